@@ -0,0 +1,881 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runACME implements "mkcert acme", a minimal RFC 8555 server that issues
+// certificates from the local CA after HTTP-01 or TLS-ALPN-01 validation, so
+// that ACME clients like cert-manager, Caddy or lego can be pointed at it.
+//
+// All state is kept in memory, so accounts and orders are lost on restart.
+// Only the required subset of the protocol is implemented: there are no
+// pre-authorizations, key changes, revocations or DNS-01 challenges.
+func runACME(args []string) {
+	fs := flag.NewFlagSet("acme", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:14000", "")
+	httpPort := fs.String("http-port", "80", "")
+	tlsPort := fs.String("tls-port", "443", "")
+	allowPublic := fs.Bool("allow-public", false, "")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: mkcert acme [-listen ADDR] [-http-port PORT] [-tls-port PORT] [-allow-public]`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	host, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		log.Fatalf("ERROR: invalid -listen address %q: %s", *listen, err)
+	}
+
+	m := &mkcert{allowPublic: *allowPublic}
+	fatalIfErr(m.LoadCA(), "failed to load the local CA")
+	if m.caKey == nil {
+		fatalErr(errNoCAKey("create new certificates"))
+	}
+
+	// The directory is served over HTTPS, as clients require, with a
+	// certificate from the local CA itself.
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if host != "" && host != "localhost" && net.ParseIP(host) == nil {
+		names = append(names, host)
+	}
+	cert, err := m.CreateTLSCertificate(context.Background(), names...)
+	fatalIfErr(err, "failed to create the server certificate")
+
+	s := &acmeServer{
+		m: m, httpPort: *httpPort, tlsPort: *tlsPort,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*acmeAccount),
+		orders:   make(map[string]*acmeOrder),
+		authzs:   make(map[string]*acmeAuthz),
+		chals:    make(map[string]*acmeChallenge),
+	}
+	srv := &http.Server{
+		Addr:      *listen,
+		Handler:   s.handler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}},
+	}
+
+	if host == "" {
+		host = "localhost"
+	}
+	log.Printf("The ACME directory is at https://%s/directory 🔐", net.JoinHostPort(host, port))
+	log.Printf("Names are validated by connecting to them on port %s (HTTP-01) or %s (TLS-ALPN-01) ℹ️", s.httpPort, s.tlsPort)
+	log.Printf("Accounts and orders are only kept in memory, and lost on restart ℹ️\n\n")
+	fatalIfErr(srv.ListenAndServeTLS("", ""), "failed to serve")
+}
+
+type acmeServer struct {
+	m                 *mkcert
+	httpPort, tlsPort string
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	chals    map[string]*acmeChallenge
+}
+
+type acmeAccount struct {
+	id         string
+	key        crypto.PublicKey
+	thumbprint string
+	contact    []string
+	status     string
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	id, accountID string
+	expires       time.Time
+	identifiers   []acmeIdentifier
+	authzs        []*acmeAuthz
+	certPEM       []byte
+}
+
+type acmeAuthz struct {
+	id, accountID string
+	identifier    acmeIdentifier
+	expires       time.Time
+	status        string
+	challenges    []*acmeChallenge
+}
+
+type acmeChallenge struct {
+	id, typ, token string
+	authz          *acmeAuthz
+	status         string
+	validated      time.Time
+	err            *acmeProblem
+}
+
+// ACME resource statuses, see RFC 8555, Section 7.1.6.
+const (
+	acmeStatusPending    = "pending"
+	acmeStatusProcessing = "processing"
+	acmeStatusReady      = "ready"
+	acmeStatusValid      = "valid"
+	acmeStatusInvalid    = "invalid"
+)
+
+// An acmeProblem is an RFC 7807 problem document with an ACME error type.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func acmeError(status int, typ, format string, args ...interface{}) *acmeProblem {
+	return &acmeProblem{Type: "urn:ietf:params:acme:error:" + typ, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+func (s *acmeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/new-nonce", s.handleNewNonce)
+	mux.HandleFunc("/new-account", s.post(s.handleNewAccount))
+	mux.HandleFunc("/account/", s.post(s.handleAccount))
+	mux.HandleFunc("/orders/", s.post(s.handleOrders))
+	mux.HandleFunc("/new-order", s.post(s.handleNewOrder))
+	mux.HandleFunc("/order/", s.post(s.handleOrder))
+	mux.HandleFunc("/authz/", s.post(s.handleAuthz))
+	mux.HandleFunc("/chall/", s.post(s.handleChallenge))
+	mux.HandleFunc("/finalize/", s.post(s.handleFinalize))
+	mux.HandleFunc("/cert/", s.post(s.handleCert))
+	return mux
+}
+
+func baseURL(r *http.Request) string {
+	return "https://" + r.Host
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	fatalIfErr(err, "failed to generate random identifier")
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *acmeServer) newNonce() string {
+	nonce := randomID(16)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonces[nonce] = true
+	return nonce
+}
+
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.nonces[nonce] {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return true
+}
+
+func (s *acmeServer) writeHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", fmt.Sprintf("<%s/directory>;rel=\"index\"", baseURL(r)))
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	s.writeHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, r *http.Request, p *acmeProblem) {
+	s.writeHeaders(w, r)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *acmeServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"meta": map[string]interface{}{
+			"website": "https://github.com/FiloSottile/mkcert",
+		},
+	})
+}
+
+func (s *acmeServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	s.writeHeaders(w, r)
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// An acmeRequest is a verified JWS request body. acct is nil only for
+// new-account requests, which are signed with a jwk instead of a kid.
+type acmeRequest struct {
+	payload    []byte
+	acct       *acmeAccount
+	key        crypto.PublicKey
+	thumbprint string
+}
+
+// post wraps a handler for a JWS-signed POST, verifying the signature, the
+// nonce, the URL and, except for new-account, the account.
+func (s *acmeServer) post(h func(w http.ResponseWriter, r *http.Request, req *acmeRequest)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			s.writeProblem(w, r, acmeError(http.StatusMethodNotAllowed, "malformed", "only POST is allowed"))
+			return
+		}
+		req, p := s.verifyJWS(r)
+		if p != nil {
+			s.writeProblem(w, r, p)
+			return
+		}
+		h(w, r, req)
+	}
+}
+
+func (s *acmeServer) verifyJWS(r *http.Request) (*acmeRequest, *acmeProblem) {
+	var msg struct {
+		Protected, Payload, Signature string
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil || json.Unmarshal(body, &msg) != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "the request is not a flattened JWS")
+	}
+	protected, err1 := base64.RawURLEncoding.DecodeString(msg.Protected)
+	payload, err2 := base64.RawURLEncoding.DecodeString(msg.Payload)
+	sig, err3 := base64.RawURLEncoding.DecodeString(msg.Signature)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid base64url encoding")
+	}
+	var header struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		KID   string          `json:"kid"`
+		JWK   json.RawMessage `json:"jwk"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid protected header: %v", err)
+	}
+	if header.URL != baseURL(r)+r.URL.Path {
+		return nil, acmeError(http.StatusUnauthorized, "unauthorized", "the url header %q doesn't match the request", header.URL)
+	}
+	if !s.useNonce(header.Nonce) {
+		return nil, acmeError(http.StatusBadRequest, "badNonce", "the nonce is invalid or was already used")
+	}
+
+	req := &acmeRequest{payload: payload}
+	newAccount := r.URL.Path == "/new-account"
+	switch {
+	case newAccount && len(header.JWK) > 0 && header.KID == "":
+		req.key, req.thumbprint, err = parseJWK(header.JWK)
+		if err != nil {
+			return nil, acmeError(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+	case !newAccount && len(header.JWK) == 0 && header.KID != "":
+		prefix := baseURL(r) + "/account/"
+		s.mu.Lock()
+		req.acct = s.accounts[strings.TrimPrefix(header.KID, prefix)]
+		s.mu.Unlock()
+		if !strings.HasPrefix(header.KID, prefix) || req.acct == nil {
+			return nil, acmeError(http.StatusBadRequest, "accountDoesNotExist", "unknown account %q", header.KID)
+		}
+		if req.acct.status != acmeStatusValid {
+			return nil, acmeError(http.StatusUnauthorized, "unauthorized", "the account is %s", req.acct.status)
+		}
+		req.key, req.thumbprint = req.acct.key, req.acct.thumbprint
+	default:
+		return nil, acmeError(http.StatusBadRequest, "malformed", "exactly one of jwk (for new-account) or kid must be set")
+	}
+
+	signed := []byte(msg.Protected + "." + msg.Payload)
+	if err := verifyJWSSignature(header.Alg, req.key, signed, sig); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+	}
+	return req, nil
+}
+
+// parseJWK parses an RSA, EC or Ed25519 JSON Web Key, and returns it along
+// with its RFC 7638 thumbprint.
+func parseJWK(data []byte) (crypto.PublicKey, string, error) {
+	var jwk struct {
+		Kty, Crv, N, E, X, Y string
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, "", fmt.Errorf("invalid jwk: %v", err)
+	}
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	var key crypto.PublicKey
+	var canonical string // the required members in lexicographic order
+	switch jwk.Kty {
+	case "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, "", errors.New("unsupported RSA key size or exponent")
+		}
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if !curve.IsOnCurve(x, y) {
+			return nil, "", errors.New("invalid EC key")
+		}
+		key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", errors.New("unsupported OKP key")
+		}
+		key = ed25519.PublicKey(x)
+		canonical = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, jwk.X)
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return key, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func verifyJWSSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+	case *ecdsa.PublicKey:
+		var h []byte
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			sum := sha256.Sum256(signed)
+			h = sum[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			sum := crypto.SHA384.New()
+			sum.Write(signed)
+			h = sum.Sum(nil)
+		default:
+			return fmt.Errorf("algorithm %q doesn't match the key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q doesn't match the key", alg)
+}
+
+func (s *acmeServer) accountJSON(r *http.Request, a *acmeAccount) interface{} {
+	return map[string]interface{}{
+		"status":  a.status,
+		"contact": a.contact,
+		"orders":  baseURL(r) + "/orders/" + a.id,
+	}
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	var acct *acmeAccount
+	for _, a := range s.accounts {
+		if a.thumbprint == req.thumbprint {
+			acct = a
+		}
+	}
+	status := http.StatusOK
+	if acct == nil && !payload.OnlyReturnExisting {
+		acct = &acmeAccount{id: randomID(12), key: req.key, thumbprint: req.thumbprint,
+			contact: payload.Contact, status: acmeStatusValid}
+		s.accounts[acct.id] = acct
+		status = http.StatusCreated
+	}
+	s.mu.Unlock()
+
+	if acct == nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "accountDoesNotExist", "no account exists with this key"))
+		return
+	}
+	if status == http.StatusCreated {
+		log.Printf("Registered ACME account %s", acct.id)
+	}
+	w.Header().Set("Location", baseURL(r)+"/account/"+acct.id)
+	s.writeJSON(w, r, status, s.accountJSON(r, acct))
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	if strings.TrimPrefix(r.URL.Path, "/account/") != req.acct.id {
+		s.writeProblem(w, r, acmeError(http.StatusUnauthorized, "unauthorized", "the account doesn't match the key"))
+		return
+	}
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+			return
+		}
+	}
+	s.mu.Lock()
+	if payload.Contact != nil {
+		req.acct.contact = payload.Contact
+	}
+	if payload.Status == "deactivated" {
+		req.acct.status = "deactivated"
+	}
+	resp := s.accountJSON(r, req.acct)
+	s.mu.Unlock()
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (s *acmeServer) handleOrders(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	if strings.TrimPrefix(r.URL.Path, "/orders/") != req.acct.id {
+		s.writeProblem(w, r, acmeError(http.StatusUnauthorized, "unauthorized", "the account doesn't match the key"))
+		return
+	}
+	s.mu.Lock()
+	orders := []string{}
+	for _, o := range s.orders {
+		if o.accountID == req.acct.id && s.orderStatus(o) != acmeStatusInvalid {
+			orders = append(orders, baseURL(r)+"/order/"+o.id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(orders)
+	s.writeJSON(w, r, http.StatusOK, map[string]interface{}{"orders": orders})
+}
+
+// orderStatus derives the status of o from its authorizations and
+// certificate. It must be called with s.mu held.
+func (s *acmeServer) orderStatus(o *acmeOrder) string {
+	if o.certPEM != nil {
+		return acmeStatusValid
+	}
+	if time.Now().After(o.expires) {
+		return acmeStatusInvalid
+	}
+	status := acmeStatusReady
+	for _, a := range o.authzs {
+		switch a.status {
+		case acmeStatusInvalid:
+			return acmeStatusInvalid
+		case acmeStatusPending:
+			status = acmeStatusPending
+		}
+	}
+	return status
+}
+
+func (s *acmeServer) orderJSON(r *http.Request, o *acmeOrder) interface{} {
+	base := baseURL(r)
+	var authzs []string
+	for _, a := range o.authzs {
+		authzs = append(authzs, base+"/authz/"+a.id)
+	}
+	resp := map[string]interface{}{
+		"status":         s.orderStatus(o),
+		"expires":        o.expires.UTC().Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       base + "/finalize/" + o.id,
+	}
+	if o.certPEM != nil {
+		resp["certificate"] = base + "/cert/" + o.id
+	}
+	return resp
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "the order must request some identifiers"))
+		return
+	}
+
+	o := &acmeOrder{id: randomID(12), accountID: req.acct.id, expires: time.Now().Add(24 * time.Hour)}
+	var names []string
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "unsupportedIdentifier", "only dns identifiers are supported"))
+			return
+		}
+		name, _, err := s.m.normalizeName(id.Value)
+		if err != nil || net.ParseIP(name) != nil || strings.ContainsAny(name, "@/") {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier", "%q is not a valid hostname", id.Value))
+			return
+		}
+		if strings.HasPrefix(name, "*.") {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier", "wildcards require DNS-01 validation, which is not supported"))
+			return
+		}
+		names = append(names, name)
+		o.identifiers = append(o.identifiers, acmeIdentifier{Type: "dns", Value: name})
+	}
+	if public := publicNames(names); len(public) > 0 && !s.m.allowPublic {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "rejectedIdentifier",
+			"%q is a public domain name, restart with -allow-public to issue for it", public[0]))
+		return
+	}
+
+	s.mu.Lock()
+	for _, id := range o.identifiers {
+		a := &acmeAuthz{id: randomID(12), accountID: req.acct.id, identifier: id,
+			expires: o.expires, status: acmeStatusPending}
+		for _, typ := range []string{"http-01", "tls-alpn-01"} {
+			c := &acmeChallenge{id: randomID(12), typ: typ, token: randomID(32), authz: a, status: acmeStatusPending}
+			a.challenges = append(a.challenges, c)
+			s.chals[c.id] = c
+		}
+		o.authzs = append(o.authzs, a)
+		s.authzs[a.id] = a
+	}
+	s.orders[o.id] = o
+	resp := s.orderJSON(r, o)
+	s.mu.Unlock()
+
+	w.Header().Set("Location", baseURL(r)+"/order/"+o.id)
+	s.writeJSON(w, r, http.StatusCreated, resp)
+}
+
+func (s *acmeServer) handleOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	s.mu.Lock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/order/")]
+	var resp interface{}
+	if o != nil && o.accountID == req.acct.id {
+		resp = s.orderJSON(r, o)
+	}
+	s.mu.Unlock()
+	if resp == nil {
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown order"))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (s *acmeServer) challengeJSON(r *http.Request, c *acmeChallenge) interface{} {
+	resp := map[string]interface{}{
+		"type":   c.typ,
+		"url":    baseURL(r) + "/chall/" + c.id,
+		"token":  c.token,
+		"status": c.status,
+	}
+	if !c.validated.IsZero() {
+		resp["validated"] = c.validated.UTC().Format(time.RFC3339)
+	}
+	if c.err != nil {
+		resp["error"] = c.err
+	}
+	return resp
+}
+
+func (s *acmeServer) handleAuthz(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	s.mu.Lock()
+	a := s.authzs[strings.TrimPrefix(r.URL.Path, "/authz/")]
+	var resp interface{}
+	if a != nil && a.accountID == req.acct.id {
+		var challenges []interface{}
+		for _, c := range a.challenges {
+			challenges = append(challenges, s.challengeJSON(r, c))
+		}
+		resp = map[string]interface{}{
+			"status":     a.status,
+			"expires":    a.expires.UTC().Format(time.RFC3339),
+			"identifier": a.identifier,
+			"challenges": challenges,
+		}
+	}
+	s.mu.Unlock()
+	if resp == nil {
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown authorization"))
+		return
+	}
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	s.mu.Lock()
+	c := s.chals[strings.TrimPrefix(r.URL.Path, "/chall/")]
+	if c == nil || c.authz.accountID != req.acct.id {
+		s.mu.Unlock()
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown challenge"))
+		return
+	}
+	// An empty payload is a POST-as-GET, while {} asks for validation.
+	if len(req.payload) > 0 && c.status == acmeStatusPending && c.authz.status == acmeStatusPending {
+		c.status = acmeStatusProcessing
+		go s.validate(c, c.token+"."+req.thumbprint)
+	}
+	resp := s.challengeJSON(r, c)
+	s.mu.Unlock()
+
+	w.Header().Add("Link", fmt.Sprintf("<%s/authz/%s>;rel=\"up\"", baseURL(r), c.authz.id))
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// validate performs the challenge c, and updates it and its authorization
+// with the result.
+func (s *acmeServer) validate(c *acmeChallenge, keyAuth string) {
+	domain := c.authz.identifier.Value
+	var err *acmeProblem
+	switch c.typ {
+	case "http-01":
+		err = s.validateHTTP01(domain, c.token, keyAuth)
+	case "tls-alpn-01":
+		err = s.validateTLSALPN01(domain, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed %s validation of %q: %s", c.typ, domain, err.Detail)
+		c.status, c.err = acmeStatusInvalid, err
+		c.authz.status = acmeStatusInvalid
+		return
+	}
+	log.Printf("Validated %q with %s", domain, c.typ)
+	c.status, c.validated = acmeStatusValid, time.Now()
+	c.authz.status = acmeStatusValid
+}
+
+func (s *acmeServer) validateHTTP01(domain, token, keyAuth string) *acmeProblem {
+	url := "http://" + net.JoinHostPort(domain, s.httpPort) + "/.well-known/acme-challenge/" + token
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return acmeError(0, "connection", "failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return acmeError(0, "connection", "failed to fetch %s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return acmeError(0, "unauthorized", "%s returned %s", url, resp.Status)
+	}
+	if strings.TrimSpace(string(body)) != keyAuth {
+		return acmeError(0, "incorrectResponse", "%s returned %q, expected %q", url, body, keyAuth)
+	}
+	return nil
+}
+
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// validateTLSALPN01 implements RFC 8737, Section 3.
+func (s *acmeServer) validateTLSALPN01(domain, keyAuth string) *acmeProblem {
+	addr := net.JoinHostPort(domain, s.tlsPort)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true, // the certificate is self-signed by design
+	})
+	if err != nil {
+		return acmeError(0, "connection", "failed to connect to %s: %v", addr, err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return acmeError(0, "unauthorized", "%s didn't negotiate the acme-tls/1 protocol", addr)
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], domain) {
+		return acmeError(0, "unauthorized", "the certificate presented by %s is not only valid for %q", addr, domain)
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidACMEIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil || !ext.Critical || !bytes.Equal(got, want[:]) {
+			return acmeError(0, "incorrectResponse", "the acmeIdentifier extension presented by %s is incorrect", addr)
+		}
+		return nil
+	}
+	return acmeError(0, "unauthorized", "the certificate presented by %s lacks the acmeIdentifier extension", addr)
+}
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	s.mu.Lock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/finalize/")]
+	var status string
+	if o != nil && o.accountID == req.acct.id {
+		status = s.orderStatus(o)
+	}
+	s.mu.Unlock()
+	switch {
+	case status == "":
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown order"))
+		return
+	case status != acmeStatusReady:
+		s.writeProblem(w, r, acmeError(http.StatusForbidden, "orderNotReady", "the order is %s, not ready", status))
+		return
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "malformed", "invalid payload: %v", err))
+		return
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "invalid CSR encoding"))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "invalid CSR: %v", err))
+		return
+	}
+	if pub, ok := csr.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "RSA keys must be at least 2048 bits"))
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, n := range csr.DNSNames {
+		names[strings.ToLower(n)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		names[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+	var hosts []string
+	for _, id := range o.identifiers {
+		hosts = append(hosts, id.Value)
+	}
+	if len(names) != len(hosts) || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "the CSR names don't match the order"))
+		return
+	}
+	for _, h := range hosts {
+		if !names[h] {
+			s.writeProblem(w, r, acmeError(http.StatusBadRequest, "badCSR", "the CSR doesn't request %q", h))
+			return
+		}
+	}
+
+	tpl := s.m.newLeafTemplate(hosts, s.m.keyType)
+	_, issuerKey := s.m.issuer()
+	tpl.SignatureAlgorithm = s.m.signatureAlgorithm(issuerKey)
+	if err := s.m.checkPolicy(tpl); err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusInternalServerError, "serverInternal", "%v", err))
+		return
+	}
+	cert, err := s.m.issueLeaf(tpl, csr.PublicKey)
+	if err != nil {
+		s.writeProblem(w, r, acmeError(http.StatusInternalServerError, "serverInternal", "failed to generate certificate: %v", err))
+		return
+	}
+	log.Printf("Issued a certificate for %s, expiring on %s 📜", strings.Join(hosts, ", "), tpl.NotAfter.Format("2 January 2006"))
+
+	s.mu.Lock()
+	o.certPEM = s.m.chainPEM(cert)
+	resp := s.orderJSON(r, o)
+	s.mu.Unlock()
+	w.Header().Set("Location", baseURL(r)+"/order/"+o.id)
+	s.writeJSON(w, r, http.StatusOK, resp)
+}
+
+func (s *acmeServer) handleCert(w http.ResponseWriter, r *http.Request, req *acmeRequest) {
+	s.mu.Lock()
+	o := s.orders[strings.TrimPrefix(r.URL.Path, "/cert/")]
+	var certPEM []byte
+	if o != nil && o.accountID == req.acct.id {
+		certPEM = o.certPEM
+	}
+	s.mu.Unlock()
+	if certPEM == nil {
+		s.writeProblem(w, r, acmeError(http.StatusNotFound, "malformed", "unknown certificate"))
+		return
+	}
+	s.writeHeaders(w, r)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(certPEM)
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// localhostNames are the names added by -also-localhost.
+var localhostNames = []string{"localhost", "127.0.0.1", "::1"}
+
+// lanNames returns the names added by -also-lan: the hostname of the machine,
+// also under .local for mDNS, and the addresses of its network interfaces
+// that are up, excluding loopback and link-local ones.
+func (m *mkcert) lanNames() []string {
+	var names []string
+	if h, err := os.Hostname(); err == nil && h != "" {
+		h = strings.TrimSuffix(strings.ToLower(h), ".")
+		short := strings.SplitN(h, ".", 2)[0]
+		// A fully qualified hostname under a public domain would be
+		// refused, and is rarely how the machine is reached on the LAN.
+		candidates := []string{short, short + ".local"}
+		if h != short && !isPublicName(h, allowedSuffixes()) {
+			candidates = append(candidates, h)
+		}
+		for _, c := range candidates {
+			if _, _, err := m.normalizeName(c); err == nil {
+				names = append(names, c)
+			}
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		m.warn(WarningHostname, "", "Warning: failed to list the network interfaces for -also-lan: %v ⚠️", err)
+		return names
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			names = append(names, ipNet.IP.String())
+		}
+	}
+	return names
+}
+
+// appendNames appends to hosts the extra names that are not already in it.
+func appendNames(hosts []string, extra ...string) []string {
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		seen[strings.ToLower(h)] = true
+	}
+	for _, e := range extra {
+		if !seen[e] {
+			seen[e] = true
+			hosts = append(hosts, e)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// LoadCA loads the existing local CA from CAROOT, or from the default
+// location if CAROOT is empty, unless CACert is set. Unlike Run, it never
+// creates a new CA, and it returns errors instead of exiting.
+func (m *mkcert) LoadCA() error {
+	if m.CACert != nil || m.caCertFile != "" {
+		return m.useExternalCA()
+	}
+	if err := m.useDefaultCAROOT(); err != nil {
+		return err
+	}
+	if !pathExists(filepath.Join(m.CAROOT, rootName)) {
+		return errorf(ErrNoCA, "there is no local CA at %q; run \"mkcert -install\" to create one", m.CAROOT)
+	}
+	if err := m.readCA(); err != nil {
+		return err
+	}
+	if err := m.validateCA(); err != nil {
+		return err
+	}
+	return m.readIntermediate()
+}
+
+// useDefaultCAROOT sets CAROOT to the default location, and the selected
+// Profile, if it's empty.
+func (m *mkcert) useDefaultCAROOT() error {
+	if m.CAROOT == "" {
+		if m.CAROOT = getCAROOT(); m.CAROOT != "" {
+			m.CAROOT = profileCAROOT(m.CAROOT, m.Profile)
+		}
+	}
+	if m.CAROOT == "" {
+		return errors.New("failed to find the default CA location; set the CAROOT environment variable")
+	}
+	m.CAROOT = canonicalPath(m.CAROOT)
+	return nil
+}
+
+// CheckInstalled returns an error matching ErrCANotInstalled if the local CA
+// is not trusted by one of the trust stores that "mkcert -install" would
+// manage, see TRUST_STORES. The CA is loaded with LoadCA if it wasn't already.
+func (m *mkcert) CheckInstalled() error {
+	if m.caCert == nil {
+		if err := m.LoadCA(); err != nil {
+			return err
+		}
+	}
+	if stores := m.uninstalledStores(); len(stores) > 0 {
+		return errorf(ErrCANotInstalled, "the local CA is not installed in the %s trust store", strings.Join(stores, ", "))
+	}
+	return nil
+}
+
+// CreateCert generates a new key and a certificate for hosts signed by the
+// local CA, and returns them PEM encoded. If there is an intermediate CA, it
+// signs the certificate and follows it in certPEM. Nothing is written to disk, and
+// nothing is logged except warnings, so servers can call it at startup. The
+// CA is loaded with LoadCA if it wasn't already.
+func (m *mkcert) CreateCert(ctx context.Context, hosts ...string) (certPEM, keyPEM []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("no hosts to create a certificate for")
+	}
+	if m.caCert == nil {
+		if err := m.LoadCA(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if m.caKey == nil {
+		return nil, nil, errNoCAKey("create new certificates")
+	}
+
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		if names[i], _, err = m.normalizeName(h); err != nil {
+			return nil, nil, err
+		}
+	}
+	if public := publicNames(names); len(public) > 0 {
+		if !m.allowPublic {
+			return nil, nil, errorf(ErrPublicName, "%q is a public domain name, which you might not control", public[0])
+		}
+		m.warnPublicNames(public)
+	}
+
+	tpl := m.newLeafTemplate(names, m.keyType)
+	_, issuerKey := m.issuer()
+	tpl.SignatureAlgorithm = m.signatureAlgorithm(issuerKey)
+	if err := m.checkPolicy(tpl); err != nil {
+		return nil, nil, err
+	}
+
+	// The key pool is on disk, so always generate a new key.
+	priv, err := m.newKey(m.keyType, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate key: %v", err)
+	}
+	defer zeroKey(priv)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	cert, err := m.issueLeaf(tpl, priv.(crypto.Signer).Public())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate: %v", err)
+	}
+	keyPEM, err = marshalKeyPEM(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode certificate key: %v", err)
+	}
+
+	return m.chainPEM(cert), keyPEM, nil
+}
+
+// CreateTLSCertificate is like CreateCert, but returns a tls.Certificate
+// ready to be used in a tls.Config, with Leaf already parsed.
+func (m *mkcert) CreateTLSCertificate(ctx context.Context, hosts ...string) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := m.CreateCert(ctx, hosts...)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(keyPEM)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Audit finding severities, from most to least urgent.
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+	severityInfo   = "info"
+)
+
+type auditFinding struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+type auditor struct {
+	m        *mkcert
+	findings []auditFinding
+}
+
+func (a *auditor) report(severity, path, format string, args ...interface{}) {
+	a.findings = append(a.findings, auditFinding{
+		Severity: severity, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// runAudit implements "mkcert audit [-json] [PATH...]", which checks the
+// CAROOT, and the certificates in PATH (by default the current directory),
+// for risky conditions. It exits with status 1 if any high severity finding
+// is reported.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	jsonFlag := fs.Bool("json", false, "")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: mkcert audit [-json] [PATH...]`)
+	}
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	caroot := getCAROOT()
+	if caroot == "" {
+		log.Fatalln("ERROR: failed to find the default CA location, set the CAROOT environment variable")
+	}
+	a := &auditor{m: &mkcert{CAROOT: canonicalPath(caroot)}}
+	a.auditCA()
+	for _, path := range paths {
+		a.auditPath(path)
+	}
+
+	var high bool
+	for _, f := range a.findings {
+		high = high || f.Severity == severityHigh
+	}
+	if *jsonFlag {
+		findings := a.findings
+		if findings == nil {
+			findings = []auditFinding{}
+		}
+		out, err := json.MarshalIndent(findings, "", "\t")
+		fatalIfErr(err, "failed to encode the findings")
+		fmt.Printf("%s\n", out)
+	} else if len(a.findings) == 0 {
+		log.Print("No issues found 👍")
+	} else {
+		for _, f := range a.findings {
+			if f.Path != "" {
+				log.Printf("[%s] %s: %s", f.Severity, f.Path, f.Message)
+			} else {
+				log.Printf("[%s] %s", f.Severity, f.Message)
+			}
+		}
+	}
+	if high {
+		os.Exit(1)
+	}
+}
+
+func (a *auditor) auditCA() {
+	m := a.m
+	certPath := filepath.Join(m.CAROOT, rootName)
+	keyPath := filepath.Join(m.CAROOT, rootKeyName)
+	if !pathExists(certPath) {
+		a.report(severityInfo, m.CAROOT, "there is no local CA yet")
+		return
+	}
+
+	if runtime.GOOS != "windows" && supportsPermissions(m.CAROOT) {
+		if fi, err := os.Stat(m.CAROOT); err == nil && fi.Mode().Perm()&0022 != 0 {
+			a.report(severityHigh, m.CAROOT, "the CAROOT is writable by other users (mode %04o), who could replace the CA", fi.Mode().Perm())
+		}
+		if fi, err := os.Stat(keyPath); err == nil && fi.Mode().Perm()&0077 != 0 {
+			a.report(severityHigh, keyPath, "the CA key is accessible to other users (mode %04o)", fi.Mode().Perm())
+		}
+	}
+
+	if err := m.readCA(); err != nil {
+		a.report(severityHigh, m.CAROOT, "%v", err)
+		return
+	}
+	if err := m.validateCA(); err != nil {
+		a.report(severityHigh, certPath, "%v", err)
+	} else if left := time.Until(m.caCert.NotAfter); left < 90*24*time.Hour {
+		a.report(severityMedium, certPath, "the local CA expires in %d days", int(left.Hours()/24))
+	}
+	a.auditKey(certPath, m.caCert)
+	if m.caKey == nil {
+		a.report(severityInfo, m.CAROOT, "the CA key is not present, so only -install works")
+	}
+}
+
+// auditPath checks the certificates issued by the local CA in path, which can
+// be a file or a directory (not recursively).
+func (a *auditor) auditPath(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		a.report(severityInfo, path, "can't be read: %v", err)
+		return
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		files, _ = filepath.Glob(filepath.Join(globEscape(path), "*.pem"))
+		crts, _ := filepath.Glob(filepath.Join(globEscape(path), "*.crt"))
+		files = append(files, crts...)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(longPath(file))
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || cert.IsCA {
+			continue
+		}
+		if !a.m.issuedByLocalCA(cert) {
+			continue // not ours
+		}
+		a.auditLeaf(file, cert)
+	}
+}
+
+func (a *auditor) auditLeaf(path string, cert *x509.Certificate) {
+	if time.Now().After(cert.NotAfter) {
+		a.report(severityLow, path, "expired on %s", cert.NotAfter.Format("2 January 2006"))
+	}
+	a.auditKey(path, cert)
+	for _, p := range policyViolations(certTemplate(cert)) {
+		a.report(severityMedium, path, "browsers will reject it: %s", p)
+	}
+	for _, name := range cert.DNSNames {
+		if name == "*" || (strings.HasPrefix(name, "*.") && !strings.Contains(name[2:], ".")) {
+			a.report(severityMedium, path, "the wildcard %q covers a whole top-level domain", name)
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.IsUnspecified() || ip.Equal(net.IPv4bcast) {
+			a.report(severityLow, path, "the IP address %s can't identify a single host", ip)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	keyPath := strings.TrimSuffix(path, filepath.Ext(path)) + "-key.pem"
+	if fi, err := os.Stat(keyPath); err == nil && fi.Mode().Perm()&0077 != 0 &&
+		supportsPermissions(filepath.Dir(keyPath)) {
+		a.report(severityMedium, keyPath, "the key is accessible to other users (mode %04o)", fi.Mode().Perm())
+	}
+}
+
+// auditKey reports weak public keys and signature algorithms.
+func (a *auditor) auditKey(path string, cert *x509.Certificate) {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			a.report(severityHigh, path, "the RSA key is only %d bits", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().BitSize < 256 {
+			a.report(severityHigh, path, "the ECDSA key is only %d bits", pub.Curve.Params().BitSize)
+		}
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		a.report(severityHigh, path, "it's signed with the weak %v algorithm", cert.SignatureAlgorithm)
+	}
+}
+
+// certTemplate returns the fields of cert that policyViolations looks at.
+func certTemplate(cert *x509.Certificate) *x509.Certificate {
+	return &x509.Certificate{
+		NotBefore: cert.NotBefore, NotAfter: cert.NotAfter,
+		ExtKeyUsage: cert.ExtKeyUsage,
+		DNSNames:    cert.DNSNames, IPAddresses: cert.IPAddresses,
+		URIs: cert.URIs, EmailAddresses: cert.EmailAddresses,
+	}
+}
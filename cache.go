@@ -0,0 +1,120 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caCache holds the CAs parsed by readCA in this process, keyed by CAROOT, so
+// that repeated operations, including Run calls on a shared mkcert, don't
+// re-read and re-parse them for every certificate. Entries are checked
+// against the size and modification time of the files, so a CA replaced on
+// disk, for example by -renew-ca in another process, is picked up.
+var caCache = struct {
+	sync.Mutex
+	entries map[string]*cachedCA
+}{entries: make(map[string]*cachedCA)}
+
+type cachedCA struct {
+	certStamp, keyStamp fileStamp
+	cert                *x509.Certificate
+	key                 crypto.PrivateKey
+	keyEncrypted        bool
+}
+
+// fileStamp identifies a version of a file without reading it.
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(longPath(path))
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// cachedCAFor returns the cached CA for caroot if the files on disk still
+// match the stamps, or nil.
+func cachedCAFor(caroot string, certStamp, keyStamp fileStamp) *cachedCA {
+	caCache.Lock()
+	defer caCache.Unlock()
+	ca := caCache.entries[caroot]
+	if ca == nil || ca.certStamp != certStamp || ca.keyStamp != keyStamp {
+		return nil
+	}
+	return ca
+}
+
+// cacheCA records a freshly parsed CA. The stamps must be taken before the
+// files are read, so that a concurrent change invalidates the entry.
+//
+// A replaced entry is not zeroed, as mkcert values might still be using it.
+func cacheCA(caroot string, ca *cachedCA) {
+	caCache.Lock()
+	defer caCache.Unlock()
+	caCache.entries[caroot] = ca
+}
+
+// forgetCAs empties the CA cache and zeroes the cached keys. It must be
+// called once no mkcert is going to issue certificates anymore.
+func forgetCAs() {
+	caCache.Lock()
+	defer caCache.Unlock()
+	for caroot, ca := range caCache.entries {
+		zeroKey(ca.key)
+		delete(caCache.entries, caroot)
+	}
+}
+
+// storeCache holds the results of checkStores, as checking the NSS and Java
+// stores means running certutil and keytool. They are keyed by everything
+// that selects the stores checked: the CA certificate, the NSS profile,
+// -user-only and $TRUST_STORES. The detection of which stores exist happens
+// once at startup, and the system root pool is itself loaded only once per
+// process by crypto/x509.
+var storeCache = struct {
+	sync.Mutex
+	entries map[string]storeStatus
+}{entries: make(map[string]storeStatus)}
+
+func (m *mkcert) storeCacheKey() string {
+	return string(m.caCert.Raw) + "\x00" + m.nssProfile + "\x00" +
+		strconv.FormatBool(m.userOnly) + "\x00" + os.Getenv("TRUST_STORES")
+}
+
+func (m *mkcert) cachedStoreStatus() (storeStatus, bool) {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	s, ok := storeCache.entries[m.storeCacheKey()]
+	return s, ok
+}
+
+func (m *mkcert) cacheStoreStatus(s storeStatus) {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	storeCache.entries[m.storeCacheKey()] = s
+}
+
+// forgetStoreStatus must be called after modifying the trust stores.
+func (m *mkcert) forgetStoreStatus() {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	for key := range storeCache.entries {
+		if strings.HasPrefix(key, string(m.caCert.Raw)+"\x00") {
+			delete(storeCache.entries, key)
+		}
+	}
+}
@@ -5,8 +5,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -15,6 +17,8 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
@@ -49,17 +53,143 @@ func init() {
 
 func (m *mkcert) makeCert(hosts []string) {
 	if m.caKey == nil {
-		log.Fatalln("ERROR: can't create new certificates because the CA key (rootCA-key.pem) is missing")
+		fatalErr(errNoCAKey("create new certificates"))
 	}
 
-	priv, err := m.generateKey(false)
-	fatalIfErr(err, "failed to generate certificate key")
-	pub := priv.(crypto.Signer).Public()
+	var tpl *x509.Certificate
+	if m.codeSigning {
+		tpl = m.newCodeSigningTemplate(hosts[0])
+	} else {
+		tpl = m.newLeafTemplate(hosts, m.keyType)
+	}
+
+	// IIS (the main target of PKCS #12 files), only shows the deprecated
+	// Common Name in the UI. See issue #115.
+	if m.pkcs12 && m.Subject.CommonName == "" {
+		tpl.Subject.CommonName = hosts[0]
+	}
+
+	cert, priv := m.signLeaf(tpl, m.keyType)
+	expiration := tpl.NotAfter
+
+	certFile, keyFile, p12File := m.fileNames(hosts)
+
+	if m.OutputFormat == formatKube {
+		privPEM, err := marshalKeyPEM(priv)
+		fatalIfErr(err, "failed to encode certificate key")
+		secret := m.kubeSecret(m.kubeSecretName(hosts[0]), m.chainPEM(cert), privPEM)
+		zero(privPEM)
+		err = writeFile(certFile, secret, 0600)
+		zero(secret)
+		fatalIfErr(err, "failed to save the Kubernetes Secret")
+	} else if m.OutputFormat == formatDER {
+		privPEM, err := m.marshalLeafKeyPEM(priv)
+		fatalIfErr(err, "failed to encode certificate key")
+		err = writeFiles(
+			outputFile{path: certFile, data: cert, perm: 0644},
+			outputFile{path: keyFile, data: keyDER(privPEM), perm: 0600},
+		)
+		zero(privPEM)
+		fatalIfErr(err, "failed to save certificate and key")
+	} else if m.OutputFormat == formatBundle {
+		privPEM, err := m.marshalLeafKeyPEM(priv)
+		fatalIfErr(err, "failed to encode certificate key")
+		bundle := append(privPEM, m.chainPEM(cert)...)
+		err = writeFile(certFile, bundle, 0600)
+		zero(bundle)
+		fatalIfErr(err, "failed to save certificate and key")
+	} else if !m.pkcs12 {
+		certPEM := m.chainPEM(cert)
+		privPEM, err := m.marshalLeafKeyPEM(priv)
+		fatalIfErr(err, "failed to encode certificate key")
+		defer zero(privPEM)
+
+		if m.keyOut != "" {
+			// Write the key first, so that the certificate is not left
+			// behind if nothing reads it.
+			err = writeKeyOut(m.keyOut, privPEM)
+			fatalIfErr(err, "failed to output the certificate key")
+			err = writeFile(certFile, certPEM, 0644)
+			fatalIfErr(err, "failed to save certificate")
+		} else if samePath(certFile, keyFile) {
+			bundle := append(certPEM, privPEM...)
+			err = writeFile(keyFile, bundle, 0600)
+			zero(bundle)
+			fatalIfErr(err, "failed to save certificate and key")
+		} else {
+			err = writeFiles(
+				outputFile{path: certFile, data: certPEM, perm: 0644},
+				outputFile{path: keyFile, data: privPEM, perm: 0600},
+			)
+			fatalIfErr(err, "failed to save certificate and key")
+		}
+	} else {
+		domainCert, _ := x509.ParseCertificate(cert)
+		pfxData, err := pkcs12.Encode(rand.Reader, priv, domainCert, m.chainCerts(), m.p12Password())
+		fatalIfErr(err, "failed to generate PKCS#12")
+		err = writeFile(p12File, pfxData, 0644)
+		zero(pfxData)
+		fatalIfErr(err, "failed to save PKCS#12")
+	}
+	if m.codeSigning && m.installMode && installPersonalCert != nil {
+		m.installCodeSigningCert(cert, priv)
+	}
+	zeroKey(priv)
+
+	issued := issuedCert{Serial: serialString(tpl.SerialNumber), Names: hosts, NotAfter: expiration}
+	if m.pkcs12 {
+		issued.P12File = p12File
+	} else if issued.CertFile = certFile; m.OutputFormat == formatBundle {
+		issued.KeyFile = certFile
+	} else if m.keyOut == "" && m.OutputFormat != formatKube {
+		issued.KeyFile = keyFile
+	}
+	m.recordIssued(issued, cert)
+
+	if m.codeSigning {
+		m.logf("\nCreated a new code signing certificate for %q 📜", hosts[0])
+	} else {
+		m.printHosts(hosts)
+	}
+
+	if m.OutputFormat == formatKube {
+		m.logf("\nThe Kubernetes TLS Secret %q is at \"%s\" ✅\n", m.kubeSecretName(hosts[0]), certFile)
+		m.logf("\nIt contains the key, so don't commit it. Apply it with \"kubectl apply -f %s\" ℹ️\n\n", certFile)
+	} else if m.OutputFormat == formatBundle {
+		m.logf("\nThe key, certificate and chain are at \"%s\" ✅\n\n", certFile)
+	} else if m.keyOut != "" {
+		m.logf("\nThe certificate is at \"%s\" and the key was sent to %s ✅\n\n", certFile, describeKeyOut(m.keyOut))
+	} else if !m.pkcs12 {
+		if samePath(certFile, keyFile) {
+			m.logf("\nThe certificate and key are at \"%s\" ✅\n\n", certFile)
+		} else {
+			m.logf("\nThe certificate is at \"%s\" and the key at \"%s\" ✅\n\n", certFile, keyFile)
+		}
+	} else {
+		m.logf("\nThe PKCS#12 bundle is at \"%s\" ✅\n", p12File)
+		if m.keyPassphrase() == "" {
+			m.logf("\nThe legacy PKCS#12 encryption password is the often hardcoded default \"changeit\" ℹ️\n\n")
+		} else {
+			m.logf("\nThe PKCS#12 encryption password is the key passphrase ℹ️\n\n")
+		}
+	}
+
+	if m.OutputFormat == formatDER && m.intCert != nil {
+		m.logf("The DER certificate doesn't include the intermediate CA, which servers must also send ℹ️\n\n")
+	}
+
+	if m.smime && !m.pkcs12 {
+		m.logf("Use -pkcs12 to generate a file that mail clients can import ℹ️\n\n")
+	}
+
+	m.logf("It will expire on %s 🗓\n\n", expiration.Format("2 January 2006"))
+}
 
-	// Certificates last for 2 years and 3 months, which is always less than
-	// 825 days, the limit that macOS/iOS apply to all certificates,
-	// including custom roots. See https://support.apple.com/en-us/HT210176.
-	expiration := time.Now().AddDate(2, 3, 0)
+// newLeafTemplate returns the template for a leaf certificate valid for hosts,
+// which must have already been validated, with the key usages of a key of
+// type kt.
+func (m *mkcert) newLeafTemplate(hosts []string, kt keyType) *x509.Certificate {
+	notBefore, notAfter := m.leafValidity()
 
 	tpl := &x509.Certificate{
 		SerialNumber: randomSerialNumber(),
@@ -68,23 +198,18 @@ func (m *mkcert) makeCert(hosts []string) {
 			OrganizationalUnit: []string{userAndHostname},
 		},
 
-		NotBefore: time.Now(), NotAfter: expiration,
+		NotBefore: notBefore, NotAfter: notAfter,
 
 		KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 	}
 
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			tpl.IPAddresses = append(tpl.IPAddresses, ip)
-		} else if email, err := mail.ParseAddress(h); err == nil && email.Address == h {
-			tpl.EmailAddresses = append(tpl.EmailAddresses, h)
-		} else if uriName, err := url.Parse(h); err == nil && uriName.Scheme != "" && uriName.Host != "" {
-			tpl.URIs = append(tpl.URIs, uriName)
-		} else {
-			tpl.DNSNames = append(tpl.DNSNames, h)
-		}
-	}
+	m.applySubject(&tpl.Subject)
+	addHostsToTemplate(tpl, hosts)
 
+	// Key encipherment is only possible with RSA keys.
+	if kt == keyTypeEd25519 {
+		tpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
 	if m.client {
 		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
 	}
@@ -94,111 +219,287 @@ func (m *mkcert) makeCert(hosts []string) {
 	if len(tpl.EmailAddresses) > 0 {
 		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
 	}
-
-	// IIS (the main target of PKCS #12 files), only shows the deprecated
-	// Common Name in the UI. See issue #115.
-	if m.pkcs12 {
-		tpl.Subject.CommonName = hosts[0]
+	if m.smime {
+		m.smimeTemplate(tpl, kt)
 	}
 
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, pub, m.caKey)
-	fatalIfErr(err, "failed to generate certificate")
-
-	certFile, keyFile, p12File := m.fileNames(hosts)
+	return tpl
+}
 
-	if !m.pkcs12 {
-		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
-		privDER, err := x509.MarshalPKCS8PrivateKey(priv)
-		fatalIfErr(err, "failed to encode certificate key")
-		privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+// smimeTemplate adjusts tpl for -smime, making it only valid for signing and
+// encrypting email, with the key usages mail clients expect for the key type,
+// like the S/MIME Baseline Requirements. RSA keys encrypt the message key
+// directly, while ECDSA keys agree on it with ECDH.
+func (m *mkcert) smimeTemplate(tpl *x509.Certificate, kt keyType) {
+	tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	switch kt {
+	case keyTypeECDSA:
+		tpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+	case keyTypeEd25519:
+		tpl.KeyUsage = x509.KeyUsageDigitalSignature
+	default:
+		tpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	// Some mail clients, like Outlook, identify certificates by their
+	// Common Name.
+	if m.Subject.CommonName == "" && len(tpl.EmailAddresses) > 0 {
+		tpl.Subject.CommonName = tpl.EmailAddresses[0]
+	}
+}
 
-		if certFile == keyFile {
-			err = ioutil.WriteFile(keyFile, append(certPEM, privPEM...), 0600)
-			fatalIfErr(err, "failed to save certificate and key")
-		} else {
-			err = ioutil.WriteFile(certFile, certPEM, 0644)
-			fatalIfErr(err, "failed to save certificate")
-			err = ioutil.WriteFile(keyFile, privPEM, 0600)
-			fatalIfErr(err, "failed to save certificate key")
+// leafValidity returns the validity period of a new leaf certificate, as
+// selected by -valid-days or -not-after, or by default 2 years and 3 months,
+// which is always less than 825 days, the limit that macOS/iOS apply to all
+// certificates, including custom roots. See https://support.apple.com/en-us/HT210176.
+//
+// The period never extends past the expiration of the CA, as the certificate
+// would stop being trusted then anyway.
+func (m *mkcert) leafValidity() (notBefore, notAfter time.Time) {
+	notBefore = time.Now()
+	switch {
+	case !m.notAfter.IsZero():
+		notAfter = m.notAfter
+	case m.validFor != 0:
+		notAfter = notBefore.Add(m.validFor)
+	default:
+		notAfter = notBefore.AddDate(2, 3, 0)
+	}
+	if ca, _ := m.issuer(); ca != nil && notAfter.After(ca.NotAfter) {
+		if !m.notAfter.IsZero() || m.validFor != 0 {
+			m.warn(WarningPolicy, "", "Warning: the certificate will expire on %s instead, along with the local CA ⚠️",
+				ca.NotAfter.Format("2 January 2006"))
 		}
-	} else {
-		domainCert, _ := x509.ParseCertificate(cert)
-		pfxData, err := pkcs12.Encode(rand.Reader, priv, domainCert, []*x509.Certificate{m.caCert}, "changeit")
-		fatalIfErr(err, "failed to generate PKCS#12")
-		err = ioutil.WriteFile(p12File, pfxData, 0644)
-		fatalIfErr(err, "failed to save PKCS#12")
+		notAfter = ca.NotAfter
 	}
+	return notBefore, notAfter
+}
 
-	m.printHosts(hosts)
-
-	if !m.pkcs12 {
-		if certFile == keyFile {
-			log.Printf("\nThe certificate and key are at \"%s\" ✅\n\n", certFile)
+// addHostsToTemplate adds each of hosts to the appropriate SAN field of tpl.
+func addHostsToTemplate(tpl *x509.Certificate, hosts []string) {
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else if email, err := mail.ParseAddress(h); err == nil && email.Address == h {
+			tpl.EmailAddresses = append(tpl.EmailAddresses, h)
+		} else if uriName, err := url.Parse(h); err == nil && uriName.Scheme != "" && uriName.Host != "" {
+			tpl.URIs = append(tpl.URIs, uriName)
 		} else {
-			log.Printf("\nThe certificate is at \"%s\" and the key at \"%s\" ✅\n\n", certFile, keyFile)
+			tpl.DNSNames = append(tpl.DNSNames, h)
 		}
-	} else {
-		log.Printf("\nThe PKCS#12 bundle is at \"%s\" ✅\n", p12File)
-		log.Printf("\nThe legacy PKCS#12 encryption password is the often hardcoded default \"changeit\" ℹ️\n\n")
 	}
+}
+
+// signLeaf generates a new key of type kt and uses the CA to sign a
+// certificate for it based on tpl.
+func (m *mkcert) signLeaf(tpl *x509.Certificate, kt keyType) (cert []byte, priv crypto.PrivateKey) {
+	_, issuerKey := m.issuer()
+	tpl.SignatureAlgorithm = m.signatureAlgorithm(issuerKey)
+	m.enforcePolicy(tpl)
+
+	priv, err := m.generateKey(kt, false)
+	fatalIfErr(err, "failed to generate certificate key")
+	cert, err = m.issueLeaf(tpl, priv.(crypto.Signer).Public())
+	fatalIfErr(err, "failed to generate certificate")
+
+	return cert, priv
+}
 
-	log.Printf("It will expire on %s 🗓\n\n", expiration.Format("2 January 2006"))
+// issueLeaf uses the CA to sign a certificate for pub based on tpl, which
+// must already have passed checkPolicy. The certificate is not recorded in the
+// issuance index, see recordIssued.
+func (m *mkcert) issueLeaf(tpl *x509.Certificate, pub crypto.PublicKey) ([]byte, error) {
+	if m.crlURL != "" {
+		tpl.CRLDistributionPoints = []string{m.crlURL}
+	}
+	if m.ocspURL != "" {
+		tpl.OCSPServer = []string{m.ocspURL}
+	}
+	issuerCert, issuerKey := m.issuer()
+	cert, err := x509.CreateCertificate(rand.Reader, tpl, issuerCert, pub, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
 }
 
 func (m *mkcert) printHosts(hosts []string) {
 	secondLvlWildcardRegexp := regexp.MustCompile(`(?i)^\*\.[0-9a-z_-]+$`)
-	log.Printf("\nCreated a new certificate valid for the following names 📜")
+	m.logf("\nCreated a new certificate valid for the following names 📜")
 	for _, h := range hosts {
-		log.Printf(" - %q", h)
+		if u, ok := m.uLabels[h]; ok {
+			m.logf(" - %q (%s)", h, u)
+		} else {
+			m.logf(" - %q", h)
+		}
 		if secondLvlWildcardRegexp.MatchString(h) {
-			log.Printf("   Warning: many browsers don't support second-level wildcards like %q ⚠️", h)
+			m.warn(WarningHostname, "", "   Warning: many browsers don't support second-level wildcards like %q ⚠️", h)
+		}
+		if strings.Contains(h, "_") && !strings.Contains(h, "@") && !strings.Contains(h, "://") {
+			m.warn(WarningHostname, "", "   Warning: underscores are not valid in hostnames, and some clients will reject %q ⚠️", h)
 		}
 	}
 
 	for _, h := range hosts {
 		if strings.HasPrefix(h, "*.") {
-			log.Printf("\nReminder: X.509 wildcards only go one level deep, so this won't match a.b.%s ℹ️", h[2:])
+			m.logf("\nReminder: X.509 wildcards only go one level deep, so this won't match a.b.%s ℹ️", h[2:])
 			break
 		}
 	}
 }
 
-func (m *mkcert) generateKey(rootCA bool) (crypto.PrivateKey, error) {
-	if m.ecdsa {
-		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	}
-	if rootCA {
-		return rsa.GenerateKey(rand.Reader, 3072)
+func (m *mkcert) generateKey(kt keyType, rootCA bool) (crypto.PrivateKey, error) {
+	if !rootCA && (kt == "" || kt == keyTypeRSA) {
+		if key := m.takePooledKey(); key != nil {
+			return key, nil
+		}
 	}
-	return rsa.GenerateKey(rand.Reader, 2048)
+	return m.newKey(kt, rootCA)
 }
 
 func (m *mkcert) fileNames(hosts []string) (certFile, keyFile, p12File string) {
-	defaultName := strings.Replace(hosts[0], ":", "_", -1)
-	defaultName = strings.Replace(defaultName, "*", "_wildcard", -1)
-	if len(hosts) > 1 {
-		defaultName += "+" + strconv.Itoa(len(hosts)-1)
-	}
-	if m.client {
-		defaultName += "-client"
+	switch {
+	case m.Filenames != nil:
+		certFile, keyFile, p12File = m.Filenames(hosts)
+	case m.nameTemplate != nil:
+		certFile, keyFile, p12File = m.templateFileNames(hosts)
+	default:
+		defaultName := m.safeFileName(hosts[0])
+		if len(hosts) > 1 {
+			defaultName += "+" + strconv.Itoa(len(hosts)-1)
+		}
+		if m.client {
+			defaultName += "-client"
+		}
+		if m.codeSigning {
+			defaultName = codeSigningFileName(hosts[0])
+		}
+		if m.certFile == "" && m.keyFile == "" && m.p12File == "" {
+			defaultName = m.avoidNameCollision(defaultName, hosts)
+		}
+
+		certFile = m.outPath(defaultName + m.certExt())
+		keyFile = m.outPath(defaultName + "-key.pem")
+		if m.OutputFormat == formatDER {
+			keyFile = m.outPath(defaultName + "-key.der")
+		}
+		p12File = m.outPath(defaultName + ".p12")
 	}
 
-	certFile = "./" + defaultName + ".pem"
 	if m.certFile != "" {
 		certFile = m.certFile
 	}
-	keyFile = "./" + defaultName + "-key.pem"
 	if m.keyFile != "" {
 		keyFile = m.keyFile
 	}
-	p12File = "./" + defaultName + ".p12"
 	if m.p12File != "" {
 		p12File = m.p12File
 	}
 
+	if m.pkcs12 {
+		m.makeParentDir(p12File)
+	} else {
+		m.makeParentDir(certFile)
+		m.makeParentDir(keyFile)
+	}
 	return
 }
 
+// avoidNameCollision returns name, or a variation of it if a certificate
+// already exists with that default name for a different set of hosts, so that
+// unrelated certificates are not silently overwritten. A certificate for the
+// same hosts is instead replaced, as a renewal.
+func (m *mkcert) avoidNameCollision(name string, hosts []string) string {
+	if m.OutputFormat == formatKube {
+		// The manifest replaces the Secret of the same name when applied
+		// anyway, and is named after the first host like the Secret.
+		return name
+	}
+	ext := m.certExt()
+	if m.pkcs12 {
+		ext = ".p12"
+	}
+	candidate := name
+	for i := 1; ; i++ {
+		existing, err := readCertFile(m.outPath(candidate+ext), m.pkcs12, m.p12Password())
+		if os.IsNotExist(err) || (err == nil && sameNames(existing, hosts)) ||
+			(err == nil && m.codeSigning && existing.Subject.CommonName == hosts[0]) {
+			break
+		}
+		candidate = name + "-" + time.Now().Format("20060102")
+		if i > 1 {
+			candidate += "-" + strconv.Itoa(i)
+		}
+	}
+	if candidate != name {
+		m.warn(WarningRenamed, "", "Note: %q already exists for different names, so the new files are named %q instead ℹ️", name+ext, candidate+ext)
+	}
+	return candidate
+}
+
+// readCertFile returns the leaf certificate in the PEM or PKCS#12 file at
+// path, decrypting the latter with p12Password.
+func readCertFile(path string, isPKCS12 bool, p12Password string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if isPKCS12 {
+		_, cert, err := pkcs12.Decode(data, p12Password)
+		return cert, err
+	}
+	if len(data) > 0 && data[0] == 0x30 { // DER SEQUENCE, see -format der
+		return x509.ParseCertificate(data)
+	}
+	// Skip the key at the start of -format bundle files.
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("unexpected content")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return nil, errors.New("unexpected content")
+		}
+	}
+}
+
+// certNames returns the names a certificate is valid for, in the same
+// format as the command line arguments.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// sameNames reports whether cert is valid for exactly the names in hosts.
+func sameNames(cert *x509.Certificate, hosts []string) bool {
+	names := make(map[string]bool)
+	for _, n := range certNames(cert) {
+		names[n] = true
+	}
+	requested := make(map[string]bool)
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			h = ip.String()
+		}
+		if !names[h] {
+			return false
+		}
+		requested[h] = true
+	}
+	return len(requested) == len(names)
+}
+
 func randomSerialNumber() *big.Int {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -206,32 +507,30 @@ func randomSerialNumber() *big.Int {
 	return serialNumber
 }
 
-func (m *mkcert) makeCertFromCSR() {
+// makeCertFromCSR signs the CSR at m.csrPath. If hosts is not empty, it
+// replaces the names requested by the CSR, while -add-san adds to them.
+func (m *mkcert) makeCertFromCSR(hosts []string) {
 	if m.caKey == nil {
-		log.Fatalln("ERROR: can't create new certificates because the CA key (rootCA-key.pem) is missing")
+		fatalErr(errNoCAKey("create new certificates"))
 	}
 
-	csrPEMBytes, err := ioutil.ReadFile(m.csrPath)
-	fatalIfErr(err, "failed to read the CSR")
-	csrPEM, _ := pem.Decode(csrPEMBytes)
-	if csrPEM == nil {
-		log.Fatalln("ERROR: failed to read the CSR: unexpected content")
-	}
-	if csrPEM.Type != "CERTIFICATE REQUEST" &&
-		csrPEM.Type != "NEW CERTIFICATE REQUEST" {
-		log.Fatalln("ERROR: failed to read the CSR: expected CERTIFICATE REQUEST, got " + csrPEM.Type)
+	csr := readCSR(m.csrPath)
+
+	m.logf("Signing a CSR for %q with a %s key 🖋", csr.Subject.String(), describeCSRKey(csr))
+	if len(hosts) > 0 && len(csrNames(csr)) > 0 {
+		m.logf("The names requested by the CSR will be replaced with the specified ones:")
+		for _, h := range csrNames(csr) {
+			m.logf(" - %q", h)
+		}
 	}
-	csr, err := x509.ParseCertificateRequest(csrPEM.Bytes)
-	fatalIfErr(err, "failed to parse the CSR")
-	fatalIfErr(csr.CheckSignature(), "invalid CSR signature")
 
-	expiration := time.Now().AddDate(2, 3, 0)
+	notBefore, notAfter := m.leafValidity()
 	tpl := &x509.Certificate{
 		SerialNumber:    randomSerialNumber(),
 		Subject:         csr.Subject,
 		ExtraExtensions: csr.Extensions, // includes requested SANs, KUs and EKUs
 
-		NotBefore: time.Now(), NotAfter: expiration,
+		NotBefore: notBefore, NotAfter: notAfter,
 
 		// If the CSR does not request a SAN extension, fix it up for them as
 		// the Common Name field does not work in modern browsers. Otherwise,
@@ -243,17 +542,171 @@ func (m *mkcert) makeCertFromCSR() {
 		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
+	// Key encipherment is only possible with RSA keys.
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); !ok {
+		tpl.KeyUsage &^= x509.KeyUsageKeyEncipherment
+	}
+
+	if len(hosts) == 0 && len(m.addSANs) > 0 {
+		// Supplement the requested names, rather than replacing them.
+		hosts = csrNames(csr)
+	}
+	if len(m.addSANs) > 0 {
+		m.checkPublicNames(m.addSANs)
+		hosts = appendNames(hosts, m.addSANs...)
+	}
+	if len(hosts) > 0 {
+		// Drop the requested SAN extension, so it doesn't override ours.
+		tpl.ExtraExtensions = withoutExtension(tpl.ExtraExtensions, oidExtensionSubjectAltName)
+		tpl.DNSNames = nil
+		addHostsToTemplate(tpl, hosts)
+	} else {
+		hosts = csrNames(csr)
+		if len(hosts) == 0 {
+			if csr.Subject.CommonName == "" {
+				log.Fatalln("ERROR: the CSR doesn't request any names, specify them as arguments or with -add-san")
+			}
+			hosts = []string{csr.Subject.CommonName}
+		}
+		m.checkPublicNames(hosts)
+	}
 
 	if m.client {
-		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+		m.addCSRClientAuth(tpl)
 	}
-	if len(csr.EmailAddresses) > 0 {
+	if len(csr.EmailAddresses) > 0 || len(tpl.EmailAddresses) > 0 {
 		tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
 	}
 
-	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, csr.PublicKey, m.caKey)
+	_, issuerKey := m.issuer()
+	tpl.SignatureAlgorithm = m.signatureAlgorithm(issuerKey)
+	m.enforcePolicy(tpl)
+	cert, err := m.issueLeaf(tpl, csr.PublicKey)
 	fatalIfErr(err, "failed to generate certificate")
 
+	certFile, _, _ := m.fileNames(hosts)
+
+	if m.OutputFormat == formatDER {
+		err = writeFile(certFile, cert, 0644)
+	} else {
+		err = writeFile(certFile, m.chainPEM(cert), 0644)
+	}
+	fatalIfErr(err, "failed to save certificate")
+	m.recordIssued(issuedCert{Serial: serialString(tpl.SerialNumber), Names: hosts, CertFile: certFile, NotAfter: notAfter}, cert)
+
+	m.printHosts(hosts)
+
+	m.logf("\nThe certificate is at \"%s\" ✅\n\n", certFile)
+
+	m.logf("It will expire on %s 🗓\n\n", notAfter.Format("2 January 2006"))
+}
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionExtKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtKeyUsageServerAuth   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	oidExtKeyUsageClientAuth   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+)
+
+// withoutExtension returns exts without the extension with the given id.
+func withoutExtension(exts []pkix.Extension, id asn1.ObjectIdentifier) []pkix.Extension {
+	var filtered []pkix.Extension
+	for _, ext := range exts {
+		if !ext.Id.Equal(id) {
+			filtered = append(filtered, ext)
+		}
+	}
+	return filtered
+}
+
+// addCSRClientAuth adds clientAuth to the extended key usages of a
+// certificate for a CSR. If the CSR requests its own, they would override
+// tpl.ExtKeyUsage, so they are moved to it, or to tpl.UnknownExtKeyUsage.
+func (m *mkcert) addCSRClientAuth(tpl *x509.Certificate) {
+	for _, ext := range tpl.ExtraExtensions {
+		if !ext.Id.Equal(oidExtensionExtKeyUsage) {
+			continue
+		}
+		var requested []asn1.ObjectIdentifier
+		if rest, err := asn1.Unmarshal(ext.Value, &requested); err != nil || len(rest) != 0 {
+			log.Fatalln("ERROR: the CSR requests invalid extended key usages")
+		}
+		tpl.ExtKeyUsage = nil
+		for _, oid := range requested {
+			switch {
+			case oid.Equal(oidExtKeyUsageClientAuth):
+			case oid.Equal(oidExtKeyUsageServerAuth):
+				tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+			default:
+				tpl.UnknownExtKeyUsage = append(tpl.UnknownExtKeyUsage, oid)
+			}
+		}
+		tpl.ExtraExtensions = withoutExtension(tpl.ExtraExtensions, oidExtensionExtKeyUsage)
+	}
+	tpl.ExtKeyUsage = append(tpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+}
+
+// readCSR reads, parses and validates a PEM or DER CSR, exiting with an
+// actionable message if it's not suitable for signing.
+func readCSR(path string) *x509.CertificateRequest {
+	csrBytes, err := ioutil.ReadFile(longPath(path))
+	fatalIfErr(err, "failed to read the CSR")
+	csrDER := csrBytes
+	if csrPEM, _ := pem.Decode(csrBytes); csrPEM != nil {
+		if csrPEM.Type != "CERTIFICATE REQUEST" &&
+			csrPEM.Type != "NEW CERTIFICATE REQUEST" {
+			log.Fatalln("ERROR: failed to read the CSR: expected CERTIFICATE REQUEST, got " + csrPEM.Type)
+		}
+		csrDER = csrPEM.Bytes
+	} else if len(csrBytes) == 0 || csrBytes[0] != 0x30 { // DER SEQUENCE
+		log.Fatalln("ERROR: failed to read the CSR: unexpected content, expected a PEM or DER encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		log.Fatalf("ERROR: failed to parse the CSR: %s\n\nThe file must contain a PEM (BEGIN CERTIFICATE REQUEST) or DER encoded PKCS #10 request, like the ones generated by \"openssl req -new\".", err)
+	}
+
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			log.Fatalf("ERROR: the CSR has a %d-bit RSA key, but keys shorter than 2048 bits are rejected by browsers; generate a new key", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			log.Fatalln("ERROR: the CSR has an ECDSA key on an unsupported curve; use P-256, P-384 or P-521")
+		}
+	case ed25519.PublicKey:
+	default:
+		if csr.PublicKeyAlgorithm == x509.DSA {
+			log.Fatalln("ERROR: the CSR has a DSA key, which is not supported; use an RSA, ECDSA or Ed25519 key")
+		}
+		log.Fatalln("ERROR: the CSR has an unsupported type of key; use an RSA, ECDSA or Ed25519 key")
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		log.Fatalf("ERROR: the CSR signature is invalid, it might have been modified after being signed: %s", err)
+	}
+
+	return csr
+}
+
+func describeCSRKey(csr *x509.CertificateRequest) string {
+	switch pub := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("%d-bit RSA", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return csr.PublicKeyAlgorithm.String()
+}
+
+// csrNames returns the names requested by a CSR, in the same format as the
+// command line arguments.
+func csrNames(csr *x509.CertificateRequest) []string {
 	var hosts []string
 	hosts = append(hosts, csr.DNSNames...)
 	hosts = append(hosts, csr.EmailAddresses...)
@@ -263,65 +716,158 @@ func (m *mkcert) makeCertFromCSR() {
 	for _, uri := range csr.URIs {
 		hosts = append(hosts, uri.String())
 	}
-	certFile, _, _ := m.fileNames(hosts)
-
-	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(
-		&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
-	fatalIfErr(err, "failed to save certificate")
-
-	m.printHosts(hosts)
-
-	log.Printf("\nThe certificate is at \"%s\" ✅\n\n", certFile)
-
-	log.Printf("It will expire on %s 🗓\n\n", expiration.Format("2 January 2006"))
+	return hosts
 }
 
-// loadCA will load or create the CA at CAROOT.
+// loadCA will load or create the CA at CAROOT. If the CA can't be used, it
+// exits with a diagnosis and a suggested remediation.
 func (m *mkcert) loadCA() {
+	if m.CACert != nil || m.caCertFile != "" {
+		if err := m.useExternalCA(); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		return
+	}
+	created := false
 	if !pathExists(filepath.Join(m.CAROOT, rootName)) {
 		m.newCA()
+		created = true
+	}
+
+	err := m.readCA()
+	if err == nil && !created && !m.uninstallMode {
+		if err := m.checkCAConstraints(); err != nil {
+			log.Fatalf("ERROR: %s\n\nRun \"mkcert -renew-ca -constrain ...\" to replace it with a new constrained local CA 👈", err)
+		}
+	}
+	if err == nil && !m.uninstallMode {
+		// Even a broken CA can be uninstalled.
+		err = m.validateCA()
+	}
+	if err == nil && !m.uninstallMode {
+		err = m.readIntermediate()
+	}
+	if err != nil {
+		log.Fatalf("ERROR: %s\n\nRun \"mkcert -renew-ca\" to replace it with a new local CA and install that instead 👈", err)
 	}
+}
+
+// readCA reads the CA certificate and, if present, key from CAROOT, or reuses
+// them from caCache if they didn't change.
+func (m *mkcert) readCA() (err error) {
+	certPath := filepath.Join(m.CAROOT, rootName)
+	keyPath := filepath.Join(m.CAROOT, rootKeyName)
+	certStamp, keyStamp := stampFile(certPath), stampFile(keyPath)
+	if ca := cachedCAFor(m.CAROOT, certStamp, keyStamp); ca != nil {
+		m.caCert, m.caKey, m.caKeyEncrypted = ca.cert, ca.key, ca.keyEncrypted
+		return nil
+	}
+	m.caCert, m.caKey, m.caKeyEncrypted = nil, nil, false
+	defer func() {
+		if err == nil {
+			cacheCA(m.CAROOT, &cachedCA{certStamp, keyStamp, m.caCert, m.caKey, m.caKeyEncrypted})
+		}
+	}()
 
-	certPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
-	fatalIfErr(err, "failed to read the CA certificate")
+	certPEMBlock, err := ioutil.ReadFile(longPath(certPath))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA certificate: %v", err)
+	}
 	certDERBlock, _ := pem.Decode(certPEMBlock)
 	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
-		log.Fatalln("ERROR: failed to read the CA certificate: unexpected content")
+		return fmt.Errorf("the CA certificate at %q is corrupted: unexpected content", certPath)
 	}
 	m.caCert, err = x509.ParseCertificate(certDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA certificate")
+	if err != nil {
+		return fmt.Errorf("the CA certificate at %q is corrupted: %v", certPath, err)
+	}
 
-	if !pathExists(filepath.Join(m.CAROOT, rootKeyName)) {
-		return // keyless mode, where only -install works
+	if !pathExists(keyPath) {
+		return nil // keyless mode, where only -install works
 	}
 
-	keyPEMBlock, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootKeyName))
-	fatalIfErr(err, "failed to read the CA key")
+	keyPEMBlock, err := ioutil.ReadFile(longPath(keyPath))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA key: %v", err)
+	}
 	keyDERBlock, _ := pem.Decode(keyPEMBlock)
-	if keyDERBlock == nil || keyDERBlock.Type != "PRIVATE KEY" {
-		log.Fatalln("ERROR: failed to read the CA key: unexpected content")
+	if keyDERBlock == nil || !strings.HasSuffix(keyDERBlock.Type, "PRIVATE KEY") {
+		return fmt.Errorf("the CA key at %q is corrupted: unexpected content", keyPath)
 	}
-	m.caKey, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes)
-	fatalIfErr(err, "failed to parse the CA key")
+	m.caKeyEncrypted = keyDERBlock.Type == "ENCRYPTED PRIVATE KEY"
+	m.caKey, err = m.parseKeyBlock(keyDERBlock)
+	zero(keyPEMBlock)
+	zero(keyDERBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to load the CA key at %q: %v", keyPath, err)
+	}
+	return nil
 }
 
-func (m *mkcert) newCA() {
-	priv, err := m.generateKey(true)
-	fatalIfErr(err, "failed to generate the CA key")
-	pub := priv.(crypto.Signer).Public()
+// validateCA checks that the loaded CA can issue certificates that will be
+// trusted once it's installed.
+func (m *mkcert) validateCA() error {
+	certPath := m.caCertPath()
+	if !m.caCert.IsCA || !m.caCert.BasicConstraintsValid {
+		return fmt.Errorf("the certificate at %q is not a CA certificate", certPath)
+	}
+	if now := time.Now(); now.After(m.caCert.NotAfter) {
+		return fmt.Errorf("the local CA expired on %s, so the certificates it issues would not be trusted",
+			m.caCert.NotAfter.Format("2 January 2006"))
+	} else if now.Before(m.caCert.NotBefore) {
+		return fmt.Errorf("the local CA is only valid starting %s, check that the system clock is correct",
+			m.caCert.NotBefore.Format("2 January 2006 15:04 MST"))
+	}
+	if m.caKey == nil {
+		return nil
+	}
+	signer, ok := m.caKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("the CA key at %q is of an unsupported type", m.caKeyPath())
+	}
+	keySPKI, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil || !bytes.Equal(keySPKI, m.caCert.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("the CA key at %q doesn't match the CA certificate at %q", m.caKeyPath(), certPath)
+	}
+	return nil
+}
 
-	spkiASN1, err := x509.MarshalPKIXPublicKey(pub)
-	fatalIfErr(err, "failed to encode public key")
+// renewCA moves the current CA, if any, to a subdirectory of CAROOT, so that
+// loadCA will generate a new one.
+func (m *mkcert) renewCA() {
+	if !pathExists(filepath.Join(m.CAROOT, rootName)) {
+		return
+	}
+	old := m.moveCA()
+	m.logf("The old local CA was moved to %q 📦", old)
+	m.logf("If it's still installed, you can remove it from the trust stores with:")
+	m.logf("\tCAROOT=%q mkcert -uninstall", old)
+	m.logln("")
+}
 
-	var spki struct {
-		Algorithm        pkix.AlgorithmIdentifier
-		SubjectPublicKey asn1.BitString
+// moveCA moves the current CA to a new subdirectory of CAROOT, and returns it.
+func (m *mkcert) moveCA() string {
+	old := filepath.Join(m.CAROOT, "previous-"+time.Now().Format("20060102-150405"))
+	fatalIfErr(os.MkdirAll(longPath(old), 0700), "failed to create the backup directory")
+	for _, name := range []string{rootName, rootKeyName, intermediateName, intermediateKeyName} {
+		if !pathExists(filepath.Join(m.CAROOT, name)) {
+			continue
+		}
+		err := os.Rename(longPath(filepath.Join(m.CAROOT, name)), longPath(filepath.Join(old, name)))
+		fatalIfErr(err, "failed to move the old CA")
 	}
-	_, err = asn1.Unmarshal(spkiASN1, &spki)
-	fatalIfErr(err, "failed to decode public key")
+	return old
+}
 
-	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
+func (m *mkcert) newCA() {
+	priv, err := m.generateKey(m.keyType, true)
+	fatalIfErr(err, "failed to generate the CA key")
+	pub := priv.(crypto.Signer).Public()
 
+	commonName := "mkcert " + userAndHostname
+	if m.Profile != "" {
+		commonName = "mkcert " + m.Profile + " " + userAndHostname
+	}
 	tpl := &x509.Certificate{
 		SerialNumber: randomSerialNumber(),
 		Subject: pkix.Name{
@@ -331,34 +877,60 @@ func (m *mkcert) newCA() {
 			// The CommonName is required by iOS to show the certificate in the
 			// "Certificate Trust Settings" menu.
 			// https://github.com/FiloSottile/mkcert/issues/47
-			CommonName: "mkcert " + userAndHostname,
+			CommonName: commonName,
 		},
-		SubjectKeyId: skid[:],
+		SubjectKeyId: subjectKeyID(pub),
 
 		NotAfter:  time.Now().AddDate(10, 0, 0),
 		NotBefore: time.Now(),
 
-		KeyUsage: x509.KeyUsageCertSign,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 		MaxPathLenZero:        true,
+
+		SignatureAlgorithm: m.signatureAlgorithm(priv),
+	}
+	if m.genIntermediateMode {
+		// Allow exactly one level of intermediate CAs.
+		tpl.MaxPathLen, tpl.MaxPathLenZero = 1, false
 	}
+	m.constrainCA(tpl)
 
 	cert, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pub, priv)
 	fatalIfErr(err, "failed to generate CA certificate")
 
-	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	privPEM, err := m.marshalCAKeyPEM(priv)
 	fatalIfErr(err, "failed to encode CA key")
-	err = ioutil.WriteFile(filepath.Join(m.CAROOT, rootKeyName), pem.EncodeToMemory(
-		&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0400)
-	fatalIfErr(err, "failed to save CA key")
+	zeroKey(priv) // loadCA will read it back from disk
+	defer zero(privPEM)
+	err = writeFiles(outputFile{
+		path: filepath.Join(m.CAROOT, rootKeyName), perm: 0400, data: privPEM,
+	}, outputFile{
+		path: filepath.Join(m.CAROOT, rootName), perm: 0644,
+		data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+	})
+	fatalIfErr(err, "failed to save CA certificate and key")
+
+	m.logf("Created a new local CA 💥\n")
+}
 
-	err = ioutil.WriteFile(filepath.Join(m.CAROOT, rootName), pem.EncodeToMemory(
-		&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
-	fatalIfErr(err, "failed to save CA key")
+// subjectKeyID returns the SHA-1 hash of the subject public key, as in
+// method (1) of RFC 5280, Section 4.2.1.2.
+func subjectKeyID(pub crypto.PublicKey) []byte {
+	spkiASN1, err := x509.MarshalPKIXPublicKey(pub)
+	fatalIfErr(err, "failed to encode public key")
 
-	log.Printf("Created a new local CA 💥\n")
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(spkiASN1, &spki)
+	fatalIfErr(err, "failed to decode public key")
+
+	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return skid[:]
 }
 
 func (m *mkcert) caUniqueName() string {
@@ -0,0 +1,72 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"regexp"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// defaultCodeSigningName is the publisher name of -code-signing certificates
+// when none is specified.
+const defaultCodeSigningName = "mkcert development code signing"
+
+// installPersonalCert, if not nil, imports a PKCS #12 file into the personal
+// certificate store of the current user, where signing tools like signtool
+// look for certificates with their keys. It's set on Windows.
+var installPersonalCert func(pfx []byte, password string) error
+
+// newCodeSigningTemplate returns the template for a -code-signing certificate
+// for the publisher name, which is only valid for signing code and has no
+// subject alternative names.
+func (m *mkcert) newCodeSigningTemplate(name string) *x509.Certificate {
+	notBefore, notAfter := m.leafValidity()
+
+	tpl := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject: pkix.Name{
+			Organization:       []string{"mkcert development certificate"},
+			OrganizationalUnit: []string{userAndHostname},
+			CommonName:         name,
+		},
+
+		NotBefore: notBefore, NotAfter: notAfter,
+
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	m.applySubject(&tpl.Subject)
+
+	return tpl
+}
+
+var unsafeFileNameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// codeSigningFileName returns the default file name, without extension, of a
+// -code-signing certificate for the publisher name.
+func codeSigningFileName(name string) string {
+	if name == defaultCodeSigningName {
+		return "codesign"
+	}
+	return unsafeFileNameRegexp.ReplaceAllString(name, "_") + "-codesign"
+}
+
+// installCodeSigningCert implements -code-signing -install on Windows, by
+// importing the certificate and its key into the personal store.
+func (m *mkcert) installCodeSigningCert(cert []byte, priv crypto.PrivateKey) {
+	leaf, err := x509.ParseCertificate(cert)
+	fatalIfErr(err, "failed to parse the code signing certificate")
+	pfx, err := pkcs12.Encode(rand.Reader, priv, leaf, nil, m.p12Password())
+	fatalIfErr(err, "failed to generate PKCS#12")
+	err = installPersonalCert(pfx, m.p12Password())
+	zero(pfx)
+	fatalIfErr(err, "failed to install the code signing certificate in the personal store")
+	m.logf("\nThe code signing certificate is installed in the personal certificate store, for signtool /a ✅")
+}
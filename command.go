@@ -0,0 +1,285 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandTimeout is how long an external command like certutil, keytool or
+// security can run before it's considered hung and killed. It can be changed
+// with $MKCERT_COMMAND_TIMEOUT, and 0 disables it. It has to leave time for
+// the user to type a sudo password.
+var commandTimeout = parseCommandTimeout()
+
+func parseCommandTimeout() time.Duration {
+	const defaultTimeout = 2 * time.Minute
+	env := os.Getenv("MKCERT_COMMAND_TIMEOUT")
+	if env == "" {
+		return defaultTimeout
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid $MKCERT_COMMAND_TIMEOUT %q, using %v ⚠️", env, defaultTimeout)
+		return defaultTimeout
+	}
+	return d
+}
+
+// CommandRunner executes external programs. All the trust store code goes
+// through it, so that it can be replaced to test that logic without touching
+// the real stores, or to sandbox or record what mkcert executes.
+type CommandRunner interface {
+	// Run runs cmd and returns its combined output, unless cmd.Stdout or
+	// cmd.Stderr are already set. If ctx is canceled before cmd exits, cmd
+	// is killed and Run returns the context error.
+	Run(ctx context.Context, cmd *exec.Cmd) ([]byte, error)
+
+	// LookPath is like exec.LookPath.
+	LookPath(file string) (string, error)
+}
+
+// runner is the CommandRunner used by mkcert. If $MKCERT_DEBUG_COMMANDS is
+// set, each command is logged before it runs.
+var runner CommandRunner = newRunner()
+
+func newRunner() CommandRunner {
+	if os.Getenv("MKCERT_DEBUG_COMMANDS") != "" {
+		return loggingRunner{execRunner{}}
+	}
+	return execRunner{}
+}
+
+// SetCommandRunner replaces how mkcert runs external programs, like certutil,
+// keytool or sudo, for example with a fake that records the commands to test
+// trust store logic, or to sandbox them. A nil r restores the default. It
+// must not be called while Run is in progress.
+func SetCommandRunner(r CommandRunner) {
+	if r == nil {
+		r = newRunner()
+	}
+	runner = r
+}
+
+// runCommand runs cmd with runner.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	return runner.Run(ctx, cmd)
+}
+
+// execRunner is the CommandRunner that actually executes commands.
+type execRunner struct{}
+
+// sudoMu serializes the commands run with sudo, as the trust stores are
+// updated concurrently, and only one at a time can prompt for a password.
+// Once one succeeded, sudo usually doesn't prompt again for a while.
+var sudoMu sync.Mutex
+
+func (execRunner) LookPath(file string) (string, error) {
+	return exec.LookPath(file)
+}
+
+// Run runs cmd. If the command doesn't exit within commandTimeout, it's
+// killed, and a warning with its output so far is logged to show what it was
+// stuck on. It's also killed, silently, if ctx is canceled.
+func (execRunner) Run(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if isSudo(cmd) {
+		sudoMu.Lock()
+		defer sudoMu.Unlock()
+	}
+	out := &lockedBuffer{}
+	if cmd.Stdout == nil {
+		cmd.Stdout = out
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = out
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timeout <-chan time.Time
+	if commandTimeout > 0 {
+		t := time.NewTimer(commandTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+		stop(cmd, done)
+		return out.Bytes(), ctx.Err()
+	case <-timeout:
+		stop(cmd, done)
+		log.Printf("Warning: %q did not complete within %v and was stopped ⚠️", strings.Join(cmd.Args, " "), commandTimeout)
+		if out.Len() > 0 {
+			log.Printf("Its output was:\n\n%s\n", out.Bytes())
+		}
+		log.Printf(`You can change the limit with $MKCERT_COMMAND_TIMEOUT, for example "5m" 👈`)
+		return out.Bytes(), fmt.Errorf("timed out after %v", commandTimeout)
+	}
+}
+
+// stopGrace is how long stop waits for a killed command to exit.
+var stopGrace = 5 * time.Second
+
+// stop kills cmd, and waits for done, the result of cmd.Wait, for at most
+// stopGrace. Wait also waits for the output to be copied, which never ends if
+// a process that couldn't be killed, like one started by sudo as root, keeps
+// it open.
+func stop(cmd *exec.Cmd, done <-chan error) {
+	stopCommand(cmd)
+	t := time.NewTimer(stopGrace)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	}
+}
+
+func isSudo(cmd *exec.Cmd) bool {
+	return len(cmd.Args) > 0 && cmd.Args[0] == "sudo"
+}
+
+// lockedBuffer is a bytes.Buffer that can be read while a command that was
+// not waited for is still writing to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Bytes returns a copy of the contents of the buffer.
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// retryPolicy describes the output of command failures that are likely to be
+// transient, like a database locked by a running browser, and what the user
+// can do if they persist.
+type retryPolicy struct {
+	markers []string
+	hint    string
+}
+
+func (p retryPolicy) transient(out []byte) bool {
+	for _, m := range p.markers {
+		if bytes.Contains(bytes.ToLower(out), []byte(strings.ToLower(m))) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	nssRetryPolicy = retryPolicy{
+		markers: []string{"SEC_ERROR_LOCKED_DATABASE", "SEC_ERROR_BAD_DATABASE", "database is locked", "SQLITE_BUSY"},
+		hint:    fmt.Sprintf("The %s security database seems to be in use, try closing %s and re-running mkcert", NSSBrowsers, NSSBrowsers),
+	}
+	keychainRetryPolicy = retryPolicy{
+		markers: []string{"busy", "resource temporarily unavailable", "interrupted system call"},
+		hint:    "The keychain seems to be in use, try closing Keychain Access and re-running mkcert",
+	}
+)
+
+const maxAttempts = 4
+
+// runCommandWithRetry runs cmd like runCommand, retrying with exponential
+// backoff if it fails in a way that policy considers transient. It stops
+// waiting as soon as ctx is canceled.
+func runCommandWithRetry(ctx context.Context, cmd *exec.Cmd, policy retryPolicy) ([]byte, error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		out, err := runCommand(ctx, cmd)
+		if err == nil || !policy.transient(out) {
+			return out, err
+		}
+		if attempt == maxAttempts {
+			log.Printf("%s 👈", policy.hint)
+			return out, err
+		}
+		log.Printf("Warning: %q failed with what looks like a temporary error, retrying in %v... ⚠️", filepath.Base(cmd.Path), backoff)
+		if err := sleepContext(ctx, backoff); err != nil {
+			return out, err
+		}
+		backoff *= 2
+		cmd = cloneCommand(cmd)
+	}
+}
+
+// sleepContext is like time.Sleep, but returns ctx.Err() early if ctx is
+// canceled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cloneCommand returns an unstarted copy of cmd, which can't be run twice.
+func cloneCommand(cmd *exec.Cmd) *exec.Cmd {
+	c := exec.Command(cmd.Path)
+	c.Args = cmd.Args
+	c.Env = cmd.Env
+	c.Dir = cmd.Dir
+	c.Stdin = cmd.Stdin
+	if r, ok := cmd.Stdin.(*bytes.Reader); ok {
+		r.Seek(0, io.SeekStart) // consumed by the previous run
+	}
+	return c
+}
+
+// loggingRunner logs each command, and its result, around running it with r.
+type loggingRunner struct {
+	r CommandRunner
+}
+
+func (l loggingRunner) LookPath(file string) (string, error) {
+	path, err := l.r.LookPath(file)
+	log.Printf("[command] look up %q: %q %v", file, path, err)
+	return path, err
+}
+
+func (l loggingRunner) Run(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	log.Printf("[command] run %q", cmd.Args)
+	out, err := l.r.Run(ctx, cmd)
+	if err != nil {
+		log.Printf("[command] %q failed: %v", cmd.Args[0], err)
+	}
+	return out, err
+}
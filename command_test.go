@@ -0,0 +1,177 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResult is what fakeRunner returns for a command.
+type fakeResult struct {
+	out []byte
+	err error
+}
+
+// fakeRunner is a CommandRunner that records the commands it's asked to run
+// instead of running them, and returns canned results.
+type fakeRunner struct {
+	mu     sync.Mutex
+	cmds   [][]string
+	stdins []string
+
+	// results are returned, in order, for the commands whose arguments
+	// start with the key, joined by spaces. Commands without results, or
+	// after the results ran out, succeed with no output.
+	results map[string][]fakeResult
+
+	// paths are the programs LookPath finds.
+	paths map[string]bool
+}
+
+func (f *fakeRunner) Run(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var stdin []byte
+	if cmd.Stdin != nil {
+		stdin, _ = ioutil.ReadAll(cmd.Stdin)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cmds = append(f.cmds, cmd.Args)
+	f.stdins = append(f.stdins, string(stdin))
+	line := strings.Join(cmd.Args, " ")
+	for prefix, results := range f.results {
+		if strings.HasPrefix(line, prefix) && len(results) > 0 {
+			f.results[prefix] = results[1:]
+			return results[0].out, results[0].err
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeRunner) LookPath(file string) (string, error) {
+	if f.paths[file] {
+		return "/fake/bin/" + file, nil
+	}
+	return "", exec.ErrNotFound
+}
+
+// useFakeRunner replaces the runner with f for the duration of the test.
+func useFakeRunner(t *testing.T, f *fakeRunner) {
+	SetCommandRunner(f)
+	t.Cleanup(func() { SetCommandRunner(nil) })
+}
+
+// newTestCA returns an mkcert with a new CA certificate, without a key,
+// saved in a temporary CAROOT.
+func newTestCA(t *testing.T) *mkcert {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{Organization: []string{"mkcert development CA"}, CommonName: "mkcert test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageCertSign,
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caroot, err := ioutil.TempDir("", "mkcert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(caroot) })
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(caroot, rootName), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &mkcert{CAROOT: caroot, caCert: cert, Logger: discardLogger{}}
+}
+
+// setTrustStores sets $TRUST_STORES for the duration of the test.
+func setTrustStores(t *testing.T, stores string) {
+	old, ok := os.LookupEnv("TRUST_STORES")
+	os.Setenv("TRUST_STORES", stores)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("TRUST_STORES", old)
+		} else {
+			os.Unsetenv("TRUST_STORES")
+		}
+	})
+}
+
+func TestRunCommandWithRetry(t *testing.T) {
+	locked := fakeResult{[]byte("SEC_ERROR_LOCKED_DATABASE"), errors.New("exit status 255")}
+	failed := fakeResult{[]byte("SEC_ERROR_BAD_PASSWORD"), errors.New("exit status 255")}
+	tests := []struct {
+		name    string
+		results []fakeResult
+		runs    int
+		wantErr bool
+	}{
+		{"success", nil, 1, false},
+		{"transient", []fakeResult{locked}, 2, false},
+		{"permanent", []fakeResult{failed}, 1, true},
+		{"transient then permanent", []fakeResult{locked, failed}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRunner{results: map[string][]fakeResult{"certutil": tt.results}}
+			useFakeRunner(t, f)
+			_, err := runCommandWithRetry(context.Background(), exec.Command("certutil", "-A"), nssRetryPolicy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if len(f.cmds) != tt.runs {
+				t.Errorf("ran %d times, want %d", len(f.cmds), tt.runs)
+			}
+		})
+	}
+}
+
+func TestRunCommandWithRetryStdin(t *testing.T) {
+	f := &fakeRunner{results: map[string][]fakeResult{"keytool": {
+		{[]byte("SQLITE_BUSY"), errors.New("exit status 1")},
+	}}}
+	useFakeRunner(t, f)
+	cmd := exec.Command("keytool", "-importcert")
+	cmd.Stdin = bytes.NewReader([]byte("certificate"))
+	if _, err := runCommandWithRetry(context.Background(), cmd, nssRetryPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"certificate", "certificate"}; !reflect.DeepEqual(f.stdins, want) {
+		t.Errorf("stdin of the attempts = %q, want %q", f.stdins, want)
+	}
+}
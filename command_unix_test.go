@@ -0,0 +1,75 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// forkingCommand returns a command whose child outlives it, holding its
+// output open, like the one sudo starts.
+func forkingCommand() *exec.Cmd {
+	return exec.Command("sh", "-c", "sleep 30 & echo started; wait")
+}
+
+func TestExecRunnerTimeoutKillsChildren(t *testing.T) {
+	old := commandTimeout
+	commandTimeout = 200 * time.Millisecond
+	defer func() { commandTimeout = old }()
+
+	start := time.Now()
+	out, err := execRunner{}.Run(context.Background(), forkingCommand())
+	if err == nil {
+		t.Fatal("Run succeeded, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= stopGrace {
+		t.Errorf("Run returned after %v, want the forked child killed right away", elapsed)
+	}
+	if string(out) != "started\n" {
+		t.Errorf("output = %q, want the output before the timeout", out)
+	}
+}
+
+func TestExecRunnerCancelKillsChildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := execRunner{}.Run(ctx, forkingCommand())
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed >= stopGrace {
+		t.Errorf("Run returned after %v, want the forked child killed right away", elapsed)
+	}
+}
+
+func TestStopGrace(t *testing.T) {
+	old := stopGrace
+	stopGrace = 500 * time.Millisecond
+	defer func() { stopGrace = old }()
+
+	// Without a process group, like for sudo, the child keeps the output
+	// open, and Wait doesn't return until it exits.
+	cmd := exec.Command("sh", "-c", "sleep 5 & wait")
+	cmd.Stdout = &lockedBuffer{}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	start := time.Now()
+	stop(cmd, done)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop returned after %v, want about %v", elapsed, stopGrace)
+	}
+}
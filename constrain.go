@@ -0,0 +1,151 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// defaultPermittedIPRanges are the IP ranges a constrained CA is limited to
+// if none are specified, as otherwise it could issue certificates for any IP
+// address.
+var defaultPermittedIPRanges = []string{"127.0.0.0/8", "::1/128"}
+
+// parseNameConstraints parses the entries of -constrain, which are domains
+// (including their subdomains), wildcards like "*.localhost" (only the
+// subdomains), IP addresses or CIDR ranges.
+func parseNameConstraints(entries []string) (domains []string, ipRanges []*net.IPNet, err error) {
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		switch {
+		case e == "":
+			continue
+		case strings.Contains(e, "/"):
+			_, ipNet, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid IP range %q", e)
+			}
+			ipRanges = append(ipRanges, ipNet)
+		case net.ParseIP(e) != nil:
+			ip := net.ParseIP(e)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ipRanges = append(ipRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			domain := strings.ToLower(strings.TrimSuffix(e, "."))
+			if strings.HasPrefix(domain, "*.") {
+				domain = domain[1:]
+			}
+			if !hostnameRegexp.MatchString(strings.TrimPrefix(domain, ".")) {
+				return nil, nil, fmt.Errorf("invalid domain %q", e)
+			}
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 && len(ipRanges) == 0 {
+		return nil, nil, errors.New("no domains or IP ranges specified")
+	}
+	if len(ipRanges) == 0 {
+		for _, r := range defaultPermittedIPRanges {
+			_, ipNet, _ := net.ParseCIDR(r)
+			ipRanges = append(ipRanges, ipNet)
+		}
+	}
+	return domains, ipRanges, nil
+}
+
+// constrainCA limits the CA template tpl to m.NameConstraints, if any.
+func (m *mkcert) constrainCA(tpl *x509.Certificate) {
+	if len(m.NameConstraints) == 0 {
+		return
+	}
+	domains, ipRanges, err := parseNameConstraints(m.NameConstraints)
+	fatalIfErr(err, "invalid name constraints")
+	tpl.PermittedDNSDomainsCritical = true
+	tpl.PermittedDNSDomains = domains
+	tpl.PermittedIPRanges = ipRanges
+}
+
+// checkCAConstraints returns an error if m.NameConstraints is set, but the
+// existing local CA was created with different (or no) constraints, which
+// can only be changed by replacing it.
+func (m *mkcert) checkCAConstraints() error {
+	if len(m.NameConstraints) == 0 {
+		return nil
+	}
+	domains, ipRanges, err := parseNameConstraints(m.NameConstraints)
+	if err != nil {
+		return err
+	}
+	if constraintsString(domains, ipRanges) != constraintsString(m.caCert.PermittedDNSDomains, m.caCert.PermittedIPRanges) {
+		return errors.New("the name constraints of the existing local CA can't be changed")
+	}
+	return nil
+}
+
+func constraintsString(domains []string, ipRanges []*net.IPNet) string {
+	var s []string
+	s = append(s, domains...)
+	for _, r := range ipRanges {
+		s = append(s, r.String())
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// constraintViolations returns the names of tpl that are outside the name
+// constraints of the local CA, which clients would reject.
+func (m *mkcert) constraintViolations(tpl *x509.Certificate) []string {
+	ca := m.caCert
+	if ca == nil || (len(ca.PermittedDNSDomains) == 0 && len(ca.PermittedIPRanges) == 0) {
+		return nil
+	}
+	var problems []string
+	for _, name := range tpl.DNSNames {
+		if len(ca.PermittedDNSDomains) == 0 {
+			break
+		}
+		var ok bool
+		for _, d := range ca.PermittedDNSDomains {
+			ok = ok || domainPermitted(strings.ToLower(name), d)
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q is outside the name constraints of the local CA", name))
+		}
+	}
+	for _, ip := range tpl.IPAddresses {
+		if len(ca.PermittedIPRanges) == 0 {
+			break
+		}
+		var ok bool
+		for _, r := range ca.PermittedIPRanges {
+			ok = ok || r.Contains(ip)
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is outside the name constraints of the local CA", ip))
+		}
+	}
+	return problems
+}
+
+// domainPermitted implements the RFC 5280 matching of a DNS name constraint:
+// "example.test" permits itself and its subdomains, while ".example.test"
+// only permits the subdomains. Wildcards match like the names they stand for.
+func domainPermitted(name, constraint string) bool {
+	if strings.HasPrefix(name, "*.") {
+		name = "x" + name[1:]
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint) && name != constraint
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
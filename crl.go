@@ -0,0 +1,120 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"path/filepath"
+	"time"
+)
+
+const crlName = "crl.pem"
+
+// crlValidity is how long a CRL is valid for, after which clients that check
+// revocation will reject it until -gen-crl is run again.
+const crlValidity = 7 * 24 * time.Hour
+
+// Revoke marks cert, which must have been issued by the local CA, as revoked
+// in the issuance index, so that it's listed in the CRLs created from then
+// on. Certificates issued before the index existed are added to it.
+func (m *mkcert) Revoke(cert *x509.Certificate) error {
+	issuer := m.caCert
+	if m.intCert != nil && cert.CheckSignatureFrom(m.intCert) == nil {
+		issuer = m.intCert
+	} else if cert.CheckSignatureFrom(m.caCert) != nil {
+		return errors.New("the certificate was not issued by the local CA")
+	}
+	if cert.IsCA {
+		return errors.New("the certificate is a CA, run \"mkcert -renew-ca\" to replace the local CA instead")
+	}
+	serial := serialString(cert.SerialNumber)
+	now := time.Now()
+	return m.updateIndex(func(entries []indexEntry) []indexEntry {
+		for i, e := range entries {
+			if e.Serial == serial && e.Issuer == caID(issuer) {
+				if e.RevokedAt == nil {
+					entries[i].RevokedAt = &now
+				}
+				return entries
+			}
+		}
+		e := newIndexEntry(cert, issuer)
+		e.RevokedAt = &now
+		return append(entries, e)
+	})
+}
+
+// CreateCRL returns a DER encoded CRL, signed by the CA that issues leaves
+// (the intermediate CA, if any), listing the certificates it issued that were
+// revoked and haven't expired yet.
+func (m *mkcert) CreateCRL() ([]byte, error) {
+	issuerCert, issuerKey := m.issuer()
+	if issuerKey == nil {
+		return nil, errNoCAKey("sign a CRL")
+	}
+	entries, err := m.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var revoked []pkix.RevokedCertificate
+	for _, e := range entries {
+		if e.RevokedAt == nil || e.Issuer != caID(issuerCert) || now.After(e.NotAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(e.Serial, 16)
+		if !ok {
+			return nil, errors.New("invalid serial number in the issuance index: " + e.Serial)
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber: serial, RevocationTime: e.RevokedAt.UTC(),
+		})
+	}
+	return issuerCert.CreateCRL(rand.Reader, issuerKey, revoked, now, now.Add(crlValidity))
+}
+
+// writeCRL implements -gen-crl, and refreshes the CRL after -revoke.
+func (m *mkcert) writeCRL() {
+	if issuerCert, _ := m.issuer(); issuerCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		m.warn(WarningRevocation, "", "Warning: the local CA was created before mkcert supported CRLs, so some clients will reject its CRLs. "+
+			"Run \"mkcert -renew-ca\" to replace it ⚠️")
+	}
+	crl, err := m.CreateCRL()
+	fatalIfErr(err, "failed to create the CRL")
+	crlPath := filepath.Join(m.CAROOT, crlName)
+	err = writeFile(crlPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0644)
+	fatalIfErr(err, "failed to save the CRL")
+
+	m.logf("The CRL is at \"%s\", valid until %s ✅\n", crlPath, time.Now().Add(crlValidity).Format("2 January 2006"))
+	if m.crlURL == "" {
+		m.logf("Serve it and use -crl-url when issuing certificates to point clients to it ℹ️\n")
+	}
+}
+
+// revokeFiles implements -revoke, calling Revoke for the certificate in each
+// of paths and then refreshing the CRL.
+func (m *mkcert) revokeFiles(paths []string) {
+	if len(paths) == 0 {
+		log.Fatalln("ERROR: -revoke requires the certificate files to revoke as arguments")
+	}
+	for _, path := range paths {
+		chain, err := readCertChain(path)
+		if err != nil {
+			log.Fatalf("ERROR: failed to read %q: %s", path, err)
+		}
+		if err := m.Revoke(chain[0]); err != nil {
+			log.Fatalf("ERROR: failed to revoke %q: %s", path, err)
+		}
+		m.logf(" - %q (serial %s) was revoked 🚫", path, serialString(chain[0].SerialNumber))
+	}
+	m.logln("")
+	m.writeCRL()
+}
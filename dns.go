@@ -0,0 +1,180 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The hosts file entries managed by mkcert are kept between these markers,
+// so that they can be listed and removed without touching anything else.
+const (
+	hostsBlockStart = "# BEGIN mkcert managed entries"
+	hostsBlockEnd   = "# END mkcert managed entries"
+)
+
+var hostsFile = "/etc/hosts"
+
+func init() {
+	if runtime.GOOS == "windows" {
+		hostsFile = filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+}
+
+type hostsEntry struct {
+	ip, host string
+}
+
+func runDNS(args []string) {
+	if len(args) == 0 {
+		log.Fatalln(`ERROR: usage: "mkcert dns add HOST... [IP]", "mkcert dns remove HOST..." or "mkcert dns list"`)
+	}
+	m := &mkcert{}
+	switch args[0] {
+	case "add":
+		ip := "127.0.0.1"
+		hosts := args[1:]
+		if len(hosts) > 0 && net.ParseIP(hosts[len(hosts)-1]) != nil {
+			ip = hosts[len(hosts)-1]
+			hosts = hosts[:len(hosts)-1]
+		}
+		if len(hosts) == 0 {
+			log.Fatalln("ERROR: no hostnames to add")
+		}
+		m.addDNSEntries(hosts, ip)
+	case "remove":
+		if len(args) == 1 {
+			log.Fatalln("ERROR: no hostnames to remove")
+		}
+		m.removeDNSEntries(args[1:])
+	case "list":
+		_, entries := readHostsFile()
+		for _, e := range entries {
+			m.logf("%s\t%s", e.ip, e.host)
+		}
+	default:
+		log.Fatalf("ERROR: unknown dns command %q", args[0])
+	}
+}
+
+// addDNSEntries makes the hostnames among hosts resolve to ip through the
+// hosts file. IPs, emails, URIs and wildcards are skipped.
+func (m *mkcert) addDNSEntries(hosts []string, ip string) {
+	other, entries := readHostsFile()
+	var added []string
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if net.ParseIP(h) != nil || strings.Contains(h, "@") || strings.Contains(h, "://") {
+			continue
+		}
+		if strings.HasPrefix(h, "*.") {
+			m.warn(WarningHostname, "", "Warning: the hosts file doesn't support wildcards, so %q can't be resolved automatically ⚠️", h)
+			continue
+		}
+		var found bool
+		for i, e := range entries {
+			if e.host == h {
+				entries[i].ip, found = ip, true
+			}
+		}
+		if !found {
+			entries = append(entries, hostsEntry{ip: ip, host: h})
+		}
+		added = append(added, h)
+	}
+	if len(added) == 0 {
+		return
+	}
+	m.writeHostsFile(other, entries)
+	m.logf("The following names now resolve to %s via %q 🧭", ip, hostsFile)
+	for _, h := range added {
+		m.logf(" - %q", h)
+	}
+}
+
+func (m *mkcert) removeDNSEntries(hosts []string) {
+	other, entries := readHostsFile()
+	var kept []hostsEntry
+	var removed bool
+	for _, e := range entries {
+		var match bool
+		for _, h := range hosts {
+			if e.host == strings.ToLower(strings.TrimSuffix(h, ".")) {
+				match = true
+			}
+		}
+		if match {
+			removed = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if !removed {
+		m.logf("No matching entries found in %q ℹ️", hostsFile)
+		return
+	}
+	m.writeHostsFile(other, kept)
+	m.logf("The entries are now removed from %q 👋", hostsFile)
+}
+
+// readHostsFile returns the lines of the hosts file outside the mkcert block,
+// and the entries inside it, one per hostname, as lines edited by hand might
+// list several aliases for an IP.
+func readHostsFile() (other []string, entries []hostsEntry) {
+	data, err := ioutil.ReadFile(hostsFile)
+	fatalIfErr(err, "failed to read the hosts file")
+	var inBlock bool
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == hostsBlockStart:
+			inBlock = true
+		case line == hostsBlockEnd:
+			inBlock = false
+		case inBlock:
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			for i := 1; i < len(fields); i++ {
+				entries = append(entries, hostsEntry{ip: fields[0], host: fields[i]})
+			}
+		default:
+			other = append(other, line)
+		}
+	}
+	return
+}
+
+func (m *mkcert) writeHostsFile(other []string, entries []hostsEntry) {
+	var buf bytes.Buffer
+	for _, line := range other {
+		buf.WriteString(line + "\n")
+	}
+	if len(entries) > 0 {
+		buf.WriteString(hostsBlockStart + "\n")
+		for _, e := range entries {
+			buf.WriteString(e.ip + "\t" + e.host + "\n")
+		}
+		buf.WriteString(hostsBlockEnd + "\n")
+	}
+
+	if runtime.GOOS == "windows" {
+		err := ioutil.WriteFile(hostsFile, buf.Bytes(), 0644)
+		fatalIfErr(err, "failed to write the hosts file (try running as Administrator)")
+		return
+	}
+	cmd := commandWithSudo("tee", hostsFile)
+	cmd.Stdin = &buf
+	out, err := runCommand(m.context(), cmd)
+	fatalIfCmdErr(err, "tee "+hostsFile, out)
+}
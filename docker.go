@@ -0,0 +1,103 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerCertDir is where the -docker snippet mounts the certificate and key
+// inside the container.
+const dockerCertDir = "/etc/ssl/mkcert"
+
+// dockerCAPath is where the -docker snippet mounts the local CA inside the
+// container, so that update-ca-certificates picks it up in Debian, Ubuntu and
+// Alpine based images.
+const dockerCAPath = "/usr/local/share/ca-certificates/mkcert-rootCA.crt"
+
+// dockerServiceName returns a docker-compose service name for host, like
+// "myservice" for "myservice.test".
+func dockerServiceName(host string) string {
+	name := strings.SplitN(strings.TrimPrefix(host, "*."), ".", 2)[0]
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	if name = strings.Trim(name, "-"); name == "" {
+		return "app"
+	}
+	return name
+}
+
+// printDockerCompose implements -docker, printing a docker-compose snippet
+// that mounts the certificate, key and local CA into a service container.
+func (m *mkcert) printDockerCompose(c issuedCert) {
+	abs := func(path string) string {
+		if p, err := filepath.Abs(path); err == nil {
+			return p
+		}
+		return path
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "services:\n  %s:\n    volumes:\n", dockerServiceName(c.Names[0]))
+	fmt.Fprintf(b, "      - %q\n", abs(c.CertFile)+":"+dockerCertDir+"/cert.pem:ro")
+	if c.KeyFile != "" {
+		fmt.Fprintf(b, "      - %q\n", abs(c.KeyFile)+":"+dockerCertDir+"/key.pem:ro")
+	}
+	fmt.Fprintf(b, "      - %q\n", abs(m.caCertPath())+":"+dockerCAPath+":ro")
+	fmt.Fprintf(b, "    environment:\n      NODE_EXTRA_CA_CERTS: %s\n", dockerCAPath)
+
+	m.logf("Add this to your docker-compose.yml to use the certificate in the container 🐳\n\n%s\n", b)
+	m.logf("The certificate and key will be at %q and %q.", dockerCertDir+"/cert.pem", dockerCertDir+"/key.pem")
+	m.logf("For programs in the container to trust the local CA, run \"update-ca-certificates\" when it starts,")
+	m.logf("or install it in the running container with \"mkcert -docker-container NAME\" ℹ️\n\n")
+}
+
+// dockerInstallScript installs the certificate on stdin as the trust anchor
+// named $1, with whichever tool the image has. Like for the Linux system store,
+// the certificate is passed on stdin instead of with "docker cp", which
+// doesn't work with all storage drivers and container runtimes.
+const dockerInstallScript = `set -e
+if command -v update-ca-certificates >/dev/null 2>&1; then
+	mkdir -p /usr/local/share/ca-certificates
+	cat > "/usr/local/share/ca-certificates/$1.crt"
+	update-ca-certificates
+elif command -v update-ca-trust >/dev/null 2>&1; then
+	mkdir -p /etc/pki/ca-trust/source/anchors
+	cat > "/etc/pki/ca-trust/source/anchors/$1.pem"
+	update-ca-trust extract
+else
+	echo "neither update-ca-certificates nor update-ca-trust is available" >&2
+	exit 3
+fi
+`
+
+// installInContainer implements -docker-container, installing the local CA
+// in the system trust store of a running container. Like any change to a
+// container, it's lost when the container is recreated.
+func (m *mkcert) installInContainer(container string) {
+	if !binaryExists("docker") {
+		log.Fatalln(`ERROR: "docker" is not available, so the local CA can't be installed in the container`)
+	}
+	name := strings.Replace(m.caUniqueName(), " ", "_", -1)
+	cmd := exec.Command("docker", "exec", "-i", "-u", "0", container, "sh", "-c", dockerInstallScript, "sh", name)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw}))
+	out, err := runCommand(m.context(), cmd)
+	fatalIfCmdErr(err, "docker exec "+container, out)
+	m.logf("The local CA is now installed in the container %q! 🐳", container)
+	m.logf("It will need to be installed again if the container is recreated, see -docker ℹ️\n\n")
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// These errors are wrapped by the errors of functions like LoadCA and
+// CreateCert, so that they can be told apart with errors.Is. The CLI exits
+// with a distinct status for each of them, see exitCode.
+var (
+	// ErrNoCA means there is no local CA in the CAROOT.
+	ErrNoCA = errors.New("no local CA")
+	// ErrCAKeyMissing means the local CA can't sign anything because its
+	// key, rootCA-key.pem, is missing.
+	ErrCAKeyMissing = errors.New("the CA key is missing")
+	// ErrCANotInstalled means the local CA is not trusted by a trust store.
+	ErrCANotInstalled = errors.New("the local CA is not installed")
+	// ErrInvalidHostname means a name is not a valid hostname, IP address,
+	// URL or email address.
+	ErrInvalidHostname = errors.New("invalid hostname")
+	// ErrPublicName means a name is under a public domain, which the user
+	// might not control, and public names were not allowed.
+	ErrPublicName = errors.New("public domain name")
+	// ErrPolicy means browsers would reject the certificate, and
+	// non-compliant certificates were not allowed.
+	ErrPolicy = errors.New("non-compliant certificate")
+)
+
+// A TrustStoreError records a failure to install the local CA into, or
+// uninstall it from, a trust store.
+type TrustStoreError struct {
+	// Store is "system", "nss" or "java", like Warning.Store.
+	Store string
+	Err   error
+}
+
+func (e *TrustStoreError) Error() string { return e.Err.Error() }
+
+func (e *TrustStoreError) Unwrap() error { return e.Err }
+
+// kindError is an error with its own message that matches one of the Err*
+// sentinels with errors.Is.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+
+func (e *kindError) Unwrap() error { return e.kind }
+
+// errorf is like fmt.Errorf, but the error matches kind with errors.Is.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// errNoCAKey returns the ErrCAKeyMissing error for when the CA key would be
+// needed to do action.
+func errNoCAKey(action string) error {
+	return errorf(ErrCAKeyMissing, "can't %s because the CA key (rootCA-key.pem) is missing", action)
+}
+
+// The exit codes of the CLI. Usage errors of the subcommands exit with 2,
+// like the flag package does.
+const (
+	exitFailure      = 1
+	exitUsage        = 2
+	exitInvalidName  = 3 // ErrInvalidHostname or ErrPublicName
+	exitNoCA         = 4 // ErrNoCA or ErrCAKeyMissing
+	exitNotInstalled = 5 // ErrCANotInstalled
+	exitTrustStore   = 6 // *TrustStoreError
+	exitPolicy       = 7 // ErrPolicy
+)
+
+// exitCode returns the exit code of the CLI for err.
+func exitCode(err error) int {
+	var storeErr *TrustStoreError
+	switch {
+	case errors.Is(err, ErrInvalidHostname), errors.Is(err, ErrPublicName):
+		return exitInvalidName
+	case errors.Is(err, ErrNoCA), errors.Is(err, ErrCAKeyMissing):
+		return exitNoCA
+	case errors.Is(err, ErrCANotInstalled):
+		return exitNotInstalled
+	case errors.As(err, &storeErr):
+		return exitTrustStore
+	case errors.Is(err, ErrPolicy):
+		return exitPolicy
+	}
+	return exitFailure
+}
+
+// fatalErr logs err and exits with its exit code.
+func fatalErr(err error) {
+	log.Printf("ERROR: %s", err)
+	os.Exit(exitCode(err))
+}
+
+// fatalIfStoreErr is like fatalIfErr, for a failure to manage store.
+func fatalIfStoreErr(store string, err error, msg string) {
+	if err != nil {
+		fatalErr(&TrustStoreError{Store: store, Err: fmt.Errorf("%s: %s", msg, err)})
+	}
+}
+
+// fatalIfStoreCmdErr is like fatalIfCmdErr, for a command managing store.
+func fatalIfStoreCmdErr(store string, err error, cmd string, out []byte) {
+	if err != nil {
+		fatalErr(&TrustStoreError{Store: store, Err: fmt.Errorf("failed to execute \"%s\": %s\n\n%s\n", cmd, err, out)})
+	}
+}
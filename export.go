@@ -0,0 +1,350 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A CA export is either a gzipped tar archive of rootCA.pem and
+// rootCA-key.pem, with a SHA256SUMS file to detect corruption, or, if it has a
+// passphrase, an encrypted archive.
+//
+// An encrypted CA export is a tar archive of rootCA.pem and rootCA-key.pem,
+// sealed with AES-256-GCM under a key derived from a passphrase with
+// PBKDF2-HMAC-SHA256. The header is authenticated as additional data, so any
+// modification of the file is detected before anything is unpacked.
+//
+//	magic || salt (16 bytes) || iterations (uint32) || nonce (12 bytes) || ciphertext
+const exportMagic = "mkcert encrypted CA v1\n"
+
+const (
+	exportIterations    = 600000
+	maxExportIterations = 10000000
+	exportSaltSize      = 16
+	exportHeaderSize    = len(exportMagic) + exportSaltSize + 4 + 12
+)
+
+// exportSumsName is the checksums file of unencrypted CA exports, in the
+// format of sha256sum.
+const exportSumsName = "SHA256SUMS"
+
+// exportPassphraseEnv is the passphrase of encrypted CA exports.
+const exportPassphraseEnv = "MKCERT_PASSPHRASE"
+
+// ExportCA writes the local CA certificate and key to w, as a gzipped tar
+// archive, or as an encrypted archive if passphrase is not empty. CAROOT
+// defaults to the default location, like in LoadCA.
+func (m *mkcert) ExportCA(w io.Writer, passphrase string) error {
+	if err := m.useDefaultCAROOT(); err != nil {
+		return err
+	}
+	certPEM, err := ioutil.ReadFile(longPath(filepath.Join(m.CAROOT, rootName)))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA certificate: %v", err)
+	}
+	keyPEM, err := ioutil.ReadFile(longPath(filepath.Join(m.CAROOT, rootKeyName)))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA key: %v", err)
+	}
+	defer zero(keyPEM)
+
+	files := []exportFile{{rootName, certPEM, 0644}, {rootKeyName, keyPEM, 0400}}
+	if passphrase == "" {
+		sums := &bytes.Buffer{}
+		for _, f := range files {
+			sum := sha256.Sum256(f.data)
+			fmt.Fprintf(sums, "%s  %s\n", hex.EncodeToString(sum[:]), f.name)
+		}
+		files = append(files, exportFile{exportSumsName, sums.Bytes(), 0644})
+		gw := gzip.NewWriter(w)
+		if err := writeExportTar(gw, files); err != nil {
+			return err
+		}
+		return gw.Close()
+	}
+
+	var archive bytes.Buffer
+	if err := writeExportTar(&archive, files); err != nil {
+		return err
+	}
+	defer zero(archive.Bytes())
+	sealed, err := sealExport([]byte(passphrase), archive.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the archive: %v", err)
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+type exportFile struct {
+	name string
+	data []byte
+	mode int64
+}
+
+func writeExportTar(w io.Writer, files []exportFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: f.mode, Size: int64(len(f.data)), ModTime: time.Now()}); err != nil {
+			return fmt.Errorf("failed to create the archive: %v", err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return fmt.Errorf("failed to create the archive: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to create the archive: %v", err)
+	}
+	return nil
+}
+
+// errExportPassphrase is returned by ImportCA for encrypted archives if the
+// passphrase is empty.
+var errExportPassphrase = errors.New("the archive is encrypted, and requires a passphrase")
+
+// isEncryptedExport reports whether data starts like an encrypted CA export.
+func isEncryptedExport(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(exportMagic))
+}
+
+// ImportCA reads a CA export produced by ExportCA from r, checks it, and
+// saves it as the local CA in CAROOT, unless CAROOT already has a different
+// CA. passphrase is only used for encrypted archives.
+func (m *mkcert) ImportCA(r io.Reader, passphrase string) error {
+	if err := m.useDefaultCAROOT(); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read the archive: %v", err)
+	}
+
+	var tr *tar.Reader
+	sumsRequired := true
+	if isEncryptedExport(data) {
+		if passphrase == "" {
+			return errExportPassphrase
+		}
+		archive, err := openExport([]byte(passphrase), data)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt the archive: %v", err)
+		}
+		defer zero(archive)
+		// The AEAD already detects any modification.
+		tr, sumsRequired = tar.NewReader(bytes.NewReader(archive)), false
+	} else {
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return errors.New("not an mkcert CA archive")
+		}
+		tr = tar.NewReader(gr)
+	}
+
+	files := make(map[string][]byte)
+	defer func() { zero(files[rootKeyName]) }()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %v", err)
+		}
+		if hdr.Name != rootName && hdr.Name != rootKeyName && hdr.Name != exportSumsName {
+			return fmt.Errorf("unexpected file %q in the archive", hdr.Name)
+		}
+		if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return fmt.Errorf("failed to read the archive: %v", err)
+		}
+	}
+	if err := checkExportSums(files, sumsRequired); err != nil {
+		return err
+	}
+
+	certBlock, _ := pem.Decode(files[rootName])
+	keyBlock, _ := pem.Decode(files[rootKeyName])
+	if certBlock == nil || keyBlock == nil {
+		return errors.New("the archive doesn't contain a CA certificate and key")
+	}
+	if m.caCert, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return fmt.Errorf("failed to parse the CA certificate: %v", err)
+	}
+	if m.caKey, err = m.parseKeyBlock(keyBlock); err != nil {
+		return fmt.Errorf("failed to parse the CA key: %v", err)
+	}
+	if err := m.validateCA(); err != nil {
+		return fmt.Errorf("the imported CA can't be used: %v", err)
+	}
+
+	if err := os.MkdirAll(longPath(m.CAROOT), 0755); err != nil {
+		return fmt.Errorf("failed to create the CAROOT: %v", err)
+	}
+	unlock := m.lockCAROOT()
+	defer unlock()
+	certPath := filepath.Join(m.CAROOT, rootName)
+	if existing, err := ioutil.ReadFile(longPath(certPath)); err == nil {
+		if bytes.Equal(existing, files[rootName]) {
+			return nil
+		}
+		return fmt.Errorf("there is already a different local CA at %q; set $CAROOT to an empty directory, or run \"mkcert -renew-ca\" to move the current one aside first", m.CAROOT)
+	}
+	err = writeFiles(outputFile{
+		path: filepath.Join(m.CAROOT, rootKeyName), perm: 0400, data: files[rootKeyName],
+	}, outputFile{
+		path: certPath, perm: 0644, data: files[rootName],
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save the CA certificate and key: %v", err)
+	}
+	return nil
+}
+
+// checkExportSums verifies the SHA256SUMS file of an archive, if present,
+// against the other files, which must all be listed.
+func checkExportSums(files map[string][]byte, required bool) error {
+	sums, ok := files[exportSumsName]
+	if !ok {
+		if required {
+			return fmt.Errorf("the archive has no %s file", exportSumsName)
+		}
+		return nil
+	}
+	checked := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(sums)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid %s file in the archive", exportSumsName)
+		}
+		data, ok := files[fields[1]]
+		if !ok {
+			return fmt.Errorf("the archive is missing %q", fields[1])
+		}
+		sum := sha256.Sum256(data)
+		if fields[0] != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("the checksum of %q doesn't match, the archive is corrupted", fields[1])
+		}
+		checked[fields[1]] = true
+	}
+	for name := range files {
+		if name != exportSumsName && !checked[name] {
+			return fmt.Errorf("%q is not listed in %s", name, exportSumsName)
+		}
+	}
+	return nil
+}
+
+// writeExport saves the export of the local CA to path, for -export-ca.
+func (m *mkcert) writeExport(path, passphrase string) {
+	var archive bytes.Buffer
+	fatalIfErr(m.ExportCA(&archive, passphrase), "failed to export the local CA")
+	err := writeFile(path, archive.Bytes(), 0600)
+	zero(archive.Bytes())
+	fatalIfErr(err, "failed to save the archive")
+	m.logf("The local CA at %q is exported to %q 📦", m.CAROOT, path)
+	if passphrase == "" {
+		m.logf("The archive is not encrypted, and contains the CA key: keep it safe, or set $%s to encrypt it ⚠️", exportPassphraseEnv)
+	}
+}
+
+// readExport imports the CA export at path, asking for the passphrase if the
+// archive is encrypted and $MKCERT_PASSPHRASE is not set, for -import-ca.
+func (m *mkcert) readExport(path string) {
+	data, err := ioutil.ReadFile(longPath(path))
+	fatalIfErr(err, "failed to read the archive")
+
+	passphrase := os.Getenv(exportPassphraseEnv)
+	if passphrase == "" && isEncryptedExport(data) {
+		fmt.Fprint(os.Stderr, "Enter the archive passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalln("ERROR: failed to read the passphrase")
+		}
+		passphrase = strings.TrimSpace(line)
+	}
+
+	existing, _ := ioutil.ReadFile(longPath(filepath.Join(m.CAROOT, rootName)))
+	fatalIfErr(m.ImportCA(bytes.NewReader(data), passphrase), "failed to import the local CA")
+	defer zeroKey(m.caKey)
+	if existing != nil {
+		m.logf("The local CA at %q is already the imported one 👍", m.CAROOT)
+		return
+	}
+	m.logf("The local CA is now imported at %q ✨", m.CAROOT)
+	m.logf(`Run "mkcert -install" to trust it on this machine 👈`)
+}
+
+func sealExport(passphrase, plaintext []byte) ([]byte, error) {
+	header := make([]byte, exportHeaderSize)
+	copy(header, exportMagic)
+	salt := header[len(exportMagic) : len(exportMagic)+exportSaltSize]
+	binary.BigEndian.PutUint32(header[len(exportMagic)+exportSaltSize:], exportIterations)
+	nonce := header[len(exportMagic)+exportSaltSize+4:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := exportAEAD(passphrase, salt, exportIterations)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+func openExport(passphrase, sealed []byte) ([]byte, error) {
+	if len(sealed) < exportHeaderSize || string(sealed[:len(exportMagic)]) != exportMagic {
+		return nil, errors.New("not an mkcert encrypted CA archive")
+	}
+	header := sealed[:exportHeaderSize]
+	salt := header[len(exportMagic) : len(exportMagic)+exportSaltSize]
+	iterations := binary.BigEndian.Uint32(header[len(exportMagic)+exportSaltSize:])
+	nonce := header[len(exportMagic)+exportSaltSize+4:]
+	if iterations == 0 || iterations > maxExportIterations {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+	aead, err := exportAEAD(passphrase, salt, int(iterations))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, sealed[exportHeaderSize:], header)
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the archive is corrupted")
+	}
+	return plaintext, nil
+}
+
+func exportAEAD(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2.Key(passphrase, salt, iterations, 32, sha256.New)
+	defer zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
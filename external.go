@@ -0,0 +1,102 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// caCertPath returns the path of the CA certificate, for error messages and
+// for the trust stores that install it from a file.
+func (m *mkcert) caCertPath() string {
+	if m.caCertFile != "" {
+		return m.caCertFile
+	}
+	return filepath.Join(m.CAROOT, rootName)
+}
+
+// caKeyPath is like caCertPath, for the CA key.
+func (m *mkcert) caKeyPath() string {
+	if m.caKeyFile != "" {
+		return m.caKeyFile
+	}
+	return filepath.Join(m.CAROOT, rootKeyName)
+}
+
+// useExternalCA loads the CA from -ca-cert and -ca-key, or from CACert and
+// CAKey, instead of the local CA in CAROOT, which is then never created.
+func (m *mkcert) useExternalCA() error {
+	if m.caCertFile != "" && m.CACert == nil {
+		if err := m.readExternalCA(); err != nil {
+			return err
+		}
+	}
+	m.caCert, m.caKey, m.caKeyEncrypted = m.CACert, m.CAKey, false
+	m.intCert, m.intKey = nil, nil
+	return m.validateCA()
+}
+
+// readExternalCA reads CACert and CAKey from -ca-cert and -ca-key. The key
+// can be PKCS #8, PKCS #1 or SEC 1, and encrypted with the key passphrase, or
+// a pkcs11: URI for a key in a PKCS #11 token, see openPKCS11Key.
+func (m *mkcert) readExternalCA() error {
+	certPEM, err := ioutil.ReadFile(longPath(m.caCertFile))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA certificate: %v", err)
+	}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return fmt.Errorf("no PEM certificate found in %q", m.caCertFile)
+		}
+		if block.Type == "CERTIFICATE" {
+			if m.CACert, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return fmt.Errorf("the CA certificate at %q is corrupted: %v", m.caCertFile, err)
+			}
+			break
+		}
+	}
+
+	if m.caKeyFile == "" {
+		return nil // keyless mode, where only -install works
+	}
+	if isPKCS11URI(m.caKeyFile) {
+		if m.CAKey, err = openPKCS11Key(m.caKeyFile); err != nil {
+			return fmt.Errorf("failed to load the CA key from the PKCS #11 token: %v", err)
+		}
+		return nil
+	}
+	keyPEM, err := ioutil.ReadFile(longPath(m.caKeyFile))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA key: %v", err)
+	}
+	defer zero(keyPEM)
+	for rest := keyPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return fmt.Errorf("no PEM private key found in %q", m.caKeyFile)
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		if _, ok := block.Headers["DEK-Info"]; ok {
+			return errors.New("legacy encrypted PEM keys are not supported, convert it to PKCS #8 with \"openssl pkcs8 -topk8\"")
+		}
+		m.CAKey, err = m.parseKeyBlock(block)
+		zero(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to load the CA key at %q: %v", m.caKeyFile, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// fileNameData is the data of -name-template, executed once for each file.
+type fileNameData struct {
+	// FirstHost is the first host, made safe for file names like the
+	// default names, as in "_wildcard.example.test".
+	FirstHost string
+	Hosts     []string
+	// Type is "cert", "key" or "p12".
+	Type string
+	// Ext is the usual extension of the file, like ".pem", ".der" or ".p12".
+	Ext string
+}
+
+func parseNameTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// Check the fields, so that mistakes are reported before issuing.
+	err = tmpl.Execute(&bytes.Buffer{}, fileNameData{FirstHost: "example.test",
+		Hosts: []string{"example.test"}, Type: "cert", Ext: ".pem"})
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// outPath returns the path of the file name in -out-dir, or in the current
+// directory.
+func (m *mkcert) outPath(name string) string {
+	if m.outDir == "" {
+		return "./" + name
+	}
+	return filepath.Join(m.outDir, name)
+}
+
+// templateFileNames returns the file names for hosts from -name-template.
+func (m *mkcert) templateFileNames(hosts []string) (certFile, keyFile, p12File string) {
+	certExt, keyExt := ".pem", ".pem"
+	switch m.OutputFormat {
+	case formatDER:
+		certExt, keyExt = ".der", ".der"
+	case formatKube:
+		certExt = ".yaml"
+	}
+	name := func(typ, ext string) string {
+		var b strings.Builder
+		err := m.nameTemplate.Execute(&b, fileNameData{
+			FirstHost: m.safeFileName(hosts[0]), Hosts: hosts, Type: typ, Ext: ext,
+		})
+		fatalIfErr(err, "failed to execute -name-template")
+		if b.Len() == 0 {
+			log.Fatalf("ERROR: -name-template produced an empty name for the %s file", typ)
+		}
+		if filepath.IsAbs(b.String()) {
+			return b.String()
+		}
+		return m.outPath(b.String())
+	}
+	return name("cert", certExt), name("key", keyExt), name("p12", ".p12")
+}
+
+// safeFileName returns host, or its Unicode form with -unicode-names, with
+// the characters that are not allowed in file names replaced.
+func (m *mkcert) safeFileName(host string) string {
+	if u, ok := m.uLabels[host]; ok && m.unicodeNames {
+		host = u
+	}
+	host = strings.Replace(host, ":", "_", -1)
+	return strings.Replace(host, "*", "_wildcard", -1)
+}
+
+// makeParentDir creates the directory of an output file, if -out-dir,
+// -name-template or Filenames put it in one that doesn't exist yet.
+func (m *mkcert) makeParentDir(path string) {
+	if path == "" {
+		return
+	}
+	fatalIfErr(os.MkdirAll(longPath(filepath.Dir(path)), 0755), "failed to create the output directory")
+}
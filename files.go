@@ -0,0 +1,152 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// outputFile is a file to be written by writeFiles.
+type outputFile struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+// writeFiles atomically writes a set of related files, like a certificate
+// and its key. Each file is first written to a temporary file in the
+// destination directory and then renamed into place, so a crash or a full
+// disk never leaves a partially written file behind. If any file fails, the
+// ones already renamed into place are rolled back to their previous contents,
+// which are moved aside until then, so that a certificate is never left
+// without its matching key.
+func writeFiles(files ...outputFile) error {
+	var temps []string
+	cleanup := func() {
+		for _, t := range temps {
+			os.Remove(longPath(t))
+		}
+	}
+	for _, f := range files {
+		tmp, err := writeTempFile(f)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		temps = append(temps, tmp)
+	}
+
+	// A single rename is atomic on its own, so there is nothing to restore.
+	// Otherwise, only the files this call renamed into place are removed, and
+	// only the ones it moved aside are put back.
+	backups := make([]string, len(files))
+	placed := make([]bool, len(files))
+	restore := func() {
+		for i, f := range files {
+			switch {
+			case backups[i] != "":
+				os.Rename(longPath(backups[i]), longPath(f.path))
+			case placed[i]:
+				os.Remove(longPath(f.path))
+			}
+		}
+	}
+	for i, f := range files {
+		if len(files) > 1 && pathExists(f.path) {
+			backup := temps[i] + ".bak"
+			if err := os.Rename(longPath(f.path), longPath(backup)); err != nil {
+				restore()
+				cleanup()
+				return fmt.Errorf("failed to move %q aside: %v", f.path, err)
+			}
+			backups[i] = backup
+		}
+		if err := os.Rename(longPath(temps[i]), longPath(f.path)); err != nil {
+			restore()
+			cleanup()
+			return fmt.Errorf("failed to move %q into place: %v", f.path, err)
+		}
+		placed[i] = true
+	}
+	for _, b := range backups {
+		if b != "" {
+			os.Remove(longPath(b))
+		}
+	}
+	return nil
+}
+
+// writeFile atomically writes a single file. See writeFiles.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	return writeFiles(outputFile{path: path, data: data, perm: perm})
+}
+
+var noPermissionsWarning sync.Once
+
+func writeTempFile(f outputFile) (string, error) {
+	tmp, err := ioutil.TempFile(longPath(filepath.Dir(f.path)), "."+filepath.Base(f.path)+".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(f.data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), f.perm)
+		if err != nil && !supportsPermissions(filepath.Dir(tmp.Name())) {
+			err = nil
+		}
+	}
+	if err == nil && f.perm&0077 == 0 && !supportsPermissions(filepath.Dir(tmp.Name())) {
+		noPermissionsWarning.Do(func() {
+			log.Printf("Warning: %q is on a file system that doesn't support permissions (like FAT or some network shares), so it's readable by other users! ⚠️", f.path)
+		})
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// samePath reports whether a and b refer to the same file, even through
+// different relative paths or symlinks, and even if it doesn't exist yet.
+func samePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+	fa, errA := os.Stat(longPath(a))
+	fb, errB := os.Stat(longPath(b))
+	if errA == nil && errB == nil {
+		return os.SameFile(fa, fb)
+	}
+	return canonicalPath(a) == canonicalPath(b)
+}
+
+// canonicalPath returns an absolute form of path with symlinks resolved, as
+// far as they exist, for comparisons.
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	// The file might not exist yet, but its directory might be a symlink.
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		return filepath.Join(dir, filepath.Base(abs))
+	}
+	return abs
+}
@@ -0,0 +1,33 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileFailureKeepsDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkcert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A file can't be renamed over a directory, which the failed write must
+	// leave alone like it would an existing certificate.
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFile(blocked, []byte("new"), 0644); err == nil {
+		t.Fatal("writeFile succeeded, want an error")
+	}
+	if !pathExists(blocked) {
+		t.Errorf("the destination was removed after a failed rename")
+	}
+}
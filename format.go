@@ -0,0 +1,50 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+)
+
+// Output formats for OutputFormat.
+const (
+	formatPEM    = ""       // separate certificate and key PEM files (default)
+	formatDER    = "der"    // separate certificate and key DER files (-format der)
+	formatBundle = "bundle" // a single PEM file with key, certificate and chain (-format bundle)
+	formatKube   = "kube"   // a Kubernetes TLS Secret manifest (-kube)
+)
+
+// parseFormat parses the value of -format.
+func parseFormat(s string) (string, error) {
+	switch s {
+	case "", "pem":
+		return formatPEM, nil
+	case formatDER, formatBundle:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown -format %q, expected pem, der or bundle", s)
+}
+
+// certExt returns the suffix of the certificate file name for the output
+// format, which for bundles also identifies them as including the key.
+func (m *mkcert) certExt() string {
+	switch m.OutputFormat {
+	case formatKube:
+		return "-secret.yaml"
+	case formatDER:
+		return ".der"
+	case formatBundle:
+		return "-bundle.pem"
+	}
+	return ".pem"
+}
+
+// keyDER returns the DER contents of a PEM key from marshalLeafKeyPEM, which
+// is an encrypted PKCS #8 structure if the key is encrypted.
+func keyDER(keyPEM []byte) []byte {
+	block, _ := pem.Decode(keyPEM)
+	return block.Bytes
+}
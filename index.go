@@ -0,0 +1,173 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const indexName = "issued.json"
+
+// An indexEntry records a leaf certificate issued by the local CA in the
+// issuance index in the CAROOT, which tracks revocations and is listed by
+// -list.
+type indexEntry struct {
+	Serial   string    `json:"serial"` // hexadecimal
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	IssuedAt time.Time `json:"issued_at"`
+	// Issuer identifies the CA that signed the certificate, see caID.
+	Issuer string `json:"issuer"`
+	// Path is where the certificate was saved, if known.
+	Path string `json:"path,omitempty"`
+
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// caID returns an identifier for the key of a CA certificate, the hex
+// SHA-256 of its SubjectPublicKeyInfo.
+func caID(ca *x509.Certificate) string {
+	h := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:])
+}
+
+func serialString(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+func newIndexEntry(cert *x509.Certificate, issuer *x509.Certificate) indexEntry {
+	// Client, preset and code signing certificates might only have a
+	// Common Name.
+	names := certNames(cert)
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = []string{cert.Subject.CommonName}
+	}
+	return indexEntry{
+		Serial:   serialString(cert.SerialNumber),
+		Names:    names,
+		NotAfter: cert.NotAfter,
+		IssuedAt: cert.NotBefore,
+		Issuer:   caID(issuer),
+	}
+}
+
+// readIndex returns the entries of the issuance index, which might not exist.
+func (m *mkcert) readIndex() ([]indexEntry, error) {
+	data, err := ioutil.ReadFile(longPath(filepath.Join(m.CAROOT, indexName)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []indexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("the issuance index %q is corrupted: %v", filepath.Join(m.CAROOT, indexName), err)
+	}
+	return entries, nil
+}
+
+// updateIndex applies update to the entries of the issuance index, and saves
+// the result, holding the CAROOT lock so that concurrent invocations don't
+// lose each other's changes.
+func (m *mkcert) updateIndex(update func([]indexEntry) []indexEntry) error {
+	unlock := m.lockCAROOT()
+	defer unlock()
+	entries, err := m.readIndex()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(update(entries), "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(m.CAROOT, indexName), append(data, '\n'), 0644)
+}
+
+// indexIssued adds the certificate der, just issued by the current CA and
+// saved to path if not empty, to the issuance index. Failing to do so is not
+// fatal, as the certificate can still be revoked later from its file.
+func (m *mkcert) indexIssued(der []byte, path string) {
+	issuer, _ := m.issuer()
+	cert, err := x509.ParseCertificate(der)
+	if err == nil {
+		entry := newIndexEntry(cert, issuer)
+		if path != "" {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			entry.Path = path
+		}
+		err = m.updateIndex(func(entries []indexEntry) []indexEntry {
+			return append(entries, entry)
+		})
+	}
+	if err != nil {
+		m.warn(WarningRevocation, "", "Warning: failed to record the certificate in the issuance index: %v ⚠️", err)
+	}
+}
+
+// listEntry is an issuance index entry as printed by -list.
+type listEntry struct {
+	indexEntry
+	// Status is "valid", "expired", "revoked", or "other CA" if the
+	// certificate was issued by a previous or external CA.
+	Status string `json:"status"`
+}
+
+// listIssued implements -list, printing the issuance index to w as a table,
+// or as a JSON array if asJSON is set.
+func (m *mkcert) listIssued(w io.Writer, asJSON bool) {
+	entries, err := m.readIndex()
+	fatalIfErr(err, "failed to read the issuance index")
+	var current string
+	if ca, err := readProfileCA(m.CAROOT); err == nil {
+		current = caID(ca)
+	}
+
+	list := make([]listEntry, 0, len(entries))
+	for _, e := range entries {
+		status := "valid"
+		switch {
+		case e.RevokedAt != nil:
+			status = "revoked"
+		case time.Now().After(e.NotAfter):
+			status = "expired"
+		case e.Issuer != current:
+			status = "other CA"
+		}
+		list = append(list, listEntry{e, status})
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		fatalIfErr(enc.Encode(list), "failed to encode the issuance index")
+		return
+	}
+	if len(list) == 0 {
+		m.logf("No certificates were issued by the local CA at %q yet", m.CAROOT)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tEXPIRES\tSTATUS\tNAMES\tPATH")
+	for _, e := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Serial, e.NotAfter.Format("2006-01-02"),
+			e.Status, strings.Join(e.Names, ","), e.Path)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const intermediateName = "intermediateCA.pem"
+const intermediateKeyName = "intermediateCA-key.pem"
+
+// newIntermediate creates an intermediate CA signed by the root, and saves it
+// in CAROOT, replacing the existing one, if any. From then on, leaves are
+// issued by the intermediate, and their files contain the full chain.
+func (m *mkcert) newIntermediate() {
+	if m.caKey == nil {
+		fatalErr(errNoCAKey("create an intermediate CA"))
+	}
+	if m.caCert.MaxPathLen == 0 {
+		log.Fatalln("ERROR: the local CA was created with a path length constraint that forbids intermediate CAs\n\n" +
+			"Run \"mkcert -renew-ca -gen-intermediate\" to replace it with a new local CA that allows one 👈")
+	}
+	if m.intCert != nil {
+		m.logf("Replacing the existing intermediate CA, certificates it issued will keep working until the old one expires ℹ️")
+	}
+
+	priv, err := m.newKey(m.keyType, true)
+	fatalIfErr(err, "failed to generate the intermediate CA key")
+	defer zeroKey(priv)
+	pub := priv.(crypto.Signer).Public()
+
+	notAfter := time.Now().AddDate(5, 0, 0)
+	if notAfter.After(m.caCert.NotAfter) {
+		notAfter = m.caCert.NotAfter
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject: pkix.Name{
+			Organization:       []string{"mkcert development CA"},
+			OrganizationalUnit: []string{userAndHostname},
+			CommonName:         "mkcert intermediate " + userAndHostname,
+		},
+		SubjectKeyId: subjectKeyID(pub),
+
+		NotAfter:  notAfter,
+		NotBefore: time.Now(),
+
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		SignatureAlgorithm: m.signatureAlgorithm(m.caKey),
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, pub, m.caKey)
+	fatalIfErr(err, "failed to generate the intermediate CA certificate")
+
+	privPEM, err := m.marshalCAKeyPEM(priv)
+	fatalIfErr(err, "failed to encode the intermediate CA key")
+	defer zero(privPEM)
+	err = writeFiles(outputFile{
+		path: filepath.Join(m.CAROOT, intermediateKeyName), perm: 0400, data: privPEM,
+	}, outputFile{
+		path: filepath.Join(m.CAROOT, intermediateName), perm: 0644,
+		data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+	})
+	fatalIfErr(err, "failed to save the intermediate CA certificate and key")
+
+	fatalIfErr(m.readIntermediate(), "failed to load the new intermediate CA")
+	m.logf("Created a new intermediate CA, valid until %s 🔗\n", notAfter.Format("2 January 2006"))
+}
+
+// readIntermediate loads the intermediate CA from CAROOT, if there is one,
+// and checks that it was issued by the root and can still be used.
+func (m *mkcert) readIntermediate() error {
+	m.intCert, m.intKey = nil, nil
+	certPath := filepath.Join(m.CAROOT, intermediateName)
+	if !pathExists(certPath) {
+		return nil
+	}
+
+	certPEMBlock, err := ioutil.ReadFile(longPath(certPath))
+	if err != nil {
+		return fmt.Errorf("failed to read the intermediate CA certificate: %v", err)
+	}
+	certDERBlock, _ := pem.Decode(certPEMBlock)
+	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
+		return fmt.Errorf("the intermediate CA certificate at %q is corrupted: unexpected content", certPath)
+	}
+	cert, err := x509.ParseCertificate(certDERBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("the intermediate CA certificate at %q is corrupted: %v", certPath, err)
+	}
+	if err := cert.CheckSignatureFrom(m.caCert); err != nil {
+		return fmt.Errorf("the intermediate CA at %q was not issued by the local CA; remove it, or run \"mkcert -gen-intermediate\" to replace it", certPath)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("the intermediate CA expired on %s; run \"mkcert -gen-intermediate\" to replace it",
+			cert.NotAfter.Format("2 January 2006"))
+	}
+
+	keyPath := filepath.Join(m.CAROOT, intermediateKeyName)
+	keyPEMBlock, err := ioutil.ReadFile(longPath(keyPath))
+	if err != nil {
+		return fmt.Errorf("failed to read the intermediate CA key: %v", err)
+	}
+	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	zero(keyPEMBlock)
+	if keyDERBlock == nil || !strings.HasSuffix(keyDERBlock.Type, "PRIVATE KEY") {
+		return fmt.Errorf("the intermediate CA key at %q is corrupted: unexpected content", keyPath)
+	}
+	key, err := m.parseKeyBlock(keyDERBlock)
+	zero(keyDERBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to load the intermediate CA key at %q: %v", keyPath, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("the intermediate CA key at %q is of an unsupported type", keyPath)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil || !bytes.Equal(spki, cert.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("the intermediate CA key at %q doesn't match its certificate", keyPath)
+	}
+
+	m.intCert, m.intKey = cert, key
+	return nil
+}
+
+// issuer returns the certificate and key that sign leaves: the intermediate
+// CA if there is one, or the root.
+func (m *mkcert) issuer() (*x509.Certificate, crypto.PrivateKey) {
+	if m.intCert != nil {
+		return m.intCert, m.intKey
+	}
+	return m.caCert, m.caKey
+}
+
+// chainPEM returns the PEM encoding of the leaf certificate cert followed by
+// the intermediate CA, if any, which servers must send along.
+func (m *mkcert) chainPEM(cert []byte) []byte {
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	if m.intCert != nil {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.intCert.Raw})...)
+	}
+	return chain
+}
+
+// chainCerts returns the CA certificates to bundle with a leaf, from the
+// intermediate, if any, to the root.
+func (m *mkcert) chainCerts() []*x509.Certificate {
+	if m.intCert != nil {
+		return []*x509.Certificate{m.intCert, m.caCert}
+	}
+	return []*x509.Certificate{m.caCert}
+}
+
+// issuedByLocalCA reports whether cert was signed by the root or by the
+// current intermediate CA.
+func (m *mkcert) issuedByLocalCA(cert *x509.Certificate) bool {
+	if m.caCert != nil && cert.CheckSignatureFrom(m.caCert) == nil {
+		return true
+	}
+	return m.intCert != nil && cert.CheckSignatureFrom(m.intCert) == nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// keyOutFiles keeps the files wrapping -key-out descriptors reachable, as
+// the descriptors belong to the parent process, and the finalizer of an
+// unreachable os.File would close them.
+var keyOutFiles []*os.File
+
+// writeKeyOut writes the PEM encoded key to the -key-out destination, which
+// is "-" for stdout, "fd:N" for an inherited file descriptor, or the path of
+// a named pipe. Destinations that turn out to be regular files are refused,
+// as the point of -key-out is for the key never to touch persistent storage.
+// Inherited descriptors, including stdout, are left open for later output.
+func writeKeyOut(dest string, keyPEM []byte) error {
+	var f *os.File
+	switch {
+	case dest == "-" || dest == "fd:1":
+		f = os.Stdout
+	case dest == "fd:2":
+		f = os.Stderr
+	case strings.HasPrefix(dest, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(dest, "fd:"))
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid file descriptor %q", dest)
+		}
+		if fd == 0 {
+			return errors.New("file descriptor 0 is standard input")
+		}
+		f = os.NewFile(uintptr(fd), dest)
+		if f == nil {
+			return fmt.Errorf("invalid file descriptor %q", dest)
+		}
+		keyOutFiles = append(keyOutFiles, f)
+	default:
+		if !isNamedPipe(dest) {
+			return fmt.Errorf("%q is not a named pipe", dest)
+		}
+		// Opening a FIFO blocks until there is a reader on the other end.
+		var err error
+		f, err = os.OpenFile(dest, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is a regular file, which would store the key on disk", describeKeyOut(dest))
+	}
+	_, err := f.Write(keyPEM)
+	return err
+}
+
+func isNamedPipe(path string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.HasPrefix(path, `\\.\pipe\`)
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+func describeKeyOut(dest string) string {
+	switch {
+	case dest == "-":
+		return "standard output"
+	case strings.HasPrefix(dest, "fd:"):
+		return "file descriptor " + strings.TrimPrefix(dest, "fd:")
+	default:
+		return fmt.Sprintf("%q", dest)
+	}
+}
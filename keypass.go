@@ -0,0 +1,294 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// keyPassEnv is the environment variable that sets the key passphrase when
+// -key-pass is not used, which keeps it out of the process list.
+const keyPassEnv = "MKCERT_KEY_PASS"
+
+// keyPassphrase returns the passphrase to encrypt and decrypt keys with, or
+// an empty string if keys are not encrypted.
+func (m *mkcert) keyPassphrase() string {
+	if m.KeyPass != "" {
+		return m.KeyPass
+	}
+	return os.Getenv(keyPassEnv)
+}
+
+// p12Password returns the password of PKCS #12 files, which is the key
+// passphrase if set, or the often hardcoded default "changeit".
+func (m *mkcert) p12Password() string {
+	if pass := m.keyPassphrase(); pass != "" {
+		return pass
+	}
+	return "changeit"
+}
+
+// marshalLeafKeyPEM is like marshalKeyPEM, but encrypts the key if there is
+// a key passphrase.
+func (m *mkcert) marshalLeafKeyPEM(key crypto.PrivateKey) ([]byte, error) {
+	pass := m.keyPassphrase()
+	if pass == "" {
+		return marshalKeyPEM(key)
+	}
+	return marshalEncryptedKeyPEM(key, pass)
+}
+
+// marshalCAKeyPEM is like marshalKeyPEM, but encrypts the key if the CA key
+// is or should be encrypted, see -encrypt-ca-key.
+func (m *mkcert) marshalCAKeyPEM(key crypto.PrivateKey) ([]byte, error) {
+	if !m.encryptCAKey && !m.caKeyEncrypted {
+		return marshalKeyPEM(key)
+	}
+	pass := m.keyPassphrase()
+	if pass == "" {
+		return nil, fmt.Errorf("the CA key must be encrypted, but there is no passphrase; set $%s", keyPassEnv)
+	}
+	return marshalEncryptedKeyPEM(key, pass)
+}
+
+// parseKeyBlock parses a PKCS #8, PKCS #1 or SEC 1 private key, decrypting
+// it with the key passphrase if it's an ENCRYPTED PRIVATE KEY.
+func (m *mkcert) parseKeyBlock(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		pass := m.keyPassphrase()
+		if pass == "" {
+			return nil, fmt.Errorf("the key is encrypted; set $%s or use -key-pass", keyPassEnv)
+		}
+		der, err := decryptPKCS8(block.Bytes, pass)
+		if err != nil {
+			return nil, err
+		}
+		defer zero(der)
+		return x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, fmt.Errorf("unexpected %s PEM block", block.Type)
+	}
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pkcs8Iterations is the PBKDF2 iteration count of encrypted keys, and
+// maxPKCS8Iterations the highest one accepted, as it's read from the file.
+const (
+	pkcs8Iterations    = 100000
+	maxPKCS8Iterations = 10000000
+)
+
+// pbkdf2PRFs are the PBKDF2 pseudorandom functions supported in encrypted
+// keys. hmacWithSHA1 is the default of RFC 8018 when none is specified, and
+// what OpenSSL used before 1.1.0.
+var pbkdf2PRFs = []struct {
+	oid  asn1.ObjectIdentifier
+	hash func() hash.Hash
+}{
+	{oidHMACSHA1, sha1.New},
+	{oidHMACSHA256, sha256.New},
+	{oidHMACSHA384, sha512.New384},
+	{oidHMACSHA512, sha512.New},
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the PBKDF2-params of RFC 8018, Appendix A.2. Only the
+// specified salt is supported, as nothing uses otherSource.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// marshalEncryptedKeyPEM returns key as a PEM encoded PKCS #8 encrypted
+// private key, with PBES2 (PBKDF2-HMAC-SHA256 and AES-256-CBC), which is what
+// "openssl pkcs8 -topk8 -v2 aes256" produces, and what OpenSSL, Java and most
+// servers can read.
+func marshalEncryptedKeyPEM(key crypto.PrivateKey, pass string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(der)
+
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	k := pbkdf2.Key([]byte(pass), salt, pkcs8Iterations, 32, sha256.New)
+	defer zero(k)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	defer zero(data)
+	encrypted := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt: salt, IterationCount: pkcs8Iterations,
+		PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info}), nil
+}
+
+// decryptPKCS8 decrypts a PKCS #8 encrypted private key produced by
+// marshalEncryptedKeyPEM, or by OpenSSL with the same algorithms.
+func decryptPKCS8(der []byte, pass string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	var params pbes2Params
+	var kdf pbkdf2Params
+	var iv []byte
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("unsupported key encryption, only PBES2 is supported")
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("unsupported key encryption, only PBKDF2 and AES-256-CBC are supported")
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	prf := kdf.PRF.Algorithm
+	if len(prf) == 0 {
+		prf = oidHMACSHA1
+	}
+	var h func() hash.Hash
+	for _, p := range pbkdf2PRFs {
+		if p.oid.Equal(prf) {
+			h = p.hash
+		}
+	}
+	if h == nil {
+		return nil, fmt.Errorf("unsupported key encryption, the PBKDF2 function %s is not one of HMAC-SHA1, HMAC-SHA256, HMAC-SHA384 or HMAC-SHA512", prf)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != 32 {
+		return nil, errors.New("the encrypted key is corrupted: invalid PBKDF2 key length for AES-256")
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > maxPKCS8Iterations {
+		return nil, fmt.Errorf("unsupported key encryption, the PBKDF2 iteration count must be between 1 and %d", maxPKCS8Iterations)
+	}
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData)%aes.BlockSize != 0 || len(info.EncryptedData) == 0 {
+		return nil, errors.New("the encrypted key is corrupted")
+	}
+
+	k := pbkdf2.Key([]byte(pass), kdf.Salt, kdf.IterationCount, 32, h)
+	defer zero(k)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.EncryptedData)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		subtle.ConstantTimeCompare(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) != 1 {
+		zero(data)
+		return nil, errors.New("wrong key passphrase, or the key is corrupted")
+	}
+	return data[:len(data)-padding], nil
+}
+
+// encryptCAKeys implements -encrypt-ca-key for an existing local CA, by
+// rewriting its key, and the intermediate CA key if any, encrypted.
+func (m *mkcert) encryptCAKeys() {
+	if m.caKeyEncrypted || m.caKey == nil {
+		return
+	}
+	files := []outputFile{{path: filepath.Join(m.CAROOT, rootKeyName), perm: 0400}}
+	keys := []crypto.PrivateKey{m.caKey}
+	if m.intKey != nil {
+		files = append(files, outputFile{path: filepath.Join(m.CAROOT, intermediateKeyName), perm: 0400})
+		keys = append(keys, m.intKey)
+	}
+	for i, key := range keys {
+		privPEM, err := m.marshalCAKeyPEM(key)
+		fatalIfErr(err, "failed to encrypt the CA key")
+		defer zero(privPEM)
+		files[i].data = privPEM
+	}
+	fatalIfErr(writeFiles(files...), "failed to save the encrypted CA key")
+	m.caKeyEncrypted = true
+	m.logf("The CA key is now encrypted with the key passphrase, which will be required to issue certificates 🔒\n")
+}
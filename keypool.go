@@ -0,0 +1,192 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// RSA key generation takes long enough to be noticeable in interactive use,
+// so when $MKCERT_KEY_POOL is set, that many leaf keys are generated ahead of
+// time by a background process and stored in the CAROOT, encrypted with a
+// key derived from the CA key. ECDSA keys are fast enough to always be
+// generated on demand.
+
+const keyPoolDir = "keypool"
+
+func keyPoolSize() int {
+	n, err := strconv.Atoi(os.Getenv("MKCERT_KEY_POOL"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// keyPoolAEAD returns the cipher used to encrypt pooled keys, or nil if the
+// CA key is not available.
+func (m *mkcert) keyPoolAEAD() cipher.AEAD {
+	if m.caKey == nil {
+		return nil
+	}
+	caKeyDER, err := x509.MarshalPKCS8PrivateKey(m.caKey)
+	if err != nil {
+		return nil
+	}
+	defer zero(caKeyDER)
+	mac := hmac.New(sha256.New, caKeyDER)
+	mac.Write([]byte("mkcert key pool"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil
+	}
+	return aead
+}
+
+var refillKeyPoolOnce sync.Once
+
+// takePooledKey returns a pre-generated RSA leaf key and removes it from the
+// pool, or nil if the pool is disabled or empty. Either way, when running as
+// the mkcert command, it starts a background process to refill the pool.
+func (m *mkcert) takePooledKey() crypto.PrivateKey {
+	if keyPoolSize() == 0 {
+		return nil
+	}
+	aead := m.keyPoolAEAD()
+	if aead == nil {
+		return nil
+	}
+	if m.cli {
+		defer refillKeyPoolOnce.Do(m.startKeyPoolRefill)
+	}
+
+	unlock := m.lockCAROOT()
+	defer unlock()
+	dir := longPath(filepath.Join(m.CAROOT, keyPoolDir))
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		data, err := ioutil.ReadFile(path)
+		os.Remove(path) // never reuse a key, even if it turns out to be corrupted
+		if err != nil {
+			continue
+		}
+		if key, err := openPooledKey(aead, data); err == nil {
+			return key
+		}
+	}
+	return nil
+}
+
+func openPooledKey(aead cipher.AEAD, data []byte) (crypto.PrivateKey, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("truncated pooled key")
+	}
+	der, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	zero(der)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("unexpected pooled key type")
+	}
+	return key, nil
+}
+
+// startKeyPoolRefill runs "mkcert -fill-key-pool" in the background for the
+// same pool, that is the same resolved CAROOT and CA key. It must only be
+// used by the mkcert command, as otherwise the executable, like a test
+// binary, might not be mkcert.
+func (m *mkcert) startKeyPoolRefill() {
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	args := []string{"-fill-key-pool"}
+	if m.caCertFile != "" {
+		args = append(args, "-ca-cert", m.caCertFile)
+	}
+	if m.caKeyFile != "" {
+		args = append(args, "-ca-key", m.caKeyFile)
+	}
+	cmd := exec.Command(exe, args...)
+	// The CAROOT already includes the -profile, and the passphrase is
+	// passed in the environment to keep it out of the process list.
+	cmd.Env = append(os.Environ(), "CAROOT="+m.CAROOT, keyPassEnv+"="+m.keyPassphrase())
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	cmd.Process.Release()
+}
+
+// fillKeyPool generates keys until the pool is full. Keys are generated
+// without holding the CAROOT lock, which is only taken to check the pool size
+// and add each key, so that concurrent refills can't overfill it.
+func (m *mkcert) fillKeyPool() {
+	size := keyPoolSize()
+	if size == 0 {
+		log.Fatalln("ERROR: set $MKCERT_KEY_POOL to the number of keys to pre-generate")
+	}
+	aead := m.keyPoolAEAD()
+	if aead == nil {
+		fatalErr(errNoCAKey("fill the key pool"))
+	}
+	dir := longPath(filepath.Join(m.CAROOT, keyPoolDir))
+	fatalIfErr(os.MkdirAll(dir, 0700), "failed to create the key pool")
+
+	for {
+		if entries, _ := ioutil.ReadDir(dir); len(entries) >= size {
+			return // checked again below, with the lock held
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		fatalIfErr(err, "failed to generate key")
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		zeroKey(priv)
+		fatalIfErr(err, "failed to encode key")
+		nonce := make([]byte, aead.NonceSize())
+		_, err = rand.Read(nonce)
+		fatalIfErr(err, "failed to generate nonce")
+		data := aead.Seal(nonce, nonce, der, nil)
+		zero(der)
+
+		name := make([]byte, 16)
+		_, err = rand.Read(name)
+		fatalIfErr(err, "failed to generate key name")
+
+		unlock := m.lockCAROOT()
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil || len(entries) >= size {
+			unlock()
+			fatalIfErr(err, "failed to read the key pool")
+			return
+		}
+		err = writeFile(filepath.Join(dir, hex.EncodeToString(name)+".key"), data, 0600)
+		unlock()
+		fatalIfErr(err, "failed to save pooled key")
+	}
+}
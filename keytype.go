@@ -0,0 +1,73 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+)
+
+// A keyType is the algorithm of the keys mkcert generates, selected with
+// -key-type. The zero value is RSA.
+type keyType string
+
+const (
+	keyTypeRSA     keyType = "rsa"
+	keyTypeECDSA   keyType = "ecdsa"
+	keyTypeEd25519 keyType = "ed25519"
+)
+
+var keyTypes = []keyType{keyTypeRSA, keyTypeECDSA, keyTypeEd25519}
+
+func parseKeyType(s string) (keyType, bool) {
+	for _, t := range keyTypes {
+		if string(t) == strings.ToLower(s) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func keyTypeNames() string {
+	var names []string
+	for _, t := range keyTypes {
+		names = append(names, string(t))
+	}
+	return strings.Join(names, ", ")
+}
+
+// keyTypeOf returns the keyType of pub, or the zero value if unknown.
+func keyTypeOf(pub crypto.PublicKey) keyType {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return keyTypeRSA
+	case *ecdsa.PublicKey:
+		return keyTypeECDSA
+	case ed25519.PublicKey:
+		return keyTypeEd25519
+	}
+	return ""
+}
+
+// newKey generates a new key of type kt, without using the key pool. RSA
+// roots are 3072 bits, and leaves 2048 bits.
+func (m *mkcert) newKey(kt keyType, rootCA bool) (crypto.PrivateKey, error) {
+	switch kt {
+	case keyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	if rootCA {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
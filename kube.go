@@ -0,0 +1,58 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// kubeNameRegexp matches a DNS-1123 subdomain, as required for the names of
+// most Kubernetes objects, including Secrets.
+var kubeNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// kubeLabelRegexp matches a DNS-1123 label, as required for Namespace names.
+var kubeLabelRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// kubeSecretName returns the -kube-name, or a Secret name derived from host,
+// like "www-example-test-tls" for "www.example.test".
+func (m *mkcert) kubeSecretName(host string) string {
+	if m.kubeName != "" {
+		return m.kubeName
+	}
+	name := strings.Replace(host, "*", "wildcard", -1)
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	return strings.Trim(name, "-") + "-tls"
+}
+
+// kubeSecret returns a kubernetes.io/tls Secret manifest holding certPEM and
+// keyPEM and, with -kube-ca, the local CA certificate as ca.crt, like the
+// Secrets managed by cert-manager.
+func (m *mkcert) kubeSecret(name string, certPEM, keyPEM []byte) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: %s\n", name)
+	if m.kubeNamespace != "" {
+		fmt.Fprintf(b, "  namespace: %s\n", m.kubeNamespace)
+	}
+	fmt.Fprintf(b, "type: kubernetes.io/tls\ndata:\n")
+	fmt.Fprintf(b, "  tls.crt: %s\n", base64.StdEncoding.EncodeToString(certPEM))
+	fmt.Fprintf(b, "  tls.key: %s\n", base64.StdEncoding.EncodeToString(keyPEM))
+	if m.kubeCA {
+		fmt.Fprintf(b, "  ca.crt: %s\n", base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw})))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const lockName = ".lock"
+
+// lockDirName is used as a lock on file systems that don't support advisory
+// locks, like NFS without lockd and some SMB shares, as creating a directory
+// is atomic even there.
+const lockDirName = ".lock.d"
+
+const (
+	// staleLockAge is how old a lockDirName needs to be for it to be
+	// considered left behind by a crashed process. The lock is only held for
+	// short operations, like generating the CA.
+	staleLockAge = time.Minute
+
+	lockPollInterval = 100 * time.Millisecond
+)
+
+// lockCAROOT takes an exclusive advisory lock on the CAROOT, waiting for any
+// other mkcert process holding it, and returns a function that releases it.
+// It must be held while creating or modifying anything shared in the CAROOT,
+// so that parallel invocations (for example from make -j) don't race.
+//
+// The lock is released automatically if the process exits.
+func (m *mkcert) lockCAROOT() (unlock func()) {
+	f, err := os.OpenFile(longPath(filepath.Join(m.CAROOT, lockName)), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		// A CAROOT we can't write to can't be modified by us either, so
+		// there is nothing to protect.
+		return func() {}
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return m.lockCAROOTWithDir()
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}
+}
+
+// lockCAROOTWithDir is the fallback for lockCAROOT on file systems without
+// advisory locks. Unlike those, this lock is not released automatically if
+// mkcert exits abruptly, so old locks are assumed to be stale.
+func (m *mkcert) lockCAROOTWithDir() (unlock func()) {
+	dir := longPath(filepath.Join(m.CAROOT, lockDirName))
+	var warned bool
+	for {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			return func() { os.Remove(dir) }
+		}
+		if !os.IsExist(err) {
+			fatalIfErr(err, "failed to lock the CAROOT")
+		}
+		if fi, err := os.Stat(dir); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			m.logf("Warning: removing the stale CAROOT lock %q ⚠️", filepath.Join(m.CAROOT, lockDirName))
+			os.Remove(dir)
+			continue
+		}
+		if !warned {
+			m.logf("Waiting for another mkcert process to release the CAROOT lock...")
+			warned = true
+		}
+		fatalIfErr(sleepContext(m.context(), lockPollInterval), "failed to lock the CAROOT")
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package main
+
+import "os"
+
+// Advisory locking is not available on this platform, so concurrent
+// invocations are not protected.
+
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,44 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x00000002 // LOCKFILE_EXCLUSIVE_LOCK
+
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	ret, _, err := procLockFileEx.Call(
+		f.Fd(),                       // HANDLE hFile
+		lockfileExclusiveLock,        // DWORD dwFlags
+		0,                            // DWORD dwReserved
+		1,                            // DWORD nNumberOfBytesToLockLow
+		0,                            // DWORD nNumberOfBytesToLockHigh
+		uintptr(unsafe.Pointer(&ol)), // LPOVERLAPPED lpOverlapped
+	)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	ret, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// A Logger receives the progress messages of mkcert operations, like the
+// trust stores the local CA was installed in, or the names a certificate was
+// created for. Warnings are logged too, besides being returned by Run.
+// *log.Logger implements Logger.
+//
+// Fatal errors are still logged to the standard logger before exiting.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger logs to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Output(3, fmt.Sprintf(format, v...))
+}
+
+// discardLogger drops all messages, for -quiet and -json.
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+
+func (m *mkcert) logf(format string, v ...interface{}) {
+	if m.Logger == nil {
+		stdLogger{}.Printf(format, v...)
+		return
+	}
+	m.Logger.Printf(format, v...)
+}
+
+func (m *mkcert) logln(v ...interface{}) {
+	m.logf("%s", fmt.Sprintln(v...))
+}
+
+// An issuedCert describes a certificate saved by Run, for -json.
+type issuedCert struct {
+	Serial   string    `json:"serial,omitempty"` // hexadecimal, like in the issuance index
+	Names    []string  `json:"names"`
+	CertFile string    `json:"cert_file,omitempty"`
+	KeyFile  string    `json:"key_file,omitempty"`
+	P12File  string    `json:"p12_file,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// recordIssued records the certificate der, saved by the command as
+// described by c, for -json and in the issuance index. Functions like
+// CreateCert don't call it, as they don't write to the CAROOT.
+func (m *mkcert) recordIssued(c issuedCert, der []byte) {
+	m.warningsMu.Lock()
+	m.issued = append(m.issued, c)
+	m.warningsMu.Unlock()
+
+	path := c.CertFile
+	if path == "" {
+		path = c.P12File
+	}
+	m.indexIssued(der, path)
+}
+
+// printJSONResult prints the outcome of Run for -json.
+func (m *mkcert) printJSONResult(w io.Writer, warnings []Warning) {
+	result := struct {
+		CAROOT       string       `json:"caroot"`
+		Certificates []issuedCert `json:"certificates"`
+		Warnings     []Warning    `json:"warnings"`
+	}{m.CAROOT, m.issued, warnings}
+	if result.Certificates == nil {
+		result.Certificates = []issuedCert{}
+	}
+	if result.Warnings == nil {
+		result.Warnings = []Warning{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	fatalIfErr(enc.Encode(result), "failed to encode the result")
+}
+
+// jsonLogWriter turns the lines of the standard logger, which with -json only
+// logs errors, their hints, and a few warnings, into JSON objects.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := "info"
+	switch {
+	case strings.HasPrefix(msg, "ERROR: "):
+		level, msg = "error", strings.TrimPrefix(msg, "ERROR: ")
+	case strings.HasPrefix(msg, "Warning: "):
+		level = "warning"
+	}
+	if msg == "" {
+		return len(p), nil
+	}
+	out, _ := json.Marshal(map[string]string{"level": level, "message": msg})
+	if _, err := j.w.Write(append(out, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,11 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+// longPath is only needed on Windows, see longpath_windows.go.
+func longPath(path string) string { return path }
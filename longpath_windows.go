@@ -0,0 +1,31 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath returns the extended-length form of path (\\?\C:\... or
+// \\?\UNC\server\share\...) if it's too long for the MAX_PATH limit. The os
+// package does this automatically only for absolute, non-UNC paths, but
+// roaming profiles and redirected folders frequently put the CAROOT on a
+// deep UNC path. It must only be used for file system calls, not for
+// messages or paths passed to other programs.
+func longPath(path string) string {
+	// 248 is the limit for directories, which need room for an 8.3 name.
+	if len(path) < 248 || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -6,10 +6,13 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/mail"
@@ -23,6 +26,8 @@ import (
 	"runtime/debug"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"golang.org/x/net/idna"
 )
@@ -35,15 +40,18 @@ const shortUsage = `Usage of mkcert:
 	$ mkcert example.org
 	Generate "example.org.pem" and "example.org-key.pem".
 
-	$ mkcert example.com myapp.dev localhost 127.0.0.1 ::1
+	$ mkcert example.com myapp.test localhost 127.0.0.1 ::1
 	Generate "example.com+4.pem" and "example.com+4-key.pem".
 
-	$ mkcert "*.example.it"
-	Generate "_wildcard.example.it.pem" and "_wildcard.example.it-key.pem".
+	$ mkcert "*.example.test"
+	Generate "_wildcard.example.test.pem" and "_wildcard.example.test-key.pem".
 
 	$ mkcert -uninstall
 	Uninstall the local CA (but do not delete it).
 
+	$ mkcert dns add app.localhost 127.0.0.1
+	Make "app.localhost" resolve to 127.0.0.1 via the hosts file.
+
 `
 
 const advancedUsage = `Advanced options:
@@ -51,23 +59,281 @@ const advancedUsage = `Advanced options:
 	-cert-file FILE, -key-file FILE, -p12-file FILE
 	    Customize the output paths.
 
+	-out-dir DIR
+	    Save the certificate and key files in DIR instead of the
+	    current directory, creating it if needed.
+
+	-name-template TEMPLATE
+	    Name the output files with a Go template instead of the
+	    default "example.com+4.pem" style, relative to -out-dir. The
+	    fields are .FirstHost, .Hosts, .Type ("cert", "key" or "p12")
+	    and .Ext (like ".pem"). For example:
+
+	    $ mkcert -name-template '{{.FirstHost}}/{{.Type}}{{.Ext}}' example.com
+
 	-client
 	    Generate a certificate for client authentication.
 
-	-ecdsa
-	    Generate a certificate with an ECDSA key.
+	-smime
+	    Generate a certificate for signing and encrypting email, for
+	    the email addresses specified as arguments. Combine with
+	    -pkcs12 to import it into a mail client.
+
+	-code-signing [NAME]
+	    Generate a certificate for signing code, like with signtool,
+	    jarsigner or codesign, for the publisher NAME. On Windows, add
+	    -install to also import it into the personal certificate store.
+
+	-key-type rsa|ecdsa|ed25519
+	    Generate a certificate with a key of the selected type. Defaults
+	    to RSA. Also applies to the local CA when it's created. Browsers
+	    don't support Ed25519. "-ecdsa" is a deprecated alias for
+	    "-key-type ecdsa".
+
+	-key-out -|fd:N|PIPE
+	    Never write the key to disk, and instead send it to standard
+	    output, to the inherited file descriptor N, or to the named pipe
+	    PIPE. The certificate is still saved to a file.
+
+	-sig-hash sha256|sha384|sha512
+	    Sign certificates with the selected digest. Defaults to SHA-256.
+	    Applies to the local CA only when it's created.
+
+	-valid-days DAYS, -not-after DATE
+	    Make the certificate valid for DAYS days, or until DATE (as
+	    "2006-01-02" or RFC 3339), instead of 2 years and 3 months.
+	    Browsers reject server certificates valid for more than 825
+	    days, and no certificate outlives the local CA.
+
+	-format pem|der|bundle
+	    Save the certificate and key as PEM files (the default), as raw
+	    DER files (".der" and "-key.der") for embedded toolchains, or
+	    as a single "-bundle.pem" file with the key, certificate and
+	    chain, like nginx and HAProxy expect.
+
+	-kube [-kube-name NAME] [-kube-namespace NS] [-kube-ca]
+	    Generate a Kubernetes "kubernetes.io/tls" Secret manifest,
+	    ready for "kubectl apply -f", instead of PEM files. The Secret
+	    is named after the first host by default, and with -kube-ca
+	    also includes the local CA as "ca.crt". Use -cert-file to
+	    change the output path.
+
+	-subject "/O=ORG/OU=UNIT/CN=NAME"
+	    Set the subject name of the certificate, in the OpenSSL format.
+	    Supported attributes are C, ST, L, STREET, POSTALCODE, O, OU, CN
+	    and SERIALNUMBER. The default O and OU are kept unless set.
+
+	-key-pass PASSPHRASE, -encrypt-ca-key
+	    Encrypt the private key (as PKCS #8 with AES-256) and the PKCS #12
+	    file with PASSPHRASE, instead of the default "changeit". Prefer
+	    setting $MKCERT_KEY_PASS, which also decrypts encrypted CA keys.
+	    With -encrypt-ca-key, also encrypt the CA keys.
 
 	-pkcs12
 	    Generate a ".p12" PKCS #12 file, also know as a ".pfx" file,
 	    containing certificate and key for legacy applications.
 
 	-csr CSR
-	    Generate a certificate based on the supplied CSR. Conflicts with
-	    all other flags and arguments except -install and -cert-file.
+	    Generate a certificate based on the supplied CSR, with an RSA,
+	    ECDSA or Ed25519 key. Names specified as arguments replace the
+	    ones requested by the CSR. Combine with -client to also allow
+	    client authentication, and with -valid-days or -not-after.
+
+	-add-san NAME[,NAME...]
+	    With -csr, add these names to the ones requested by the CSR, or
+	    to the ones specified as arguments.
+
+	-preset postgres|mysql|mongodb|redis, -preset-user NAME
+	    Generate a server certificate and a client certificate for NAME
+	    laid out as the database expects, in a directory named after the
+	    preset. Defaults to localhost if no names are specified.
+
+	-reject-underscores
+	    Refuse hostnames containing underscores, which are accepted by
+	    default but rejected by some clients.
+
+	-unicode-names
+	    Name the output files after the Unicode form of internationalized
+	    hostnames, instead of their punycode form.
+
+	-also-localhost
+	    Also include localhost, 127.0.0.1 and ::1 in the certificate.
+
+	-also-lan
+	    Also include the hostname of this machine, as is and under
+	    .local, and its current LAN IP addresses in the certificate, to
+	    reach it from other devices like a phone.
+
+	-ssh [user@host|host ...]
+	    Generate a short-lived OpenSSH certificate and key signed by an
+	    SSH CA kept in the CAROOT: a user certificate for "user@host"
+	    arguments, or a host certificate for hostnames. Without names,
+	    print how to make servers and clients trust the SSH CA.
+
+	-ssh-pubkey FILE
+	    With -ssh, sign the existing public key FILE instead of
+	    generating a new key, saving the certificate next to it.
+
+	-docker
+	    Also print a docker-compose snippet that mounts the certificate,
+	    key and local CA into a container.
+
+	-docker-container NAME
+	    Install the local CA in the system trust store of the running
+	    container NAME, with "docker exec". Works for Debian, Ubuntu,
+	    Alpine and Red Hat based images.
+
+	-with-dns
+	    Also make the certificate hostnames resolve to 127.0.0.1 through
+	    the hosts file. See "mkcert dns add|remove|list".
+
+	-nss-profile DIR
+	    Only install in, uninstall from or check the NSS database in
+	    DIR, like a single Firefox profile, instead of all the detected
+	    Firefox and Chrome/Chromium profiles.
+
+	-nss-native
+	    Install in, uninstall from and check the NSS databases by
+	    editing cert9.db directly, instead of with "certutil". This is
+	    the default if "certutil" is not available. Databases protected
+	    by a primary password are not supported.
+
+	-allow-noncompliant
+	    Issue certificates that browsers would reject even with the local
+	    CA installed, for example because they are valid for too long,
+	    with a warning instead of an error.
+
+	mkcert audit [-json] [PATH...]
+	    Check the local CA, and the certificates it issued found in PATH
+	    (by default the current directory), for risky conditions like
+	    keys readable by other users, weak keys or expired certificates.
+
+	mkcert probe [-sni NAME] [-alpn PROTOS] HOST:PORT
+	    Connect to a TLS server and check that it presents a certificate
+	    issued by the local CA, valid for the name, and not expired.
+
+	mkcert regenerate [PATH...]
+	    Re-issue with the current local CA, for example after -renew-ca,
+	    the certificates found in PATH (by default the current directory,
+	    recursively), keeping their names, file layout and key type.
+
+	mkcert ocsp-staple [-url URL] [-issuer FILE] [-o FILE] CERT
+	    Fetch the OCSP status of CERT from its responder, or URL, and
+	    save the response to be stapled by a test server. The issuer
+	    defaults to the next certificate in CERT, or the local CA.
+
+	mkcert acme [-listen ADDR] [-http-port PORT] [-tls-port PORT]
+	    Run a minimal ACME server issuing certificates from the local CA,
+	    at https://localhost:14000/directory by default, for clients like
+	    cert-manager, Caddy or lego. Names are validated with HTTP-01 or
+	    TLS-ALPN-01 on the selected ports. State is kept in memory.
+
+	-export-ca FILE, -import-ca FILE
+	    Export the local CA certificate and key to a ".tar.gz" archive
+	    with checksums, encrypted if $MKCERT_PASSPHRASE is set, or
+	    import one into the CAROOT (and -profile) if it has no CA yet.
+	    Encrypted archives ask for the passphrase if it's not set.
+
+	-user-only
+	    Only install in, or uninstall from, the trust stores of the
+	    current user, which never requires sudo or administrator rights.
+	    Some applications will not trust the local CA, as reported.
+
+	-allow-public
+	    Issue certificates for names under real public suffixes, like
+	    "example.dev" or "foo.github.io", which are refused by default
+	    as you might not control them. Names under ".test", ".localhost"
+	    and the other reserved suffixes are always allowed.
+
+	-ca-truststore FILE [-truststore-pass PASSWORD]
+	    Save the local CA certificate as a standalone Java truststore,
+	    in the JKS format if FILE ends in ".jks" and PKCS #12 otherwise,
+	    for JVM applications in environments without keytool. The
+	    password defaults to "changeit".
+
+	-ca-cert FILE [-ca-key FILE]
+	    Use an existing CA, like one provided by your organization,
+	    instead of the local CA, which is then never created. Without
+	    -ca-key, only -install and -uninstall work. The key can be
+	    encrypted with $MKCERT_KEY_PASS, or be a "pkcs11:token=...;
+	    object=..." URI for a key kept in a PKCS #11 token or HSM, like
+	    a YubiKey PIV slot. The module is loaded from module-path or
+	    $MKCERT_PKCS11_MODULE, and the PIN is read from $MKCERT_PKCS11_PIN.
 
 	-CAROOT
 	    Print the CA certificate and key storage location.
 
+	-profile NAME, -profile-list
+	    Use a separate local CA, kept in CAROOT/profiles/NAME, for
+	    everything including -install and -uninstall, so that several
+	    CAs can be used side by side. -profile-list lists the profiles.
+
+	-constrain DOMAIN,...
+	    Limit the local CA, when it's created, to issuing certificates
+	    for the listed domains and their subdomains ("*.localhost" for
+	    subdomains only) and IP ranges ("10.0.0.0/8"), with X.509 name
+	    constraints. IP addresses are limited to loopback unless listed.
+	    Combine with -renew-ca to replace an existing CA.
+
+	-renew-ca
+	    Replace the local CA with a new one, for example if it expired,
+	    and install it. The old CA is moved to a subdirectory of CAROOT.
+
+	-rotate-ca [-rotate-grace DAYS], -rotate-finish
+	    Replace the local CA with a new one and install it, keeping the
+	    old CA installed, and re-issue the certificates mkcert saved that
+	    are still in place. The old CA is uninstalled and deleted by the
+	    next -install after the grace period (30 days by default), or by
+	    -rotate-finish.
+
+	-renew [-renew-within DAYS] FILE..., -check FILE...
+	    Re-issue the certificates in FILE with the current local CA, for
+	    the same names and key, if they expire within DAYS (by default
+	    30) or don't chain to it. Or, print their names and expiration,
+	    and whether they chain to the current local CA.
+
+	-revoke FILE..., -gen-crl, -crl-url URL
+	    Revoke the certificates in FILE, or refresh the CRL of the local
+	    CA, which is saved in CAROOT and valid for 7 days. With -crl-url,
+	    new certificates point clients to the CRL served at URL.
+
+	-ocsp [-listen ADDR], -ocsp-url URL
+	    Run an OCSP responder for the certificates issued by the local
+	    CA, reporting them as good or revoked (see -revoke), on ADDR
+	    (localhost:8888 by default). With -ocsp-url, new certificates
+	    point clients to the responder at URL.
+
+	-serve unix://PATH|tcp://HOST:PORT
+	    Run a local API for other tools to request certificates from
+	    the local CA without access to its key. "POST /issue" with
+	    {"names": [...]} returns the key and certificate as PEM, and
+	    "GET /ca" the CA certificate. Requests must send the token from
+	    $MKCERT_SERVE_TOKEN or CAROOT/serve-token as a Bearer token.
+
+	-gen-intermediate
+	    Create an intermediate CA signed by the local CA, and issue all
+	    following certificates from it, saving the full chain. The local
+	    CA only allows intermediates if it was created along with one,
+	    so combine with -renew-ca the first time.
+
+	-fix-perms
+	    Make the CA key private and the CAROOT not writable by other
+	    users, if they aren't already. Otherwise, mkcert only warns.
+
+	-quiet
+	    Only print errors.
+
+	-json
+	    Print the result, including the paths and expiration of the
+	    certificates created and any warnings, as a JSON object on
+	    standard output. Errors are printed as JSON objects, one per
+	    line, on standard error.
+
+	-list
+	    List the certificates issued by the local CA, with their serial,
+	    expiration, revocation status, names and path. With -json, print
+	    them as a JSON array instead.
+
 	$CAROOT (environment variable)
 	    Set the CA certificate and key storage location. (This allows
 	    maintaining multiple local CAs in parallel.)
@@ -75,7 +341,32 @@ const advancedUsage = `Advanced options:
 	$TRUST_STORES (environment variable)
 	    A comma-separated list of trust stores to install the local
 	    root CA into. Options are: "system", "java" and "nss" (includes
-	    Firefox). Autodetected by default.
+	    Firefox). Autodetected by default. On Linux, individual system
+	    stores can be selected instead of "system" with "ca-trust",
+	    "ca-certificates", "trust-source", "pki-trust", "p11-kit" and
+	    "nixos", and the Snap and Flatpak browsers instead of "nss"
+	    with "snap" and "flatpak".
+
+	$MKCERT_ALLOWED_DOMAINS (environment variable)
+	    A comma-separated list of domains, like those of your
+	    organization, that are allowed without "-allow-public".
+
+	$MKCERT_COMMAND_TIMEOUT (environment variable)
+	    How long to wait for external commands like certutil, keytool
+	    or security before stopping them, as a duration like "5m".
+	    Defaults to 2m, and 0 disables the limit.
+
+	$MKCERT_KEY_POOL (environment variable)
+	    Keep this many RSA keys pre-generated in the CAROOT, encrypted,
+	    to make issuance faster. The pool is refilled in the background,
+	    or explicitly with "mkcert -fill-key-pool".
+
+	Exit codes
+	    1 for most errors, 2 for invalid subcommand arguments, 3 for an
+	    invalid or public name, 4 if there is no local CA or its key is
+	    missing, 5 if the local CA is not trusted where it should be, 6
+	    if a trust store couldn't be updated, and 7 if browsers would
+	    reject the certificate.
 
 `
 
@@ -87,18 +378,82 @@ var Version string
 func main() {
 	log.SetFlags(0)
 	var (
-		installFlag   = flag.Bool("install", false, "")
-		uninstallFlag = flag.Bool("uninstall", false, "")
-		pkcs12Flag    = flag.Bool("pkcs12", false, "")
-		ecdsaFlag     = flag.Bool("ecdsa", false, "")
-		clientFlag    = flag.Bool("client", false, "")
-		helpFlag      = flag.Bool("help", false, "")
-		carootFlag    = flag.Bool("CAROOT", false, "")
-		csrFlag       = flag.String("csr", "", "")
-		certFileFlag  = flag.String("cert-file", "", "")
-		keyFileFlag   = flag.String("key-file", "", "")
-		p12FileFlag   = flag.String("p12-file", "", "")
-		versionFlag   = flag.Bool("version", false, "")
+		installFlag    = flag.Bool("install", false, "")
+		uninstallFlag  = flag.Bool("uninstall", false, "")
+		pkcs12Flag     = flag.Bool("pkcs12", false, "")
+		ecdsaFlag      = flag.Bool("ecdsa", false, "") // deprecated, see -key-type
+		keyTypeFlag    = flag.String("key-type", "", "")
+		clientFlag     = flag.Bool("client", false, "")
+		smimeFlag      = flag.Bool("smime", false, "")
+		codeSignFlag   = flag.Bool("code-signing", false, "")
+		listFlag       = flag.Bool("list", false, "")
+		exportCAFlag   = flag.String("export-ca", "", "")
+		importCAFlag   = flag.String("import-ca", "", "")
+		helpFlag       = flag.Bool("help", false, "")
+		carootFlag     = flag.Bool("CAROOT", false, "")
+		profileFlag    = flag.String("profile", "", "")
+		profileList    = flag.Bool("profile-list", false, "")
+		csrFlag        = flag.String("csr", "", "")
+		addSANFlag     = flag.String("add-san", "", "")
+		certFileFlag   = flag.String("cert-file", "", "")
+		keyFileFlag    = flag.String("key-file", "", "")
+		p12FileFlag    = flag.String("p12-file", "", "")
+		outDirFlag     = flag.String("out-dir", "", "")
+		nameTmplFlag   = flag.String("name-template", "", "")
+		versionFlag    = flag.Bool("version", false, "")
+		withDNSFlag    = flag.Bool("with-dns", false, "")
+		alsoLocalhost  = flag.Bool("also-localhost", false, "")
+		alsoLAN        = flag.Bool("also-lan", false, "")
+		dockerFlag     = flag.Bool("docker", false, "")
+		sshFlag        = flag.Bool("ssh", false, "")
+		sshPubKeyFlag  = flag.String("ssh-pubkey", "", "")
+		dockerCont     = flag.String("docker-container", "", "")
+		presetFlag     = flag.String("preset", "", "")
+		presetUser     = flag.String("preset-user", "", "")
+		fillPoolFlag   = flag.Bool("fill-key-pool", false, "")
+		verifySystem   = flag.Bool("verify-system-trust", false, "") // internal, see verifyPlatformInstall
+		noUnderscores  = flag.Bool("reject-underscores", false, "")
+		unicodeNames   = flag.Bool("unicode-names", false, "")
+		renewCAFlag    = flag.Bool("renew-ca", false, "")
+		rotateCAFlag   = flag.Bool("rotate-ca", false, "")
+		rotateFinish   = flag.Bool("rotate-finish", false, "")
+		rotateGrace    = flag.Int("rotate-grace", 0, "")
+		genInterFlag   = flag.Bool("gen-intermediate", false, "")
+		renewFlag      = flag.Bool("renew", false, "")
+		renewWithin    = flag.Int("renew-within", 0, "")
+		checkFlag      = flag.Bool("check", false, "")
+		quietFlag      = flag.Bool("quiet", false, "")
+		jsonFlag       = flag.Bool("json", false, "")
+		fixPermsFlag   = flag.Bool("fix-perms", false, "")
+		nssProfile     = flag.String("nss-profile", "", "")
+		nssNativeFlag  = flag.Bool("nss-native", false, "")
+		allowNonComp   = flag.Bool("allow-noncompliant", false, "")
+		keyOutFlag     = flag.String("key-out", "", "")
+		sigHashFlag    = flag.String("sig-hash", "", "")
+		userOnlyFlag   = flag.Bool("user-only", false, "")
+		allowPublic    = flag.Bool("allow-public", false, "")
+		validDays      = flag.Int("valid-days", 0, "")
+		notAfterFlag   = flag.String("not-after", "", "")
+		formatFlag     = flag.String("format", "", "")
+		kubeFlag       = flag.Bool("kube", false, "")
+		kubeName       = flag.String("kube-name", "", "")
+		kubeNamespace  = flag.String("kube-namespace", "", "")
+		kubeCA         = flag.Bool("kube-ca", false, "")
+		caTrustStore   = flag.String("ca-truststore", "", "")
+		trustStorePass = flag.String("truststore-pass", "", "")
+		revokeFlag     = flag.Bool("revoke", false, "")
+		genCRLFlag     = flag.Bool("gen-crl", false, "")
+		crlURLFlag     = flag.String("crl-url", "", "")
+		ocspFlag       = flag.Bool("ocsp", false, "")
+		listenFlag     = flag.String("listen", "", "")
+		serveFlag      = flag.String("serve", "", "")
+		ocspURLFlag    = flag.String("ocsp-url", "", "")
+		subjectFlag    = flag.String("subject", "", "")
+		constrainFlag  = flag.String("constrain", "", "")
+		keyPassFlag    = flag.String("key-pass", "", "")
+		encryptCAKey   = flag.Bool("encrypt-ca-key", false, "")
+		caCertFlag     = flag.String("ca-cert", "", "")
+		caKeyFlag      = flag.String("ca-key", "", "")
 	)
 	flag.Usage = func() {
 		fmt.Fprint(flag.CommandLine.Output(), shortUsage)
@@ -122,27 +477,313 @@ func main() {
 		fmt.Println("(unknown)")
 		return
 	}
+	if *profileFlag != "" {
+		if err := checkProfileName(*profileFlag); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
 	if *carootFlag {
 		if *installFlag || *uninstallFlag {
 			log.Fatalln("ERROR: you can't set -[un]install and -CAROOT at the same time")
 		}
-		fmt.Println(getCAROOT())
+		fmt.Println(profileCAROOT(getCAROOT(), *profileFlag))
+		return
+	}
+	if *profileList {
+		listProfiles(getCAROOT())
+		return
+	}
+	if flag.Arg(0) == "dns" {
+		runDNS(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "audit" {
+		runAudit(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "probe" {
+		runProbe(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "ocsp-staple" {
+		runOCSPStaple(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "acme" {
+		runACME(flag.Args()[1:])
 		return
 	}
 	if *installFlag && *uninstallFlag {
 		log.Fatalln("ERROR: you can't set -install and -uninstall at the same time")
 	}
-	if *csrFlag != "" && (*pkcs12Flag || *ecdsaFlag || *clientFlag) {
-		log.Fatalln("ERROR: can only combine -csr with -install and -cert-file")
+	if *renewCAFlag && *uninstallFlag {
+		log.Fatalln("ERROR: you can't set -renew-ca and -uninstall at the same time")
+	}
+	if (*rotateCAFlag || *rotateFinish) && (flag.NArg() > 0 || *uninstallFlag || *renewCAFlag || *caCertFlag != "" || *exportCAFlag != "" || *importCAFlag != "" || *listFlag) {
+		log.Fatalln("ERROR: -rotate-ca and -rotate-finish can't be combined with certificate names, -uninstall, -renew-ca, -ca-cert, -export-ca, -import-ca or -list")
+	}
+	if *rotateCAFlag && *rotateFinish {
+		log.Fatalln("ERROR: you can't set -rotate-ca and -rotate-finish at the same time")
+	}
+	if *rotateGrace < 0 || (*rotateGrace != 0 && !*rotateCAFlag) {
+		log.Fatalln("ERROR: -rotate-grace requires -rotate-ca and a positive number of days")
+	}
+	if *ecdsaFlag {
+		if *keyTypeFlag != "" && *keyTypeFlag != string(keyTypeECDSA) {
+			log.Fatalln("ERROR: you can't set -ecdsa and -key-type at the same time")
+		}
+		*keyTypeFlag = string(keyTypeECDSA)
+	}
+	keyType, ok := parseKeyType(*keyTypeFlag)
+	if *keyTypeFlag != "" && !ok {
+		log.Fatalf("ERROR: unknown -key-type %q, options are: %s", *keyTypeFlag, keyTypeNames())
+	}
+	if keyType == keyTypeEd25519 && *pkcs12Flag {
+		log.Fatalln("ERROR: PKCS #12 files only support RSA and ECDSA keys")
+	}
+	if *csrFlag != "" && (*pkcs12Flag || *keyTypeFlag != "") {
+		log.Fatalln("ERROR: can't combine -csr with -pkcs12 or -key-type, as the key is the one of the CSR")
+	}
+	var addSANs []string
+	if *addSANFlag != "" {
+		if *csrFlag == "" {
+			log.Fatalln("ERROR: -add-san requires -csr, otherwise specify the names as arguments")
+		}
+		addSANs = strings.Split(*addSANFlag, ",")
+	}
+	if *presetFlag != "" && (*csrFlag != "" || *pkcs12Flag || *clientFlag ||
+		*certFileFlag != "" || *keyFileFlag != "" || *p12FileFlag != "") {
+		log.Fatalln("ERROR: can't combine -preset with -csr, -pkcs12, -client or custom output paths")
+	}
+	if *keyOutFlag != "" && (*pkcs12Flag || *keyFileFlag != "" || *presetFlag != "" || *csrFlag != "") {
+		log.Fatalln("ERROR: can't combine -key-out with -pkcs12, -key-file, -preset or -csr")
+	}
+	if _, ok := signatureHashes[*sigHashFlag]; *sigHashFlag != "" && !ok {
+		log.Fatalf("ERROR: unknown -sig-hash %q, options are: %s", *sigHashFlag, signatureHashNames())
 	}
-	if *csrFlag != "" && flag.NArg() != 0 {
-		log.Fatalln("ERROR: can't specify extra arguments when using -csr")
+	if *renewFlag && *checkFlag {
+		log.Fatalln("ERROR: you can't set -renew and -check at the same time")
 	}
-	(&mkcert{
-		installMode: *installFlag, uninstallMode: *uninstallFlag, csrPath: *csrFlag,
-		pkcs12: *pkcs12Flag, ecdsa: *ecdsaFlag, client: *clientFlag,
+	if (*renewFlag || *checkFlag) && (*csrFlag != "" || *presetFlag != "" || *pkcs12Flag) {
+		log.Fatalln("ERROR: can't combine -renew or -check with -csr, -preset or -pkcs12")
+	}
+	if *renewWithin < 0 || (*renewWithin != 0 && !*renewFlag) {
+		log.Fatalln("ERROR: -renew-within requires -renew and a positive number of days")
+	}
+	if *jsonFlag && (*keyOutFlag == "-" || *keyOutFlag == "fd:1") {
+		log.Fatalln("ERROR: can't send the key to standard output with -json, use -key-out fd:N with another descriptor instead")
+	}
+	if *validDays != 0 && *notAfterFlag != "" {
+		log.Fatalln("ERROR: you can't set -valid-days and -not-after at the same time")
+	}
+	if *validDays < 0 || *validDays > maxValidDays {
+		log.Fatalf("ERROR: -valid-days must be between 1 and %d", maxValidDays)
+	}
+	var notAfter time.Time
+	if *notAfterFlag != "" {
+		notAfter = parseNotAfter(*notAfterFlag)
+	}
+	if *kubeFlag && (*csrFlag != "" || *presetFlag != "" || *pkcs12Flag || *keyOutFlag != "" ||
+		*keyFileFlag != "" || *renewFlag || *checkFlag) {
+		log.Fatalln("ERROR: can't combine -kube with -csr, -preset, -pkcs12, -key-out, -key-file, -renew or -check")
+	}
+	if !*kubeFlag && (*kubeName != "" || *kubeNamespace != "" || *kubeCA) {
+		log.Fatalln("ERROR: -kube-name, -kube-namespace and -kube-ca require -kube")
+	}
+	if *kubeName != "" && (len(*kubeName) > 253 || !kubeNameRegexp.MatchString(*kubeName)) {
+		log.Fatalf("ERROR: invalid -kube-name %q, it must be a lowercase DNS name", *kubeName)
+	}
+	if *kubeNamespace != "" && (len(*kubeNamespace) > 63 || !kubeLabelRegexp.MatchString(*kubeNamespace)) {
+		log.Fatalf("ERROR: invalid -kube-namespace %q, it must be a lowercase DNS label", *kubeNamespace)
+	}
+	if *revokeFlag && *genCRLFlag {
+		log.Fatalln("ERROR: you can't set -revoke and -gen-crl at the same time, -revoke also refreshes the CRL")
+	}
+	if (*revokeFlag || *genCRLFlag) && (*renewFlag || *checkFlag || *csrFlag != "" || *presetFlag != "" || *pkcs12Flag || *kubeFlag) {
+		log.Fatalln("ERROR: can't combine -revoke or -gen-crl with -renew, -check, -csr, -preset, -pkcs12 or -kube")
+	}
+	if *genCRLFlag && flag.NArg() > 0 {
+		log.Fatalln("ERROR: -gen-crl doesn't take arguments")
+	}
+	checkHTTPURL := func(name, value string) {
+		if u, err := url.Parse(value); value != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			log.Fatalf("ERROR: invalid -%s %q, it must be an http:// or https:// URL", name, value)
+		}
+	}
+	checkHTTPURL("crl-url", *crlURLFlag)
+	checkHTTPURL("ocsp-url", *ocspURLFlag)
+	if *ocspFlag && (flag.NArg() > 0 || *revokeFlag || *genCRLFlag || *renewFlag || *checkFlag || *csrFlag != "" || *presetFlag != "") {
+		log.Fatalln("ERROR: -ocsp doesn't take arguments, and can't be combined with other commands")
+	}
+	if *serveFlag != "" && (flag.NArg() > 0 || *ocspFlag || *revokeFlag || *genCRLFlag || *renewFlag || *checkFlag || *csrFlag != "" || *presetFlag != "" || *pkcs12Flag || *kubeFlag) {
+		log.Fatalln("ERROR: -serve doesn't take arguments, and can't be combined with other commands")
+	}
+	if *listenFlag != "" && !*ocspFlag {
+		log.Fatalln("ERROR: -listen requires -ocsp")
+	}
+	var subject pkix.Name
+	if *subjectFlag != "" {
+		if *csrFlag != "" || *presetFlag != "" {
+			log.Fatalln("ERROR: can't combine -subject with -csr or -preset")
+		}
+		var err error
+		if subject, err = parseSubject(*subjectFlag); err != nil {
+			log.Fatalf("ERROR: invalid -subject %q: %s", *subjectFlag, err)
+		}
+	}
+	var constraints []string
+	if *constrainFlag != "" {
+		constraints = strings.Split(*constrainFlag, ",")
+		if _, _, err := parseNameConstraints(constraints); err != nil {
+			log.Fatalf("ERROR: invalid -constrain %q: %s", *constrainFlag, err)
+		}
+	}
+	if *keyPassFlag != "" && *kubeFlag {
+		log.Fatalln("ERROR: can't combine -key-pass with -kube, as Kubernetes requires unencrypted keys")
+	}
+	if *encryptCAKey && *keyPassFlag == "" && os.Getenv(keyPassEnv) == "" {
+		log.Fatalf("ERROR: -encrypt-ca-key requires a passphrase, set with $%s or -key-pass", keyPassEnv)
+	}
+	if *caKeyFlag != "" && *caCertFlag == "" {
+		log.Fatalln("ERROR: -ca-key requires -ca-cert")
+	}
+	if *caCertFlag != "" && *profileFlag != "" {
+		log.Fatalln("ERROR: can't combine -ca-cert with -profile, which selects a local CA")
+	}
+	if *caCertFlag != "" && (*renewCAFlag || *genInterFlag || *encryptCAKey || *constrainFlag != "") {
+		log.Fatalln("ERROR: can't combine -ca-cert with -renew-ca, -gen-intermediate, -encrypt-ca-key or -constrain, which manage the local CA")
+	}
+	if *trustStorePass != "" && *caTrustStore == "" {
+		log.Fatalln("ERROR: -truststore-pass requires -ca-truststore")
+	}
+	outputFormat, err := parseFormat(*formatFlag)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if outputFormat != formatPEM && (*kubeFlag || *pkcs12Flag || *keyOutFlag != "" || *presetFlag != "" || *renewFlag || *checkFlag) {
+		log.Fatalln("ERROR: can't combine -format with -kube, -pkcs12, -key-out, -preset, -renew or -check")
+	}
+	if outputFormat == formatBundle && (*csrFlag != "" || *keyFileFlag != "") {
+		log.Fatalln("ERROR: can't combine -format bundle with -csr or -key-file, the bundle is saved to -cert-file")
+	}
+	if *kubeFlag {
+		outputFormat = formatKube
+	}
+	if *smimeFlag && (*clientFlag || *csrFlag != "" || *presetFlag != "" || *kubeFlag) {
+		log.Fatalln("ERROR: can't combine -smime with -client, -csr, -preset or -kube")
+	}
+	if *codeSignFlag && (*clientFlag || *smimeFlag || *csrFlag != "" || *presetFlag != "" || *kubeFlag || *withDNSFlag) {
+		log.Fatalln("ERROR: can't combine -code-signing with -client, -smime, -csr, -preset, -kube or -with-dns")
+	}
+	if *listFlag && (flag.NArg() > 0 || *installFlag || *uninstallFlag || *renewCAFlag || *exportCAFlag != "" || *importCAFlag != "") {
+		log.Fatalln("ERROR: -list can't be combined with other operations")
+	}
+	if *exportCAFlag != "" && *importCAFlag != "" {
+		log.Fatalln("ERROR: you can't set -export-ca and -import-ca at the same time")
+	}
+	if (*exportCAFlag != "" || *importCAFlag != "") && (flag.NArg() > 0 || *installFlag || *uninstallFlag || *renewCAFlag || *caCertFlag != "") {
+		log.Fatalln("ERROR: -export-ca and -import-ca can't be combined with other operations")
+	}
+	if (*alsoLocalhost || *alsoLAN) && (*smimeFlag || *codeSignFlag || *csrFlag != "") {
+		log.Fatalln("ERROR: can't combine -also-localhost or -also-lan with -smime, -code-signing or -csr")
+	}
+	if *dockerFlag && (*pkcs12Flag || *csrFlag != "" || *presetFlag != "" || *kubeFlag ||
+		*formatFlag != "" || *keyOutFlag != "" || *smimeFlag || *codeSignFlag) {
+		log.Fatalln("ERROR: can't combine -docker with -pkcs12, -csr, -preset, -kube, -format, -key-out, -smime or -code-signing")
+	}
+	if *sshFlag && (*pkcs12Flag || *csrFlag != "" || *presetFlag != "" || *kubeFlag || *formatFlag != "" ||
+		*keyOutFlag != "" || *clientFlag || *smimeFlag || *codeSignFlag || *dockerFlag || *alsoLocalhost || *alsoLAN || *installFlag || *uninstallFlag) {
+		log.Fatalln("ERROR: can't combine -ssh with -install, -uninstall or the flags for X.509 certificates, like -pkcs12, -csr, -client or -format")
+	}
+	if *sshPubKeyFlag != "" && !*sshFlag {
+		log.Fatalln("ERROR: -ssh-pubkey requires -ssh")
+	}
+	if *dockerCont != "" && *uninstallFlag {
+		log.Fatalln("ERROR: can't combine -docker-container with -uninstall")
+	}
+	if *codeSignFlag && flag.NArg() > 1 {
+		log.Fatalln("ERROR: -code-signing takes a single publisher name")
+	}
+	var nameTemplate *template.Template
+	if *nameTmplFlag != "" {
+		if *presetFlag != "" || *kubeFlag {
+			log.Fatalln("ERROR: can't combine -name-template with -preset or -kube")
+		}
+		var err error
+		nameTemplate, err = parseNameTemplate(*nameTmplFlag)
+		fatalIfErr(err, "invalid -name-template")
+	}
+	if *presetUser != "" && *presetFlag == "" {
+		log.Fatalln("ERROR: -preset-user requires -preset")
+	}
+	args := flag.Args()
+	regenerate := flag.Arg(0) == "regenerate"
+	if regenerate {
+		args = args[1:]
+	}
+	m := &mkcert{
+		installMode: *installFlag, uninstallMode: *uninstallFlag, csrPath: *csrFlag, addSANs: addSANs,
+		pkcs12: *pkcs12Flag, keyType: keyType, client: *clientFlag, smime: *smimeFlag, codeSigning: *codeSignFlag,
+		exportCAFile: *exportCAFlag, importCAFile: *importCAFlag, listMode: *listFlag, listJSON: *jsonFlag,
 		certFile: *certFileFlag, keyFile: *keyFileFlag, p12File: *p12FileFlag,
-	}).Run(flag.Args())
+		outDir: *outDirFlag, nameTemplate: nameTemplate,
+		alsoLocalhost: *alsoLocalhost, alsoLAN: *alsoLAN,
+		docker: *dockerFlag, dockerContainer: *dockerCont,
+		sshMode: *sshFlag, sshPubKey: *sshPubKeyFlag,
+		withDNS: *withDNSFlag, preset: *presetFlag, presetUser: *presetUser,
+		fillKeyPoolMode: *fillPoolFlag, verifySystemMode: *verifySystem,
+		rejectUnderscores: *noUnderscores, unicodeNames: *unicodeNames,
+		renewCAMode: *renewCAFlag, rotateCAMode: *rotateCAFlag, rotateFinish: *rotateFinish,
+		rotateGrace: time.Duration(*rotateGrace) * 24 * time.Hour, fixPerms: *fixPermsFlag, genIntermediateMode: *genInterFlag,
+		nssProfile: *nssProfile, nssNative: *nssNativeFlag, allowNonCompliant: *allowNonComp,
+		keyOut: *keyOutFlag, sigHash: *sigHashFlag, userOnly: *userOnlyFlag,
+		allowPublic: *allowPublic, notAfter: notAfter,
+		validFor: time.Duration(*validDays) * 24 * time.Hour, regenerateMode: regenerate,
+		renewMode: *renewFlag, renewWithin: time.Duration(*renewWithin) * 24 * time.Hour,
+		checkMode: *checkFlag, OutputFormat: outputFormat,
+		kubeName: *kubeName, kubeNamespace: *kubeNamespace, kubeCA: *kubeCA,
+		caTrustStore: *caTrustStore, trustStorePass: *trustStorePass,
+		revokeMode: *revokeFlag, genCRLMode: *genCRLFlag, crlURL: *crlURLFlag,
+		ocspMode: *ocspFlag, listen: *listenFlag, ocspURL: *ocspURLFlag, serveAddr: *serveFlag,
+		Subject: subject, NameConstraints: constraints,
+		KeyPass: *keyPassFlag, encryptCAKey: *encryptCAKey,
+		caCertFile: *caCertFlag, caKeyFile: *caKeyFlag, Profile: *profileFlag,
+		cli: true,
+	}
+	if *quietFlag || *jsonFlag {
+		m.Logger = discardLogger{}
+	}
+	if *jsonFlag {
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	}
+	warnings, err := m.RunContext(context.Background(), args...)
+	if *jsonFlag && !*listFlag {
+		m.printJSONResult(os.Stdout, warnings)
+	}
+	forgetCAs()
+	if err != nil {
+		fatalErr(err)
+	}
+}
+
+// maxValidDays bounds -valid-days to the lifetime of the local CA, which
+// certificates can't outlive anyway.
+const maxValidDays = 3650
+
+// parseNotAfter parses the -not-after flag, either as a date, which is the
+// expiration instant in local time, or as an RFC 3339 timestamp.
+func parseNotAfter(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	if err != nil {
+		log.Fatalf("ERROR: invalid -not-after %q, use a date like \"2006-01-02\" or an RFC 3339 timestamp", s)
+	}
+	if !t.After(time.Now()) {
+		log.Fatalf("ERROR: -not-after %q is in the past", s)
+	}
+	return t
 }
 
 const rootName = "rootCA.pem"
@@ -150,87 +791,403 @@ const rootKeyName = "rootCA-key.pem"
 
 type mkcert struct {
 	installMode, uninstallMode bool
-	pkcs12, ecdsa, client      bool
+	pkcs12, client, smime      bool
+	codeSigning                bool
+	docker                     bool
+	sshMode                    bool
+	sshPubKey                  string
+	dockerContainer            string
+	alsoLocalhost, alsoLAN     bool
+	exportCAFile, importCAFile string
+	listMode, listJSON         bool
+	keyType                    keyType
 	keyFile, certFile, p12File string
+	outDir                     string
+	nameTemplate               *template.Template
 	csrPath                    string
+	addSANs                    []string
+	withDNS                    bool
+	preset, presetUser         string
+	fillKeyPoolMode            bool
+	verifySystemMode           bool
+	renewCAMode                bool
+	rotateCAMode, rotateFinish bool
+	rotateGrace                time.Duration
+	genIntermediateMode        bool
+	renewMode, checkMode       bool
+	renewWithin                time.Duration
+	fixPerms                   bool
+	rejectUnderscores          bool
+	unicodeNames               bool
+	nssProfile                 string
+	nssNative                  bool
+	allowNonCompliant          bool
+	keyOut                     string
+	sigHash                    string
+	userOnly                   bool
+	allowPublic                bool
+	validFor                   time.Duration
+	notAfter                   time.Time
+	regenerateMode             bool
+	kubeName, kubeNamespace    string
+	kubeCA                     bool
+	caTrustStore               string
+	trustStorePass             string
+	revokeMode, genCRLMode     bool
+	crlURL                     string
+	encryptCAKey               bool
+	caCertFile, caKeyFile      string
+	ocspMode                   bool
+	listen, ocspURL            string
+	serveAddr                  string
+
+	// uLabels maps the punycode form of internationalized hostnames to the
+	// original Unicode form.
+	uLabels map[string]string
 
 	CAROOT string
+
+	// Profile, if set, selects the named CA in CAROOT/profiles instead of
+	// the default one. It's applied to the default CAROOT by Run and LoadCA.
+	Profile string
+
+	// Subject overrides attributes of the subject name of new certificates,
+	// which by default only identifies them as mkcert development
+	// certificates. See applySubject.
+	Subject pkix.Name
+
+	// NameConstraints limits a newly created local CA to these domains and
+	// IP ranges, see parseNameConstraints. An existing CA must match them.
+	NameConstraints []string
+
+	// CACert and CAKey, if set, are used to issue certificates instead of
+	// the local CA in CAROOT, which is then never created. CAKey can be nil
+	// to only install CACert. See also -ca-cert and -ca-key.
+	CACert *x509.Certificate
+	CAKey  crypto.PrivateKey
+
+	// KeyPass, if set, is the passphrase used to encrypt new private keys
+	// and PKCS #12 files. It defaults to $MKCERT_KEY_PASS.
+	KeyPass string
+
+	// OutputFormat selects how makeCert saves certificates and keys, see
+	// formatPEM, formatDER, formatBundle and formatKube.
+	OutputFormat string
+
+	// Filenames, if set, returns the paths where the certificate, key and
+	// PKCS #12 file for hosts are saved, instead of the default names in
+	// the current directory. Directories are created as needed.
+	Filenames func(hosts []string) (certFile, keyFile, p12File string)
+
+	// Logger receives progress messages. If nil, they go to the standard
+	// logger.
+	Logger Logger
+
 	caCert *x509.Certificate
 	caKey  crypto.PrivateKey
 
-	// The system cert pool is only loaded once. After installing the root, checks
-	// will keep failing until the next execution. TODO: maybe execve?
-	// https://github.com/golang/go/issues/24540 (thanks, myself)
-	ignoreCheckFailure bool
+	// caKeyEncrypted is whether the CA key is stored encrypted, in which
+	// case new CA keys are encrypted as well.
+	caKeyEncrypted bool
+
+	// intCert and intKey are the intermediate CA, if any, see issuer.
+	intCert *x509.Certificate
+	intKey  crypto.PrivateKey
+
+	// ctx is the context passed to RunContext, see context.
+	ctx context.Context
+
+	// cli is set when running as the mkcert command, rather than from tests,
+	// which allows re-executing the binary, see startKeyPoolRefill.
+	cli bool
+
+	warningsMu sync.Mutex // also guards issued
+	warnings   []Warning
+	issued     []issuedCert
+}
+
+// Run performs the operation selected by the mkcert fields, and returns the
+// warnings it logged along the way. It's like RunContext with a context
+// that is never canceled.
+//
+// Most failures are still fatal, but the ones of -renew and -check, which
+// report every file before failing, are returned as err.
+func (m *mkcert) Run(args []string) (warnings []Warning, err error) {
+	return m.RunContext(context.Background(), args...)
 }
 
-func (m *mkcert) Run(args []string) {
+// RunContext is like Run, but if ctx is canceled or its deadline expires,
+// any external command mkcert is running, like certutil, keytool, security or
+// sudo, is killed, and waits like retries and the CAROOT lock are abandoned.
+// The operation then fails like it would for any other command failure.
+func (m *mkcert) RunContext(ctx context.Context, args ...string) (warnings []Warning, err error) {
+	m.ctx = ctx
+	defer func() { m.ctx = nil }()
+	m.takeWarnings()
+	defer func() { warnings = m.takeWarnings() }()
+
 	m.CAROOT = getCAROOT()
+	if m.CAROOT != "" {
+		m.CAROOT = profileCAROOT(m.CAROOT, m.Profile)
+	}
 	if m.CAROOT == "" {
-		log.Fatalln("ERROR: failed to find the default CA location, set one as the CAROOT env var")
+		if runtime.GOOS == "windows" {
+			log.Fatalln(`ERROR: failed to find the default CA location because LocalAppData and USERPROFILE are not set; set the CAROOT environment variable to a writable directory to use instead`)
+		}
+		log.Fatalln(`ERROR: failed to find the default CA location because $HOME is not set and the user has no home directory; set the CAROOT environment variable to a writable directory to use instead, for example CAROOT="$PWD/.mkcert"`)
+	}
+	fatalIfErr(os.MkdirAll(longPath(m.CAROOT), 0755), "failed to create the CAROOT")
+	// Resolve symlinks once, so that all paths derived from the CAROOT, and
+	// the CAROOT passed to child processes, are consistent.
+	m.CAROOT = canonicalPath(m.CAROOT)
+	if m.verifySystemMode {
+		m.verifySystemTrust()
+		return
+	}
+	if m.importCAFile != "" {
+		m.readExport(m.importCAFile)
+		return
+	}
+	if m.listMode {
+		m.listIssued(os.Stdout, m.listJSON)
+		return
+	}
+	if m.sshMode {
+		m.makeSSHCert(args)
+		return
+	}
+	if m.exportCAFile != "" {
+		if !pathExists(filepath.Join(m.CAROOT, rootName)) {
+			fatalErr(errorf(ErrNoCA, "there is no local CA at %q to export", m.CAROOT))
+		}
+		m.writeExport(m.exportCAFile, os.Getenv(exportPassphraseEnv))
+		return
+	}
+	noSudo = m.userOnly
+	unlock := m.lockCAROOT()
+	if m.renewCAMode {
+		m.renewCA()
+	}
+	if m.rotateCAMode {
+		m.startRotation()
 	}
-	fatalIfErr(os.MkdirAll(m.CAROOT, 0755), "failed to create the CAROOT")
 	m.loadCA()
+	if m.genIntermediateMode {
+		m.newIntermediate()
+	}
+	if m.encryptCAKey {
+		m.encryptCAKeys()
+	}
+	unlock()
+	if m.nssProfile != "" {
+		hasNSS = true
+	}
+	m.checkPermissions()
 
-	if m.installMode {
+	if m.rotateFinish {
+		m.finishRotation(false)
+		return
+	}
+
+	if m.fillKeyPoolMode {
+		m.fillKeyPool()
+		return
+	}
+	if m.caTrustStore != "" {
+		m.writeCATrustStore()
+		if len(args) == 0 && !m.installMode && !m.renewCAMode && !m.rotateCAMode && !m.uninstallMode {
+			return
+		}
+	}
+
+	if m.installMode || m.renewCAMode || m.rotateCAMode {
+		if m.installMode {
+			m.finishRotation(true)
+		}
 		m.install()
-		if len(args) == 0 {
+		if m.rotateCAMode {
+			m.reissueTracked()
+			return
+		}
+		if len(args) == 0 && !m.codeSigning {
 			return
 		}
 	} else if m.uninstallMode {
 		m.uninstall()
 		return
 	} else {
-		var warning bool
-		if storeEnabled("system") && !m.checkPlatform() {
-			warning = true
-			log.Println("Note: the local CA is not installed in the system trust store.")
-		}
-		if storeEnabled("nss") && hasNSS && CertutilInstallHelp != "" && !m.checkNSS() {
-			warning = true
-			log.Printf("Note: the local CA is not installed in the %s trust store.", NSSBrowsers)
-		}
-		if storeEnabled("java") && hasJava && !m.checkJava() {
-			warning = true
-			log.Println("Note: the local CA is not installed in the Java trust store.")
+		missing := m.uninstalledStores()
+		for _, store := range missing {
+			switch store {
+			case "system":
+				m.warn(WarningNotInstalled, store, "Note: the local CA is not installed in the system trust store.")
+			case "nss":
+				m.warn(WarningNotInstalled, store, "Note: the local CA is not installed in the %s trust store.", NSSBrowsers)
+			case "java":
+				m.warn(WarningNotInstalled, store, "Note: the local CA is not installed in the Java trust store.")
+			}
 		}
-		if warning {
-			log.Println("Run \"mkcert -install\" for certificates to be trusted automatically ⚠️")
+		if len(missing) > 0 {
+			m.logln("Run \"mkcert -install\" for certificates to be trusted automatically ⚠️")
 		}
 	}
 
-	if m.csrPath != "" {
-		m.makeCertFromCSR()
+	if m.regenerateMode {
+		m.regenerate(args)
+		return
+	}
+	if m.renewMode {
+		err = m.renewFiles(args)
+		return
+	}
+	if m.checkMode {
+		err = m.checkFiles(args)
+		return
+	}
+	if m.revokeMode {
+		m.revokeFiles(args)
+		return
+	}
+	if m.genCRLMode {
+		m.writeCRL()
+		return
+	}
+	if m.ocspMode {
+		m.serveOCSP()
+		return
+	}
+	if m.serveAddr != "" {
+		m.serveAPI(m.serveAddr)
 		return
 	}
 
-	if len(args) == 0 {
-		flag.Usage()
+	if m.dockerContainer != "" {
+		m.installInContainer(m.dockerContainer)
+		if len(args) == 0 && !m.alsoLocalhost && !m.alsoLAN {
+			return
+		}
+	}
+
+	if m.codeSigning {
+		if len(args) == 0 {
+			args = []string{defaultCodeSigningName}
+		}
+		m.makeCert(args)
 		return
 	}
 
-	hostnameRegexp := regexp.MustCompile(`(?i)^(\*\.)?[0-9a-z_-]([0-9a-z._-]*[0-9a-z_-])?$`)
-	for i, name := range args {
-		if ip := net.ParseIP(name); ip != nil {
-			continue
+	// Only the names given as arguments are added to the hosts file by
+	// -with-dns, not the hostname of the machine.
+	dnsNames := len(args)
+	if m.alsoLocalhost {
+		args = appendNames(args, localhostNames...)
+	}
+	if m.alsoLAN {
+		args = appendNames(args, m.lanNames()...)
+	}
+
+	if len(args) == 0 && m.preset == "" && m.csrPath == "" {
+		if !m.fixPerms && !m.genIntermediateMode {
+			flag.Usage()
 		}
-		if email, err := mail.ParseAddress(name); err == nil && email.Address == name {
-			continue
+		return
+	}
+
+	m.normalizeNames(args)
+	m.normalizeNames(m.addSANs)
+	m.checkPublicNames(args)
+	if m.smime {
+		for _, name := range args {
+			if !strings.Contains(name, "@") {
+				log.Fatalf("ERROR: -smime certificates are only for email addresses, not %q", name)
+			}
 		}
-		if uriName, err := url.Parse(name); err == nil && uriName.Scheme != "" && uriName.Host != "" {
-			continue
+	}
+	if m.keyType == keyTypeEd25519 && m.csrPath == "" {
+		m.warn(WarningPolicy, "", "Warning: browsers don't support Ed25519 certificates, only use them with other clients ⚠️")
+	}
+
+	if m.csrPath != "" {
+		m.makeCertFromCSR(args)
+	} else if m.preset != "" {
+		m.makePresetCerts(m.preset, args)
+	} else {
+		m.makeCert(args)
+		if m.docker {
+			m.printDockerCompose(m.issued[len(m.issued)-1])
 		}
-		punycode, err := idna.ToASCII(name)
+	}
+
+	if m.withDNS {
+		m.addDNSEntries(args[:dnsNames], "127.0.0.1")
+	}
+	return
+}
+
+// context returns the context of the current RunContext call, or
+// context.Background outside of one, like in LoadCA or CreateCert.
+func (m *mkcert) context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+var hostnameRegexp = regexp.MustCompile(`(?i)^(\*\.)?[0-9a-z_-]([0-9a-z._-]*[0-9a-z_-])?$`)
+
+// normalizeNames normalizes names in place with normalizeName, recording
+// the Unicode form of internationalized hostnames, and exits if one is not
+// valid.
+func (m *mkcert) normalizeNames(names []string) {
+	for i, name := range names {
+		hostname, unicode, err := m.normalizeName(strings.TrimSpace(name))
 		if err != nil {
-			log.Fatalf("ERROR: %q is not a valid hostname, IP, URL or email: %s", name, err)
+			fatalErr(err)
 		}
-		args[i] = punycode
-		if !hostnameRegexp.MatchString(punycode) {
-			log.Fatalf("ERROR: %q is not a valid hostname, IP, URL or email", name)
+		names[i] = hostname
+		if unicode != "" {
+			if m.uLabels == nil {
+				m.uLabels = make(map[string]string)
+			}
+			m.uLabels[hostname] = unicode
 		}
 	}
+}
 
-	m.makeCert(args)
+// normalizeName validates name as a hostname, IP, URL or email, and returns it
+// in the form used in certificates. Hostnames are lowercased, stripped of the
+// trailing dot, and converted to A-labels, in which case unicode is the
+// original U-label form.
+func (m *mkcert) normalizeName(name string) (normalized, unicode string, err error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return name, "", nil
+	}
+	if email, err := mail.ParseAddress(name); err == nil && email.Address == name {
+		return name, "", nil
+	}
+	if uriName, err := url.Parse(name); err == nil && uriName.Scheme != "" && uriName.Host != "" {
+		return name, "", nil
+	}
+	// Hostnames are case-insensitive, and the trailing dot of a fully
+	// qualified name is not allowed in certificates.
+	hostname := strings.ToLower(name)
+	if strings.HasSuffix(hostname, ".") && !strings.HasSuffix(hostname, "..") {
+		hostname = strings.TrimSuffix(hostname, ".")
+	}
+	punycode, err := idna.ToASCII(hostname)
+	if err != nil {
+		return "", "", errorf(ErrInvalidHostname, "%q is not a valid hostname, IP, URL or email: %s", name, err)
+	}
+	if !hostnameRegexp.MatchString(punycode) {
+		return "", "", errorf(ErrInvalidHostname, "%q is not a valid hostname, IP, URL or email", name)
+	}
+	if m.rejectUnderscores && strings.Contains(punycode, "_") {
+		return "", "", errorf(ErrInvalidHostname, "%q contains an underscore, which is not valid in hostnames", name)
+	}
+	if punycode != hostname {
+		unicode = hostname
+	}
+	return punycode, unicode, nil
 }
 
 func getCAROOT() string {
@@ -242,102 +1199,297 @@ func getCAROOT() string {
 	switch {
 	case runtime.GOOS == "windows":
 		dir = os.Getenv("LocalAppData")
+		if home := homeDir(); dir == "" && home != "" {
+			dir = filepath.Join(home, "AppData", "Local")
+		}
 	case os.Getenv("XDG_DATA_HOME") != "":
 		dir = os.Getenv("XDG_DATA_HOME")
 	case runtime.GOOS == "darwin":
-		dir = os.Getenv("HOME")
-		if dir == "" {
-			return ""
+		if home := homeDir(); home != "" {
+			dir = filepath.Join(home, "Library", "Application Support")
 		}
-		dir = filepath.Join(dir, "Library", "Application Support")
 	default: // Unix
-		dir = os.Getenv("HOME")
-		if dir == "" {
-			return ""
+		if home := homeDir(); home != "" {
+			dir = filepath.Join(home, ".local", "share")
 		}
-		dir = filepath.Join(dir, ".local", "share")
+	}
+	if dir == "" && runtime.GOOS != "windows" && os.Getuid() == 0 {
+		// System services and minimal containers often run as root
+		// without a home directory.
+		dir = "/var/lib"
+	}
+	if dir == "" {
+		return ""
 	}
 	return filepath.Join(dir, "mkcert")
 }
 
+// homeDir returns the home directory of the current user from the
+// environment or, if that's not set (as in some containers, CI runners and
+// services), from the user database.
+func homeDir() string {
+	env := "HOME"
+	if runtime.GOOS == "windows" {
+		env = "USERPROFILE"
+	}
+	if home := os.Getenv(env); home != "" {
+		return home
+	}
+	if u, err := user.Current(); err == nil && u.HomeDir != "" && u.HomeDir != "/" && pathExists(u.HomeDir) {
+		return u.HomeDir
+	}
+	return ""
+}
+
 func (m *mkcert) install() {
-	if storeEnabled("system") {
-		if m.checkPlatform() {
-			log.Print("The local CA is already installed in the system trust store! 👍")
+	installed := m.checkStores()
+	defer m.forgetStoreStatus()
+	if systemStoreEnabled() {
+		if installed.system {
+			m.logln("The local CA is already installed in the system trust store! 👍")
 		} else {
 			if m.installPlatform() {
-				log.Print("The local CA is now installed in the system trust store! ⚡️")
+				if m.verifyPlatformInstall() {
+					m.logln("The local CA is now installed in the system trust store! ⚡️")
+				} else {
+					m.warn(WarningNotTrusted, "system", "Warning: the local CA was added to the system trust store, but it's still not trusted! ⚠️")
+					m.logln("Please report the issue with details about your environment at https://github.com/FiloSottile/mkcert/issues/new 👎")
+				}
 			}
-			m.ignoreCheckFailure = true // TODO: replace with a check for a successful install
 		}
 	}
-	if storeEnabled("nss") && hasNSS {
-		if m.checkNSS() {
-			log.Printf("The local CA is already installed in the %s trust store! 👍", NSSBrowsers)
-		} else {
-			if hasCertutil && m.installNSS() {
-				log.Printf("The local CA is now installed in the %s trust store (requires browser restart)! 🦊", NSSBrowsers)
-			} else if CertutilInstallHelp == "" {
-				log.Printf(`Note: %s support is not available on your platform. ℹ️`, NSSBrowsers)
-			} else if !hasCertutil {
-				log.Printf(`Warning: "certutil" is not available, so the CA can't be automatically installed in %s! ⚠️`, NSSBrowsers)
-				log.Printf(`Install "certutil" with "%s" and re-run "mkcert -install" 👈`, CertutilInstallHelp)
+	// The NSS profiles and Java keystores are independent, and updating
+	// each means running certutil or keytool, so they are updated at the
+	// same time, after the system store that might prompt for a password.
+	runParallel(func() {
+		if nssStoreEnabled() && hasNSS {
+			if installed.nss {
+				m.logf("The local CA is already installed in the %s trust store! 👍", NSSBrowsers)
+			} else {
+				if canManageNSS() && m.installNSS() {
+					m.logf("The local CA is now installed in the %s trust store (requires browser restart)! 🦊", NSSBrowsers)
+				} else if CertutilInstallHelp == "" {
+					m.warn(WarningStoreUnsupported, "nss", `Note: %s support is not available on your platform. ℹ️`, NSSBrowsers)
+				} else if !canManageNSS() {
+					m.warn(WarningStoreUnsupported, "nss", `Warning: "certutil" is not available, so the CA can't be automatically installed in %s! ⚠️`, NSSBrowsers)
+					m.logf(`Install "certutil" with "%s" and re-run "mkcert -install" 👈`, CertutilInstallHelp)
+				}
+			}
+		}
+	}, func() {
+		if storeEnabled("java") && hasJava {
+			if installed.java {
+				m.logln("The local CA is already installed in Java's trust store! 👍")
+			} else {
+				if hasKeytool {
+					m.installJava()
+					if m.userOnly {
+						m.logf("The local CA is now installed in the Java trust store at %q! ☕️", m.javaKeystore())
+					} else if len(javaKeystores) > 1 {
+						m.logf("The local CA is now installed in the trust stores of %d JDKs! ☕️", len(javaKeystores))
+					} else {
+						m.logln("The local CA is now installed in Java's trust store! ☕️")
+					}
+				} else {
+					m.warn(WarningStoreUnsupported, "java", `Warning: "keytool" is not available, so the CA can't be automatically installed in Java's trust store! ⚠️`)
+				}
 			}
 		}
+	})
+	if m.userOnly {
+		m.printUserOnlyReport()
 	}
-	if storeEnabled("java") && hasJava {
-		if m.checkJava() {
-			log.Println("The local CA is already installed in Java's trust store! 👍")
-		} else {
+	m.logln("")
+}
+
+func (m *mkcert) uninstall() {
+	defer m.forgetStoreStatus()
+	runParallel(func() {
+		if nssStoreEnabled() && hasNSS {
+			if canManageNSS() {
+				m.uninstallNSS()
+			} else if CertutilInstallHelp != "" {
+				m.logln("")
+				m.warn(WarningStoreUnsupported, "nss", `Warning: "certutil" is not available, so the CA can't be automatically uninstalled from %s (if it was ever installed)! ⚠️`, NSSBrowsers)
+				m.logf(`You can install "certutil" with "%s" and re-run "mkcert -uninstall" 👈`, CertutilInstallHelp)
+				m.logln("")
+			}
+		}
+	}, func() {
+		if storeEnabled("java") && hasJava {
 			if hasKeytool {
-				m.installJava()
-				log.Println("The local CA is now installed in Java's trust store! ☕️")
+				m.uninstallJava()
 			} else {
-				log.Println(`Warning: "keytool" is not available, so the CA can't be automatically installed in Java's trust store! ⚠️`)
+				m.logln("")
+				m.warn(WarningStoreUnsupported, "java", `Warning: "keytool" is not available, so the CA can't be automatically uninstalled from Java's trust store (if it was ever installed)! ⚠️`)
+				m.logln("")
 			}
 		}
+	})
+	if systemStoreEnabled() && m.uninstallPlatform() {
+		m.logln("The local CA is now uninstalled from the system trust store(s)! 👋")
+		m.logln("")
+	} else if nssStoreEnabled() && canManageNSS() {
+		m.logf("The local CA is now uninstalled from the %s trust store(s)! 👋", NSSBrowsers)
+		m.logln("")
 	}
-	log.Print("")
 }
 
-func (m *mkcert) uninstall() {
-	if storeEnabled("nss") && hasNSS {
-		if hasCertutil {
-			m.uninstallNSS()
-		} else if CertutilInstallHelp != "" {
-			log.Print("")
-			log.Printf(`Warning: "certutil" is not available, so the CA can't be automatically uninstalled from %s (if it was ever installed)! ⚠️`, NSSBrowsers)
-			log.Printf(`You can install "certutil" with "%s" and re-run "mkcert -uninstall" 👈`, CertutilInstallHelp)
-			log.Print("")
-		}
-	}
-	if storeEnabled("java") && hasJava {
-		if hasKeytool {
-			m.uninstallJava()
-		} else {
-			log.Print("")
-			log.Println(`Warning: "keytool" is not available, so the CA can't be automatically uninstalled from Java's trust store (if it was ever installed)! ⚠️`)
-			log.Print("")
+// hasSystemStore is false on platforms where installing in the system trust
+// store is not supported at all. See truststore_other.go.
+var hasSystemStore = true
+
+// storeStatus reports whether the local CA is installed in each trust store.
+type storeStatus struct {
+	system, nss, java bool
+}
+
+// checkStores checks the enabled and available trust stores concurrently.
+// The results are cached, see storeCache.
+func (m *mkcert) checkStores() storeStatus {
+	if s, ok := m.cachedStoreStatus(); ok {
+		return s
+	}
+	var s storeStatus
+	runParallel(func() {
+		if systemStoreEnabled() {
+			s.system = m.checkPlatform()
+		}
+	}, func() {
+		if nssStoreEnabled() && hasNSS {
+			s.nss = m.checkNSS()
 		}
+	}, func() {
+		if storeEnabled("java") && hasJava {
+			s.java = m.checkJava()
+		}
+	})
+	m.cacheStoreStatus(s)
+	return s
+}
+
+// uninstalledStores returns the names of the enabled and available trust
+// stores that don't trust the local CA, like Warning.Store.
+func (m *mkcert) uninstalledStores() []string {
+	installed := m.checkStores()
+	var stores []string
+	if systemStoreEnabled() && hasSystemStore && !installed.system {
+		stores = append(stores, "system")
+	}
+	if nssStoreEnabled() && hasNSS && CertutilInstallHelp != "" && !installed.nss {
+		stores = append(stores, "nss")
 	}
-	if storeEnabled("system") && m.uninstallPlatform() {
-		log.Print("The local CA is now uninstalled from the system trust store(s)! 👋")
-		log.Print("")
-	} else if storeEnabled("nss") && hasCertutil {
-		log.Printf("The local CA is now uninstalled from the %s trust store(s)! 👋", NSSBrowsers)
-		log.Print("")
+	if storeEnabled("java") && hasJava && !installed.java {
+		stores = append(stores, "java")
 	}
+	return stores
 }
 
+// checkSystemStore, if set by the platform, checks whether the local CA is in
+// the system trust store by looking it up directly, which unlike crypto/x509
+// sees the changes made by this process.
+var checkSystemStore func(m *mkcert) bool
+
 func (m *mkcert) checkPlatform() bool {
-	if m.ignoreCheckFailure {
-		return true
+	if checkSystemStore != nil {
+		return checkSystemStore(m)
 	}
-
 	_, err := m.caCert.Verify(x509.VerifyOptions{})
 	return err == nil
 }
 
+// systemRootBundles, if set by the platform, are the files the system roots
+// are loaded from, in order of preference like crypto/x509 does. See
+// verifyPlatformInstall.
+var systemRootBundles []string
+
+// verifyPlatformInstall checks that the local CA is trusted by the system
+// after installPlatform. The system cert pool is only loaded once per process
+// (https://github.com/golang/go/issues/24540, thanks, myself), so where the
+// roots come from a bundle file, it's read again into a new pool. Otherwise,
+// the check is made by a new execution of mkcert, which reads the updated
+// store, or skipped when not running as the mkcert command.
+func (m *mkcert) verifyPlatformInstall() bool {
+	if checkSystemStore != nil {
+		return checkSystemStore(m)
+	}
+	if len(systemRootBundles) > 0 {
+		return m.inSystemRootBundle()
+	}
+	if !m.cli {
+		return true
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	args := []string{"-verify-system-trust"}
+	if m.caCertFile != "" {
+		args = append(args, "-ca-cert", m.caCertFile)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), "CAROOT="+m.CAROOT)
+	_, err = runCommand(m.context(), cmd)
+	return err == nil
+}
+
+// inSystemRootBundle verifies the local CA against a new pool loaded from
+// the first of systemRootBundles that exists, or $SSL_CERT_FILE.
+func (m *mkcert) inSystemRootBundle() bool {
+	bundles := systemRootBundles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		bundles = []string{f}
+	}
+	for _, path := range bundles {
+		data, err := ioutil.ReadFile(longPath(path))
+		if err != nil {
+			continue
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(data)
+		_, err = m.caCert.Verify(x509.VerifyOptions{Roots: pool})
+		return err == nil
+	}
+	return false
+}
+
+// verifySystemTrust implements the internal -verify-system-trust mode, used
+// by verifyPlatformInstall. It only reads the CA certificate, so it works
+// without the CA key, like for an encrypted one, and exits with
+// exitNotInstalled if the system doesn't trust it.
+func (m *mkcert) verifySystemTrust() {
+	cert, err := readCertChain(m.caCertPath())
+	fatalIfErr(err, "failed to read the CA certificate")
+	m.caCert = cert[0]
+	if !m.checkPlatform() {
+		os.Exit(exitNotInstalled)
+	}
+}
+
+// platformStores are the names of the individual system trust stores of the
+// platform, like "ca-certificates" on Linux, that TRUST_STORES can select
+// instead of all of "system".
+var platformStores []string
+
+// storeSelected reports whether TRUST_STORES explicitly lists name.
+func storeSelected(name string) bool {
+	return os.Getenv("TRUST_STORES") != "" && storeEnabled(name)
+}
+
+// systemStoreEnabled reports whether TRUST_STORES selects the system store,
+// or any of the platformStores.
+func systemStoreEnabled() bool {
+	if storeEnabled("system") {
+		return true
+	}
+	for _, name := range platformStores {
+		if storeSelected(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func storeEnabled(name string) bool {
 	stores := os.Getenv("TRUST_STORES")
 	if stores == "" {
@@ -351,9 +1503,30 @@ func storeEnabled(name string) bool {
 	return false
 }
 
+// maxParallelism bounds the number of trust store operations, and so of
+// external commands, running at the same time.
+var maxParallelism = 4
+
+// runParallel runs fs concurrently, at most maxParallelism at a time, and
+// returns once all of them have returned.
+func runParallel(fs ...func()) {
+	sem := make(chan struct{}, maxParallelism)
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(f func()) {
+			defer func() { <-sem; wg.Done() }()
+			f()
+		}(f)
+	}
+	wg.Wait()
+}
+
 func fatalIfErr(err error, msg string) {
 	if err != nil {
-		log.Fatalf("ERROR: %s: %s", msg, err)
+		log.Printf("ERROR: %s: %s", msg, err)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -364,18 +1537,21 @@ func fatalIfCmdErr(err error, cmd string, out []byte) {
 }
 
 func pathExists(path string) bool {
-	_, err := os.Stat(path)
+	_, err := os.Stat(longPath(path))
 	return err == nil
 }
 
 func binaryExists(name string) bool {
-	_, err := exec.LookPath(name)
+	_, err := runner.LookPath(name)
 	return err == nil
 }
 
 var sudoWarningOnce sync.Once
 
 func commandWithSudo(cmd ...string) *exec.Cmd {
+	if noSudo {
+		return exec.Command(cmd[0], cmd[1:]...)
+	}
 	if u, err := user.Current(); err == nil && u.Uid == "0" {
 		return exec.Command(cmd[0], cmd[1:]...)
 	}
@@ -0,0 +1,160 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspValidity is how long OCSP responses are valid for. Revocations are
+// picked up by the responder immediately, but clients might cache responses.
+const ocspValidity = time.Hour
+
+// defaultOCSPListen is the -listen address of -ocsp.
+const defaultOCSPListen = "localhost:8888"
+
+// serveOCSP implements -ocsp, serving OCSP responses signed by the local CA
+// for the certificates in the issuance index until the process is stopped, or
+// the RunContext context is canceled.
+func (m *mkcert) serveOCSP() {
+	listen := m.listen
+	if listen == "" {
+		listen = defaultOCSPListen
+	}
+	if _, issuerKey := m.issuer(); issuerKey == nil {
+		fatalErr(errNoCAKey("sign OCSP responses"))
+	}
+
+	m.logf("The OCSP responder is at http://%s/ 🔎", listen)
+	if m.ocspURL == "" {
+		m.logf("Use -ocsp-url when issuing certificates to point clients to it ℹ️")
+	}
+	m.logf("Certificates issued before mkcert tracked them are reported as unknown ℹ️\n\n")
+	srv := &http.Server{Addr: listen, Handler: http.HandlerFunc(m.handleOCSP)}
+	fatalIfErr(m.serveUntilCanceled(srv, nil), "failed to serve")
+}
+
+// handleOCSP serves RFC 6960 requests, both as POST bodies and as base64
+// encoded GET paths.
+func (m *mkcert) handleOCSP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10000))
+	case http.MethodGet:
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		if path, err = url.PathUnescape(path); err == nil {
+			der, err = base64.StdEncoding.DecodeString(path)
+		}
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := ocsp.MalformedRequestErrorResponse
+	if err == nil {
+		var req *ocsp.Request
+		if req, err = ocsp.ParseRequest(der); err == nil {
+			resp, err = m.OCSPResponse(req)
+			if err != nil {
+				resp = ocsp.UnauthorizedErrorResponse
+				if err != errUnknownOCSPIssuer {
+					resp = ocsp.InternalErrorErrorResponse
+					log.Printf("ERROR: failed to create the OCSP response: %s", err)
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+var errUnknownOCSPIssuer = errors.New("the OCSP request is not for a certificate issued by the local CA")
+
+// OCSPResponse returns a DER encoded response to req, signed by the CA that
+// issued the certificate, the root or the intermediate. The status is good
+// or revoked for certificates in the issuance index, and unknown otherwise.
+func (m *mkcert) OCSPResponse(req *ocsp.Request) ([]byte, error) {
+	var issuerCert *x509.Certificate
+	var issuerKey crypto.PrivateKey
+	for _, ca := range []struct {
+		cert *x509.Certificate
+		key  crypto.PrivateKey
+	}{{m.caCert, m.caKey}, {m.intCert, m.intKey}} {
+		if ca.cert != nil && ocspRequestMatches(req, ca.cert) {
+			issuerCert, issuerKey = ca.cert, ca.key
+		}
+	}
+	if issuerCert == nil {
+		return nil, errUnknownOCSPIssuer
+	}
+	signer, ok := issuerKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("the CA key is missing")
+	}
+
+	entries, err := m.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		IssuerHash:   req.HashAlgorithm,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(ocspValidity),
+	}
+	serial, id := serialString(req.SerialNumber), caID(issuerCert)
+	for _, e := range entries {
+		if e.Serial != serial || e.Issuer != id {
+			continue
+		}
+		tpl.Status = ocsp.Good
+		if e.RevokedAt != nil {
+			tpl.Status = ocsp.Revoked
+			tpl.RevokedAt = *e.RevokedAt
+		}
+	}
+	return ocsp.CreateResponse(issuerCert, issuerCert, tpl, signer)
+}
+
+// ocspRequestMatches reports whether req is for a certificate issued by ca,
+// by comparing the hashes of its name and public key.
+func ocspRequestMatches(req *ocsp.Request, ca *x509.Certificate) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	h := req.HashAlgorithm.New()
+	h.Write(ca.RawSubject)
+	if !bytes.Equal(h.Sum(nil), req.IssuerNameHash) {
+		return false
+	}
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// runOCSPStaple implements "mkcert ocsp-staple [-url URL] [-issuer FILE]
+// [-o FILE] CERT", which fetches the OCSP status of CERT and saves the DER
+// response, ready to be stapled by a test server.
+func runOCSPStaple(args []string) {
+	fs := flag.NewFlagSet("ocsp-staple", flag.ExitOnError)
+	urlFlag := fs.String("url", "", "")
+	issuerFlag := fs.String("issuer", "", "")
+	outFlag := fs.String("o", "", "")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: mkcert ocsp-staple [-url URL] [-issuer FILE] [-o FILE] CERT`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	certPath := fs.Arg(0)
+
+	chain, err := readCertChain(certPath)
+	fatalIfErr(err, "failed to read the certificate")
+	cert := chain[0]
+
+	var issuer *x509.Certificate
+	switch {
+	case *issuerFlag != "":
+		issuers, err := readCertChain(*issuerFlag)
+		fatalIfErr(err, "failed to read the issuer certificate")
+		issuer = issuers[0]
+	case len(chain) > 1:
+		issuer = chain[1]
+	default:
+		issuer = probeCA()
+		if issuer == nil {
+			fatalErr(errorf(ErrNoCA, `there is no local CA, use "-issuer" to specify the certificate issuer`))
+		}
+	}
+	if err := cert.CheckSignatureFrom(issuer); err != nil {
+		log.Fatalf("ERROR: the certificate was not issued by %q, use \"-issuer\" to specify its issuer", issuer.Subject)
+	}
+
+	responder := *urlFlag
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			log.Fatalln(`ERROR: the certificate doesn't include an OCSP responder URL, use "-url" to specify one`)
+		}
+		responder = cert.OCSPServer[0]
+	}
+
+	der, resp, err := fetchOCSP(responder, cert, issuer)
+	fatalIfErr(err, "failed to fetch the OCSP response")
+
+	out := *outFlag
+	if out == "" {
+		out = strings.TrimSuffix(certPath, filepath.Ext(certPath)) + ".ocsp"
+	}
+	fatalIfErr(writeFile(out, der, 0644), "failed to save the OCSP response")
+
+	status := map[int]string{ocsp.Good: "good", ocsp.Revoked: "revoked", ocsp.Unknown: "unknown"}[resp.Status]
+	log.Printf("The OCSP status of %q from %s is %s 📡", certPath, responder, status)
+	if resp.Status == ocsp.Revoked {
+		log.Printf("It was revoked on %s", resp.RevokedAt.Format("2 January 2006 15:04 MST"))
+	}
+	if !resp.NextUpdate.IsZero() {
+		log.Printf("The response is valid until %s", resp.NextUpdate.Format("2 January 2006 15:04 MST"))
+	}
+	log.Printf("The staple is at %q ✅", out)
+}
+
+// fetchOCSP POSTs an OCSP request for cert to responder, and returns the raw
+// response after checking its signature against issuer.
+func fetchOCSP(responder string, cert, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	httpResp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("the responder returned %s", httpResp.Status)
+	}
+	der, err := ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return der, resp, nil
+}
+
+// readCertChain reads all the certificates in a PEM file, in order.
+func readCertChain(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return chain, nil
+}
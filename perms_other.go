@@ -0,0 +1,16 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+// checkPermissions is a no-op where files don't have Unix permissions. On
+// Windows, the CAROOT is in the user profile, which is private by default.
+func (m *mkcert) checkPermissions() {}
+
+// supportsPermissions always returns true, as there are no permissions to
+// check for.
+func supportsPermissions(dir string) bool { return true }
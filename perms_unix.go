@@ -0,0 +1,105 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// checkPermissions warns if the CA key is accessible to other users, or if the
+// CAROOT could be modified by them, and fixes it if m.fixPerms is set. Keys
+// created by older versions, or copied around, are often left world-readable.
+func (m *mkcert) checkPermissions() {
+	if !supportsPermissions(m.CAROOT) {
+		m.warn(WarningPermissions, "", "Warning: the CAROOT %q is on a file system that doesn't support permissions (like FAT or some network shares), so the CA key can't be protected from other users! ⚠️", m.CAROOT)
+		m.logln("")
+		return
+	}
+
+	var problems bool
+	if fi, err := os.Stat(m.CAROOT); err == nil {
+		if mode := fi.Mode().Perm(); mode&0022 != 0 {
+			problems = true
+			m.fixPermission(m.CAROOT, mode, mode&^0022,
+				"the CAROOT %q is writable by other users (mode %04o), so they could replace the CA")
+		}
+		m.checkOwner(m.CAROOT, fi)
+	}
+
+	keyPath := filepath.Join(m.CAROOT, rootKeyName)
+	if fi, err := os.Stat(keyPath); err == nil {
+		if mode := fi.Mode().Perm(); mode&0077 != 0 {
+			problems = true
+			m.fixPermission(keyPath, mode, 0400,
+				"the CA key %q is accessible to other users (mode %04o), so they could intercept your secure connections")
+		}
+		m.checkOwner(keyPath, fi)
+	}
+
+	if problems && !m.fixPerms {
+		m.logf(`Run "mkcert -fix-perms" to fix the permissions 👈`)
+		m.logln("")
+	}
+}
+
+func (m *mkcert) fixPermission(path string, mode, fixed os.FileMode, problem string) {
+	if !m.fixPerms {
+		m.warn(WarningPermissions, "", "Warning: "+problem+"! ⚠️", path, mode)
+		return
+	}
+	fatalIfErr(os.Chmod(path, fixed), "failed to fix permissions")
+	m.logf("Fixed the permissions of %q from %04o to %04o 🔒", path, mode, fixed)
+}
+
+func (m *mkcert) checkOwner(path string, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) == os.Getuid() || os.Getuid() == 0 {
+		return
+	}
+	m.warn(WarningPermissions, "", "Warning: %q is owned by another user (uid %d), who has control over the CA! ⚠️", path, st.Uid)
+}
+
+var (
+	permSupportMu    sync.Mutex
+	permSupportCache = make(map[string]bool)
+)
+
+// supportsPermissions reports whether the file system at dir stores Unix
+// permissions. FAT, exFAT and some network mounts instead either fail chmod
+// or silently ignore it, depending on the mount options.
+func supportsPermissions(dir string) bool {
+	permSupportMu.Lock()
+	defer permSupportMu.Unlock()
+	if supported, ok := permSupportCache[dir]; ok {
+		return supported
+	}
+
+	f, err := ioutil.TempFile(dir, ".mkcert-perm-check-")
+	if err != nil {
+		return true // we'll find out when writing
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	supported := true
+	for _, mode := range []os.FileMode{0600, 0644} {
+		if os.Chmod(f.Name(), mode) != nil {
+			supported = false
+			break
+		}
+		if fi, err := os.Stat(f.Name()); err != nil || fi.Mode().Perm() != mode {
+			supported = false
+			break
+		}
+	}
+	permSupportCache[dir] = supported
+	return supported
+}
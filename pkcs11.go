@@ -0,0 +1,146 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// pkcs11ModuleEnv is the path of the PKCS #11 module to load when the
+	// pkcs11: URI has no module-path, like the YubiKey libykcs11.so.
+	pkcs11ModuleEnv = "MKCERT_PKCS11_MODULE"
+
+	// pkcs11PINEnv is the token PIN when the pkcs11: URI has no pin-source,
+	// which keeps it out of the process list, like keyPassEnv.
+	pkcs11PINEnv = "MKCERT_PKCS11_PIN"
+)
+
+func isPKCS11URI(s string) bool {
+	return strings.HasPrefix(s, "pkcs11:")
+}
+
+// pkcs11URI is the subset of an RFC 7512 pkcs11: URI that identifies a
+// private key. Other attributes are ignored.
+type pkcs11URI struct {
+	token, manufacturer, model, serial string
+	object                             string
+	id                                 []byte
+	modulePath, pinSource              string
+}
+
+// parsePKCS11URI parses a URI like
+//
+//	pkcs11:token=YubiKey%20PIV;id=%02?module-path=/usr/lib/libykcs11.so
+//
+// which must identify the key by object (its label) or id.
+func parsePKCS11URI(s string) (*pkcs11URI, error) {
+	if !isPKCS11URI(s) {
+		return nil, errors.New("not a pkcs11: URI")
+	}
+	path, query := strings.TrimPrefix(s, "pkcs11:"), ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	u := &pkcs11URI{}
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "token":
+			u.token = value
+		case "manufacturer":
+			u.manufacturer = value
+		case "model":
+			u.model = value
+		case "serial":
+			u.serial = value
+		case "object":
+			u.object = value
+		case "id":
+			u.id = []byte(value)
+		case "type":
+			if value != "private" {
+				return nil, fmt.Errorf("the pkcs11: URI must be for a private key, not type=%s", value)
+			}
+		}
+	}
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+		name, value, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "module-path":
+			u.modulePath = value
+		case "pin-source":
+			u.pinSource = strings.TrimPrefix(value, "file:")
+		case "pin-value":
+			return nil, fmt.Errorf("pin-value is not supported, as it would be visible in the process list; set $%s instead", pkcs11PINEnv)
+		}
+	}
+	if u.object == "" && u.id == nil {
+		return nil, errors.New("the pkcs11: URI must identify the key with object or id")
+	}
+	return u, nil
+}
+
+func splitPKCS11Attr(attr string) (name, value string, err error) {
+	i := strings.IndexByte(attr, '=')
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid pkcs11: URI attribute %q", attr)
+	}
+	value, err = url.PathUnescape(attr[i+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid pkcs11: URI attribute %q", attr)
+	}
+	return attr[:i], value, nil
+}
+
+// module returns the path of the PKCS #11 module to load.
+func (u *pkcs11URI) module() (string, error) {
+	if u.modulePath != "" {
+		return u.modulePath, nil
+	}
+	if path := os.Getenv(pkcs11ModuleEnv); path != "" {
+		return path, nil
+	}
+	return "", fmt.Errorf("no PKCS #11 module specified; set $%s or add module-path to the pkcs11: URI", pkcs11ModuleEnv)
+}
+
+// pin returns the token PIN, or an empty string if none was provided.
+func (u *pkcs11URI) pin() (string, error) {
+	if u.pinSource == "" {
+		return os.Getenv(pkcs11PINEnv), nil
+	}
+	pin, err := ioutil.ReadFile(longPath(u.pinSource))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the PIN: %v", err)
+	}
+	return strings.TrimRight(string(pin), "\r\n"), nil
+}
+
+// matchesToken reports whether the token attributes of u, if any, match the
+// token with the given label, manufacturer, model and serial number.
+func (u *pkcs11URI) matchesToken(label, manufacturer, model, serial string) bool {
+	return (u.token == "" || u.token == label) &&
+		(u.manufacturer == "" || u.manufacturer == manufacturer) &&
+		(u.model == "" || u.model == model) &&
+		(u.serial == "" || u.serial == serial)
+}
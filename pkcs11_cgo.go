@@ -0,0 +1,276 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11Signer is a crypto.Signer for a private key that never leaves a
+// PKCS #11 token, like a YubiKey PIV slot through the ykcs11 module, or an
+// HSM. Operations are serialized, as sessions can't be used concurrently.
+type pkcs11Signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+
+	// pin is kept for keys that require a login for every signature, like
+	// the YubiKey PIV signature slot.
+	pin string
+}
+
+// openPKCS11Key loads the module of the pkcs11: URI, logs into the token,
+// and returns a signer for the private key identified by the URI.
+func openPKCS11Key(uri string) (crypto.Signer, error) {
+	u, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	module, err := u.module()
+	if err != nil {
+		return nil, err
+	}
+	pin, err := u.pin()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load the PKCS #11 module %q", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize the PKCS #11 module %q: %v", module, err)
+	}
+	s := &pkcs11Signer{ctx: ctx}
+	if err := s.open(u, pin); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *pkcs11Signer) open(u *pkcs11URI, pin string) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("failed to list the PKCS #11 tokens: %v", err)
+	}
+	var slot uint
+	var token *pkcs11.TokenInfo
+	for _, id := range slots {
+		info, err := s.ctx.GetTokenInfo(id)
+		if err != nil || !u.matchesToken(info.Label, info.ManufacturerID, info.Model, info.SerialNumber) {
+			continue
+		}
+		if token != nil {
+			return errors.New("the pkcs11: URI matches multiple tokens, add token or serial to it")
+		}
+		slot, token = id, &info
+	}
+	if token == nil {
+		return errors.New("no PKCS #11 token matches the pkcs11: URI, check that it's connected")
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open a PKCS #11 session: %v", err)
+	}
+	if pin != "" {
+		err := s.ctx.Login(s.session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return fmt.Errorf("failed to log into the PKCS #11 token: %v", err)
+		}
+	} else if token.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 {
+		return fmt.Errorf("the PKCS #11 token requires a PIN; set $%s or add pin-source to the pkcs11: URI", pkcs11PINEnv)
+	}
+
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}
+	if u.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.object))
+	}
+	if u.id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.id))
+	}
+	if s.key, err = s.findObject(template); err != nil {
+		return err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the PKCS #11 key: %v", err)
+	}
+	if auth, err := s.ctx.GetAttributeValue(s.session, s.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ALWAYS_AUTHENTICATE, nil),
+	}); err == nil && len(auth[0].Value) == 1 && auth[0].Value[0] != 0 {
+		s.pin = pin
+	}
+
+	// The public key is usually a separate object with the same ID, but some
+	// tokens only expose the RSA public values on the private key object.
+	obj := s.key
+	if pub, err := s.findObject([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[0].Value),
+	}); err == nil {
+		obj = pub
+	}
+	if s.pub, err = s.readPublicKey(obj); err != nil {
+		return fmt.Errorf("failed to read the PKCS #11 public key: %v", err)
+	}
+	return nil
+}
+
+// findObject returns the only object matching template.
+func (s *pkcs11Signer) findObject(template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, fmt.Errorf("failed to search the PKCS #11 token: %v", err)
+	}
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	s.ctx.FindObjectsFinal(s.session)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("failed to search the PKCS #11 token: %v", err)
+	case len(objs) == 0:
+		return 0, errors.New("no key in the PKCS #11 token matches the pkcs11: URI")
+	case len(objs) > 1:
+		return 0, errors.New("the pkcs11: URI matches multiple keys, add object or id to it")
+	}
+	return objs[0], nil
+}
+
+var pkcs11Curves = []struct {
+	oid   asn1.ObjectIdentifier
+	curve elliptic.Curve
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}, elliptic.P256()},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 34}, elliptic.P384()},
+	{asn1.ObjectIdentifier{1, 3, 132, 0, 35}, elliptic.P521()},
+}
+
+func (s *pkcs11Signer) readPublicKey(obj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	if attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}); err == nil {
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err != nil {
+			return nil, errors.New("unsupported elliptic curve parameters")
+		}
+		var curve elliptic.Curve
+		for _, c := range pkcs11Curves {
+			if c.oid.Equal(oid) {
+				curve = c.curve
+			}
+		}
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported elliptic curve %s", oid)
+		}
+		// CKA_EC_POINT should be a DER OCTET STRING, but some modules
+		// return the raw point.
+		point := attrs[1].Value
+		var wrapped []byte
+		if rest, err := asn1.Unmarshal(point, &wrapped); err == nil && len(rest) == 0 {
+			point = wrapped
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("invalid elliptic curve point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, obj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, errors.New("only RSA and ECDSA keys are supported")
+	}
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA public exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(e.Int64())}, nil
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// pkcs1Prefixes are the DER encoded DigestInfo prefixes that CKM_RSA_PKCS
+// expects before the digest, as in crypto/rsa.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign signs digest with the token, producing RSA PKCS #1 v1.5 or ASN.1
+// encoded ECDSA signatures like the crypto/rsa and crypto/ecdsa keys do.
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism uint
+	data := digest
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("RSA-PSS signatures are not supported with PKCS #11 keys")
+		}
+		prefix, ok := pkcs1Prefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+		}
+		mechanism = pkcs11.CKM_RSA_PKCS
+		data = append(append([]byte{}, prefix...), digest...)
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.CKM_ECDSA
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, s.key); err != nil {
+		return nil, fmt.Errorf("PKCS #11 signing failed: %v", err)
+	}
+	if s.pin != "" {
+		if err := s.ctx.Login(s.session, pkcs11.CKU_CONTEXT_SPECIFIC, s.pin); err != nil {
+			return nil, fmt.Errorf("failed to log into the PKCS #11 token: %v", err)
+		}
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS #11 signing failed: %v", err)
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		// CKM_ECDSA returns r and s concatenated, as fixed size integers.
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return nil, errors.New("PKCS #11 signing returned an invalid ECDSA signature")
+		}
+		n := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:]),
+		})
+	}
+	return sig, nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+func openPKCS11Key(uri string) (crypto.Signer, error) {
+	if _, err := parsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("PKCS #11 keys are not supported because mkcert was built without cgo")
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxLeafValidity is the longest validity that macOS and iOS accept for TLS
+// server certificates, including those issued by custom roots.
+// See https://support.apple.com/en-us/HT210176.
+//
+// The stricter 398 days limit enforced by Chrome and Safari only applies to
+// publicly trusted roots, so it's not enforced for the local CA.
+const maxLeafValidity = 825 * 24 * time.Hour
+
+// policyViolations returns the reasons why browsers would reject a certificate
+// issued from tpl, even with the local CA installed.
+func policyViolations(tpl *x509.Certificate) []string {
+	var problems []string
+
+	server := len(tpl.ExtKeyUsage) == 0
+	for _, eku := range tpl.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageServerAuth || eku == x509.ExtKeyUsageAny {
+			server = true
+		}
+	}
+	if !server {
+		return nil
+	}
+
+	if validity := tpl.NotAfter.Sub(tpl.NotBefore); validity > maxLeafValidity {
+		problems = append(problems, fmt.Sprintf("it would be valid for %d days, more than the %d days accepted by macOS and iOS",
+			int(validity.Hours()/24), int(maxLeafValidity.Hours()/24)))
+	}
+
+	hasSAN := len(tpl.DNSNames) > 0 || len(tpl.IPAddresses) > 0 ||
+		len(tpl.URIs) > 0 || len(tpl.EmailAddresses) > 0
+	for _, ext := range tpl.ExtraExtensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			hasSAN = true
+		}
+	}
+	if !hasSAN {
+		problems = append(problems, "it would have no Subject Alternative Names, and browsers ignore the Common Name")
+	}
+
+	switch tpl.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		problems = append(problems, fmt.Sprintf("it would be signed with %v, but browsers require SHA-256 or stronger", tpl.SignatureAlgorithm))
+	}
+
+	return problems
+}
+
+// A policyError lists the reasons why browsers would reject a certificate.
+type policyError []string
+
+// Is makes a policyError match ErrPolicy.
+func (e policyError) Is(target error) bool { return target == ErrPolicy }
+
+func (e policyError) Error() string {
+	return "browsers would reject the certificate: " + strings.Join(e, "; ")
+}
+
+// checkPolicy returns a policyError if browsers would reject a certificate
+// issued from tpl, unless -allow-noncompliant is set, in which case it only
+// warns.
+func (m *mkcert) checkPolicy(tpl *x509.Certificate) error {
+	problems := append(policyViolations(tpl), m.constraintViolations(tpl)...)
+	if len(problems) == 0 {
+		return nil
+	}
+	if !m.allowNonCompliant {
+		return policyError(problems)
+	}
+	for _, p := range problems {
+		m.warn(WarningPolicy, "", "Warning: browsers will reject this certificate: %s ⚠️", p)
+	}
+	return nil
+}
+
+// enforcePolicy is like checkPolicy, but exits on error.
+func (m *mkcert) enforcePolicy(tpl *x509.Certificate) {
+	fatalIfPolicyErr(m.checkPolicy(tpl))
+}
+
+func fatalIfPolicyErr(err error) {
+	problems, ok := err.(policyError)
+	if !ok {
+		return
+	}
+	for _, p := range problems {
+		log.Printf("ERROR: browsers would reject this certificate: %s", p)
+	}
+	log.Println(`Use "-allow-noncompliant" to issue it anyway 👈`)
+	os.Exit(exitPolicy)
+}
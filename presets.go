@@ -0,0 +1,194 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dbPreset describes the certificates and file layout a database server and
+// its clients expect for mutual TLS.
+type dbPreset struct {
+	name string
+
+	// File names, relative to the output directory. If serverKey or
+	// clientKey are empty, the key is appended to the certificate file.
+	serverCert, serverKey string
+	clientCert, clientKey string
+	caCert                string
+
+	// serverClientAuth is set for servers that connect to their replicas
+	// with the same certificate they serve.
+	serverClientAuth bool
+
+	// defaultUser is the client certificate Common Name, which these
+	// servers map to a database user.
+	defaultUser string
+
+	notes []string
+}
+
+var dbPresets = map[string]dbPreset{
+	"postgres": {
+		name:       "PostgreSQL",
+		serverCert: "server.crt", serverKey: "server.key",
+		clientCert: "postgresql.crt", clientKey: "postgresql.key",
+		caCert:      "root.crt",
+		defaultUser: "postgres",
+		notes: []string{
+			"In postgresql.conf: ssl = on, ssl_cert_file = 'server.crt', ssl_key_file = 'server.key', ssl_ca_file = 'root.crt'",
+			"The server key must be owned by the database user (or root) and not group or world readable.",
+			"Clients look for postgresql.crt, postgresql.key and root.crt in ~/.postgresql/ and can use sslmode=verify-full.",
+		},
+	},
+	"mysql": {
+		name:       "MySQL",
+		serverCert: "server-cert.pem", serverKey: "server-key.pem",
+		clientCert: "client-cert.pem", clientKey: "client-key.pem",
+		caCert:      "ca.pem",
+		defaultUser: "root",
+		notes: []string{
+			"In my.cnf under [mysqld]: ssl_ca = ca.pem, ssl_cert = server-cert.pem, ssl_key = server-key.pem",
+			"Connect with: mysql --ssl-mode=VERIFY_IDENTITY --ssl-ca=ca.pem --ssl-cert=client-cert.pem --ssl-key=client-key.pem",
+		},
+	},
+	"mongodb": {
+		name:       "MongoDB",
+		serverCert: "mongodb.pem",
+		clientCert: "client.pem",
+		caCert:     "ca.pem",
+		// Members of a replica set authenticate to each other with their
+		// server certificate.
+		serverClientAuth: true,
+		defaultUser:      "mkcert-client",
+		notes: []string{
+			"In mongod.conf: net.tls.mode: requireTLS, net.tls.certificateKeyFile: mongodb.pem, net.tls.CAFile: ca.pem",
+			"Connect with: mongosh --tls --tlsCAFile ca.pem --tlsCertificateKeyFile client.pem",
+			`For x.509 authentication, create the user in the "$external" database named after the client certificate subject.`,
+		},
+	},
+	"redis": {
+		name:       "Redis",
+		serverCert: "redis.crt", serverKey: "redis.key",
+		clientCert: "client.crt", clientKey: "client.key",
+		caCert: "ca.crt",
+		// Replicas connect to their primary with the server certificate.
+		serverClientAuth: true,
+		defaultUser:      "default",
+		notes: []string{
+			"In redis.conf: port 0, tls-port 6379, tls-cert-file redis.crt, tls-key-file redis.key, tls-ca-cert-file ca.crt",
+			"Connect with: redis-cli --tls --cacert ca.crt --cert client.crt --key client.key",
+		},
+	},
+}
+
+func presetNames() string {
+	var names []string
+	for name := range dbPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// makePresetCerts generates a server certificate for hosts and a client
+// certificate for user, laid out in a directory named after the preset.
+func (m *mkcert) makePresetCerts(presetName string, hosts []string) {
+	if m.caKey == nil {
+		fatalErr(errNoCAKey("create new certificates"))
+	}
+	p, ok := dbPresets[presetName]
+	if !ok {
+		log.Fatalf("ERROR: unknown preset %q, options are: %s", presetName, presetNames())
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	user := m.presetUser
+	if user == "" {
+		user = p.defaultUser
+	}
+
+	dir := filepath.Join(m.outDir, presetName)
+	fatalIfErr(os.MkdirAll(longPath(dir), 0755), "failed to create the output directory")
+
+	serverTpl := m.newLeafTemplate(hosts, m.keyType)
+	serverTpl.Subject.CommonName = hosts[0]
+	if p.serverClientAuth {
+		serverTpl.ExtKeyUsage = append(serverTpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	serverCert, serverKey := m.signLeaf(serverTpl, m.keyType)
+	m.writePresetPair(filepath.Join(dir, p.serverCert), p.serverKey, dir, m.chainPEM(serverCert), serverKey)
+
+	// The client subject must differ from the server one in the O/OU fields,
+	// or MongoDB will consider the client a cluster member.
+	clientTpl := m.newLeafTemplate(nil, m.keyType)
+	clientTpl.Subject.CommonName = user
+	clientTpl.Subject.OrganizationalUnit = []string{"mkcert development client"}
+	clientTpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	clientCert, clientKey := m.signLeaf(clientTpl, m.keyType)
+	m.writePresetPair(filepath.Join(dir, p.clientCert), p.clientKey, dir, m.chainPEM(clientCert), clientKey)
+
+	m.recordIssued(presetIssued(dir, p.serverCert, p.serverKey, hosts, serverTpl), serverCert)
+	m.recordIssued(presetIssued(dir, p.clientCert, p.clientKey, []string{user}, clientTpl), clientCert)
+
+	err := writeFile(filepath.Join(dir, p.caCert), pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw}), 0644)
+	fatalIfErr(err, "failed to save the CA certificate")
+
+	m.printHosts(hosts)
+	m.logf("\nThe %s certificates are in %q ✅", p.name, dir+string(filepath.Separator))
+	m.logf(" - server: %s", presetFiles(p.serverCert, p.serverKey))
+	m.logf(" - client (%q): %s", user, presetFiles(p.clientCert, p.clientKey))
+	m.logf(" - CA: %s\n\n", p.caCert)
+	for _, note := range p.notes {
+		m.logf("%s ℹ️", note)
+	}
+	m.logf("\nThey will expire on %s 🗓\n\n", serverTpl.NotAfter.Format("2 January 2006"))
+}
+
+func presetIssued(dir, cert, key string, names []string, tpl *x509.Certificate) issuedCert {
+	issued := issuedCert{Serial: serialString(tpl.SerialNumber), Names: names, CertFile: filepath.Join(dir, cert), NotAfter: tpl.NotAfter}
+	if key != "" {
+		issued.KeyFile = filepath.Join(dir, key)
+	}
+	return issued
+}
+
+func presetFiles(cert, key string) string {
+	if key == "" {
+		return cert + " (certificate and key)"
+	}
+	return cert + " and " + key
+}
+
+// writePresetPair saves the certificate at certFile and the key at keyName in
+// dir, or appended to the certificate if keyName is empty.
+func (m *mkcert) writePresetPair(certFile, keyName, dir string, certPEM []byte, priv crypto.PrivateKey) {
+	privPEM, err := m.marshalLeafKeyPEM(priv)
+	fatalIfErr(err, "failed to encode certificate key")
+	defer zero(privPEM)
+	defer zeroKey(priv)
+
+	if keyName == "" {
+		bundle := append(certPEM, privPEM...)
+		err = writeFile(certFile, bundle, 0600)
+		zero(bundle)
+		fatalIfErr(err, "failed to save certificate and key")
+		return
+	}
+	err = writeFiles(
+		outputFile{path: certFile, data: certPEM, perm: 0644},
+		outputFile{path: filepath.Join(dir, keyName), data: privPEM, perm: 0600},
+	)
+	fatalIfErr(err, "failed to save certificate and key")
+}
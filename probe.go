@@ -0,0 +1,132 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runProbe implements "mkcert probe [-sni NAME] [-alpn PROTOS] HOST:PORT",
+// which connects to a TLS server and reports whether the certificate it
+// presents was issued by the local CA, matches the name, and when it expires.
+// It exits with status 1 if the certificate wouldn't be trusted.
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	sni := fs.String("sni", "", "")
+	alpn := fs.String("alpn", "", "")
+	timeout := fs.Duration("timeout", 10*time.Second, "")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), `Usage: mkcert probe [-sni NAME] [-alpn h2,http/1.1] [-timeout 10s] HOST:PORT`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	addr := fs.Arg(0)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, addr = addr, net.JoinHostPort(addr, "443")
+	}
+	name := *sni
+	if name == "" {
+		name = host
+	}
+
+	config := &tls.Config{
+		// The chain is verified below against the local CA only.
+		InsecureSkipVerify: true,
+	}
+	if net.ParseIP(name) == nil {
+		config.ServerName = name
+	}
+	if *alpn != "" {
+		config.NextProtos = strings.Split(*alpn, ",")
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: *timeout}, "tcp", addr, config)
+	fatalIfErr(err, "failed to connect")
+	state := conn.ConnectionState()
+	conn.Close()
+
+	chain := state.PeerCertificates
+	if len(chain) == 0 {
+		log.Fatalln("ERROR: the server didn't present a certificate")
+	}
+	leaf := chain[0]
+
+	log.Printf("Connected to %s (SNI %q) 🔌", addr, config.ServerName)
+	if state.NegotiatedProtocol != "" {
+		log.Printf("Negotiated protocol: %s", state.NegotiatedProtocol)
+	}
+	log.Printf("The server presented %d certificate(s):", len(chain))
+	for _, c := range chain {
+		log.Printf(" - %s", c.Subject)
+	}
+	log.Printf("Names: %s", strings.Join(certNames(leaf), ", "))
+
+	ok := true
+	caCert := probeCA()
+	if caCert == nil {
+		ok = false
+		log.Print("❌ There is no local CA to check the certificate against")
+	} else {
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		intermediates := x509.NewCertPool()
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		if err != nil {
+			ok = false
+			log.Printf("❌ It was not issued by the local CA %q: %v", caCert.Subject.CommonName, err)
+		} else {
+			log.Printf("✅ It was issued by the local CA %q", caCert.Subject.CommonName)
+		}
+	}
+
+	if err := leaf.VerifyHostname(name); err != nil {
+		ok = false
+		log.Printf("❌ It is not valid for %q", name)
+	} else {
+		log.Printf("✅ It is valid for %q", name)
+	}
+
+	switch left := time.Until(leaf.NotAfter); {
+	case left < 0:
+		ok = false
+		log.Printf("❌ It expired on %s", leaf.NotAfter.Format("2 January 2006"))
+	case time.Now().Before(leaf.NotBefore):
+		ok = false
+		log.Printf("❌ It is only valid starting %s", leaf.NotBefore.Format("2 January 2006 15:04 MST"))
+	default:
+		log.Printf("✅ It expires on %s, in %d days", leaf.NotAfter.Format("2 January 2006"), int(left.Hours()/24))
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// probeCA returns the local CA certificate, or nil if there is none. Unlike
+// loadCA, it never creates one.
+func probeCA() *x509.Certificate {
+	caroot := getCAROOT()
+	if caroot == "" || !pathExists(filepath.Join(caroot, rootName)) {
+		return nil
+	}
+	m := &mkcert{CAROOT: canonicalPath(caroot)}
+	fatalIfErr(m.readCA(), "failed to read the local CA")
+	return m.caCert
+}
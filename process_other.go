@@ -0,0 +1,19 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "os/exec"
+
+// Process groups are not available on this platform, so only the command
+// itself is killed, and execRunner stops waiting for its output after
+// stopGrace in case its children keep it open.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func stopCommand(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
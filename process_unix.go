@@ -0,0 +1,41 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so that
+// stopCommand can also kill the processes it forks, which would otherwise
+// keep its output open. Commands run with sudo stay in the foreground group,
+// as sudo might need the terminal to ask for a password.
+func setProcessGroup(cmd *exec.Cmd) {
+	if isSudo(cmd) {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// stopCommand kills the started cmd and its process group. sudo is sent
+// SIGTERM instead, which it relays to the command it runs as another user.
+func stopCommand(cmd *exec.Cmd) {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return
+	}
+	if isSudo(cmd) {
+		cmd.Process.Signal(syscall.SIGTERM)
+		return
+	}
+	cmd.Process.Kill()
+}
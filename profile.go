@@ -0,0 +1,81 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// profilesDir is the subdirectory of the CAROOT holding the CAs of the named
+// profiles selected with -profile, each in its own directory.
+const profilesDir = "profiles"
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func checkProfileName(name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q, only letters, digits, '.', '_' and '-' are allowed", name)
+	}
+	return nil
+}
+
+// profileCAROOT returns the CAROOT of the named profile, or caroot itself for
+// the default profile.
+func profileCAROOT(caroot, name string) string {
+	if name == "" {
+		return caroot
+	}
+	return filepath.Join(caroot, profilesDir, name)
+}
+
+// listProfiles implements -profile-list, printing the default CA and the CA
+// of each named profile under caroot, with their expiration.
+func listProfiles(caroot string) {
+	dirs, _ := ioutil.ReadDir(longPath(filepath.Join(caroot, profilesDir)))
+	var names []string
+	for _, d := range dirs {
+		if d.IsDir() && checkProfileName(d.Name()) == nil {
+			names = append(names, d.Name())
+		}
+	}
+	sort.Strings(names)
+
+	printProfile := func(name, dir string) {
+		cert, err := readProfileCA(dir)
+		if err != nil {
+			log.Printf("%s\t(no CA: %v)", name, err)
+			return
+		}
+		log.Printf("%s\t%s\texpires %s", name, cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02"))
+	}
+	if pathExists(filepath.Join(caroot, rootName)) {
+		printProfile("(default)", caroot)
+	}
+	for _, name := range names {
+		printProfile(name, profileCAROOT(caroot, name))
+	}
+	if len(names) == 0 {
+		log.Printf("No profiles in %q; create one with \"mkcert -profile NAME -install\"", filepath.Join(caroot, profilesDir))
+	}
+}
+
+func readProfileCA(dir string) (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(longPath(filepath.Join(dir, rootName)))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s is not a PEM certificate", rootName)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// localSuffixes are reserved for testing, documentation, or private use, and
+// can't be registered, so names under them are always fine to issue for.
+var localSuffixes = []string{
+	"test", "localhost", "invalid", "example", // RFC 2606 and RFC 6761
+	"local",     // RFC 6762
+	"home.arpa", // RFC 8375
+	"internal",
+	"lan",
+	"example.com", "example.net", "example.org", // RFC 2606
+}
+
+// allowedSuffixes returns localSuffixes and the domains listed in the
+// comma-separated $MKCERT_ALLOWED_DOMAINS, for example those of the user's
+// organization.
+func allowedSuffixes() []string {
+	allowed := append([]string{}, localSuffixes...)
+	for _, d := range strings.Split(os.Getenv("MKCERT_ALLOWED_DOMAINS"), ",") {
+		if d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			allowed = append(allowed, d)
+		}
+	}
+	return allowed
+}
+
+// isPublicName reports whether hostname is under a real public suffix, like
+// google.com or foo.github.io, and not explicitly allowed. Single-label names
+// and names under unknown TLDs, like myapp.corp, are not public. Email
+// addresses are not checked, as S/MIME certificates for addresses like
+// user@gmail.com are an ordinary use of mkcert.
+func isPublicName(hostname string, allowed []string) bool {
+	hostname = strings.TrimPrefix(hostname, "*.")
+	if strings.Contains(hostname, "@") {
+		return false
+	}
+	if !strings.Contains(hostname, ".") || net.ParseIP(hostname) != nil {
+		return false
+	}
+	for _, suffix := range allowed {
+		if hostname == suffix || strings.HasSuffix(hostname, "."+suffix) {
+			return false
+		}
+	}
+	suffix, icann := publicsuffix.PublicSuffix(hostname)
+	// Unlisted TLDs match the default "*" rule, which is not ICANN managed,
+	// while the private section of the list has multi-label suffixes.
+	return icann || strings.Contains(suffix, ".")
+}
+
+// publicNames returns the hosts that are public names. A locally trusted CA
+// that mints real-looking certificates for domains the user doesn't control
+// deserves a guardrail.
+func publicNames(hosts []string) []string {
+	allowed := allowedSuffixes()
+	var public []string
+	for _, h := range hosts {
+		if isPublicName(h, allowed) {
+			public = append(public, h)
+		}
+	}
+	return public
+}
+
+// checkPublicNames exits if any of hosts is a public name, unless
+// -allow-public is set, in which case it only warns.
+func (m *mkcert) checkPublicNames(hosts []string) {
+	public := publicNames(hosts)
+	if len(public) == 0 {
+		return
+	}
+	if !m.allowPublic {
+		for _, h := range public {
+			log.Printf("ERROR: %q is a public domain name, which you might not control", h)
+		}
+		log.Println(`Use "-allow-public", or add your domains to $MKCERT_ALLOWED_DOMAINS, to issue it anyway 👈`)
+		os.Exit(exitInvalidName)
+	}
+	m.warnPublicNames(public)
+}
+
+func (m *mkcert) warnPublicNames(public []string) {
+	for _, h := range public {
+		m.warn(WarningHostname, "", "Warning: %q is a public domain name, only use this certificate for domains you control ⚠️", h)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestIsPublicName(t *testing.T) {
+	tests := []struct {
+		name   string
+		public bool
+	}{
+		{"google.com", true},
+		{"*.google.com", true},
+		{"foo.github.io", true},
+		{"localhost", false},
+		{"myapp.test", false},
+		{"myapp.corp", false},
+		{"127.0.0.1", false},
+		{"user@gmail.com", false},
+		{"user@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicName(tt.name, localSuffixes); got != tt.public {
+			t.Errorf("isPublicName(%q) = %v, want %v", tt.name, got, tt.public)
+		}
+	}
+}
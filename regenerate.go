@@ -0,0 +1,225 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pemFile is a certificate or key file found by regenerate.
+type pemFile struct {
+	path  string
+	cert  *x509.Certificate
+	key   crypto.PrivateKey
+	perm  os.FileMode
+	other bool // has other PEM blocks, which would be lost
+}
+
+// regenerate re-issues with the current CA every mkcert certificate found in
+// paths (files, or directories walked recursively), keeping the file layout,
+// names, key type and extended key usages. Copies of a previous local CA
+// certificate, like the ones written by -preset, are updated too.
+func (m *mkcert) regenerate(paths []string) {
+	if m.caKey == nil {
+		fatalErr(errNoCAKey("create new certificates"))
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var files []*pemFile
+	for _, path := range paths {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if samePath(path, m.CAROOT) || (strings.HasPrefix(info.Name(), ".") && info.Name() != ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch filepath.Ext(path) {
+			case ".pem", ".crt", ".key":
+				if f := m.readPEMFile(path, info); f != nil {
+					files = append(files, f)
+				}
+			}
+			return nil
+		})
+		fatalIfErr(err, "failed to walk "+path)
+	}
+
+	keys := make(map[string]*pemFile)
+	for _, f := range files {
+		if f.key == nil {
+			continue
+		}
+		if spki, err := x509.MarshalPKIXPublicKey(f.key.(crypto.Signer).Public()); err == nil {
+			keys[string(spki)] = f
+		}
+	}
+
+	isLeaf := m.mkcertLeafChecker()
+	var replaced int
+	for _, f := range files {
+		switch {
+		case f.cert == nil:
+			continue
+		case f.cert.IsCA && isMkcertCA(f.cert) && bytes.Equal(f.cert.RawIssuer, f.cert.RawSubject):
+			if bytes.Equal(f.cert.Raw, m.caCert.Raw) || f.other || f.key != nil {
+				continue
+			}
+			err := writeFile(f.path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw}), f.perm)
+			fatalIfErr(err, "failed to save the CA certificate")
+			m.logf(" - %q (CA certificate)", f.path)
+			replaced++
+		case isLeaf(f.cert):
+			if m.issuedByLocalCA(f.cert) {
+				continue // already issued by the current CA
+			}
+			key := keys[string(f.cert.RawSubjectPublicKeyInfo)]
+			if key == nil {
+				m.logf("Skipping %q, as its key was not found 🤷", f.path)
+				continue
+			}
+			if f.other || (key != f && key.other) {
+				m.logf("Skipping %q, as it contains other data that would be lost 🤷", f.path)
+				continue
+			}
+			m.reissue(f, key)
+			replaced++
+		}
+	}
+
+	if replaced == 0 {
+		m.logln("No certificates needed to be regenerated 👍")
+		return
+	}
+	m.logf("\nThe files above were regenerated with the current local CA ✅\n\n")
+}
+
+// reissue replaces the certificate in f, and its key in key, which can be the
+// same file, with new ones for the same names.
+func (m *mkcert) reissue(f, key *pemFile) {
+	old := f.cert
+	kt := keyTypeOf(old.PublicKey)
+	tpl := m.newLeafTemplate(certNames(old), kt)
+	tpl.Subject = old.Subject
+	tpl.ExtKeyUsage = old.ExtKeyUsage
+
+	cert, priv := m.signLeaf(tpl, kt)
+	defer zeroKey(priv)
+	certPEM := m.chainPEM(cert)
+	privPEM, err := m.marshalLeafKeyPEM(priv)
+	fatalIfErr(err, "failed to encode certificate key")
+	defer zero(privPEM)
+
+	if key == f {
+		bundle := append(certPEM, privPEM...)
+		err = writeFile(f.path, bundle, f.perm)
+		zero(bundle)
+		fatalIfErr(err, "failed to save certificate and key")
+		m.recordIssued(issuedCert{Serial: serialString(tpl.SerialNumber), Names: certNames(old), CertFile: f.path, KeyFile: f.path, NotAfter: tpl.NotAfter}, cert)
+		m.logf(" - %q (certificate and key)", f.path)
+		return
+	}
+	err = writeFiles(
+		outputFile{path: f.path, data: certPEM, perm: f.perm},
+		outputFile{path: key.path, data: privPEM, perm: key.perm},
+	)
+	fatalIfErr(err, "failed to save certificate and key")
+	m.recordIssued(issuedCert{Serial: serialString(tpl.SerialNumber), Names: certNames(old), CertFile: f.path, KeyFile: key.path, NotAfter: tpl.NotAfter}, cert)
+	m.logf(" - %q and %q", f.path, key.path)
+}
+
+// readPEMFile parses the first certificate and private key in path, or
+// returns nil if there are none.
+func (m *mkcert) readPEMFile(path string, info os.FileInfo) *pemFile {
+	data, err := ioutil.ReadFile(longPath(path))
+	if err != nil {
+		return nil
+	}
+	f := &pemFile{path: path, perm: info.Mode().Perm()}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE" && f.cert == nil:
+			f.cert, _ = x509.ParseCertificate(block.Bytes)
+		case block.Type == "CERTIFICATE" && isMkcertCABlock(block.Bytes):
+			// The intermediate CA following a leaf, which reissue rewrites.
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && f.key == nil:
+			f.key, _ = m.parseKeyBlock(block)
+			zero(block.Bytes)
+		default:
+			f.other = true
+		}
+	}
+	if f.cert == nil && f.key == nil {
+		return nil
+	}
+	return f
+}
+
+// mkcertLeafChecker returns a function that reports whether a certificate is
+// a leaf issued by mkcert: by any mkcert CA, including one since replaced, by
+// the current or a previous local CA in the CAROOT, or recorded in the
+// issuance index. The subject of the leaf is not used, as -subject changes it.
+func (m *mkcert) mkcertLeafChecker() func(*x509.Certificate) bool {
+	var previous []*x509.Certificate
+	dirs, _ := filepath.Glob(filepath.Join(globEscape(m.CAROOT), "previous-*"))
+	for _, dir := range dirs {
+		for _, name := range []string{rootName, intermediateName} {
+			if chain, err := readCertChain(filepath.Join(dir, name)); err == nil {
+				previous = append(previous, chain[0])
+			}
+		}
+	}
+	serials := make(map[string]bool)
+	entries, _ := m.readIndex()
+	for _, e := range entries {
+		serials[e.Serial] = true
+	}
+
+	return func(cert *x509.Certificate) bool {
+		if cert.IsCA {
+			return false
+		}
+		if isMkcertCAName(cert.Issuer) || m.issuedByLocalCA(cert) || serials[serialString(cert.SerialNumber)] {
+			return true
+		}
+		for _, ca := range previous {
+			if cert.CheckSignatureFrom(ca) == nil {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func isMkcertCABlock(der []byte) bool {
+	cert, err := x509.ParseCertificate(der)
+	return err == nil && cert.IsCA && isMkcertCA(cert)
+}
+
+func isMkcertCA(cert *x509.Certificate) bool {
+	return isMkcertCAName(cert.Subject)
+}
+
+func isMkcertCAName(name pkix.Name) bool {
+	return len(name.Organization) == 1 && name.Organization[0] == "mkcert development CA"
+}
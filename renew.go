@@ -0,0 +1,192 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultRenewWithin is how close to expiration a certificate must be for
+// -renew to re-issue it, unless -renew-within is set.
+const defaultRenewWithin = 30 * 24 * time.Hour
+
+// Renew re-issues the mkcert certificate at certPath with the current CA, for
+// the same names and public key, if it expires within the -renew-within
+// threshold or was not issued by the current CA. The private key is not
+// needed, and any other PEM blocks in the file, like the key of a bundle,
+// are preserved. It reports whether the certificate was renewed.
+func (m *mkcert) Renew(certPath string) (renewed bool, err error) {
+	_, renewed, err = m.renew(certPath)
+	return renewed, err
+}
+
+// renew implements Renew, and also returns the certificate now in certPath,
+// renewed or not.
+func (m *mkcert) renew(certPath string) (cert *x509.Certificate, renewed bool, err error) {
+	if m.caKey == nil {
+		return nil, false, errNoCAKey("create new certificates")
+	}
+	info, err := os.Stat(longPath(certPath))
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := ioutil.ReadFile(longPath(certPath))
+	if err != nil {
+		return nil, false, err
+	}
+	defer zero(data)
+
+	// Keep everything but the certificates, which are replaced by the new
+	// chain, in their original order.
+	var old *x509.Certificate
+	var rest []byte
+	for data := data; ; {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			if old == nil {
+				if old, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, false, fmt.Errorf("failed to parse the certificate in %q: %v", certPath, err)
+				}
+			}
+			continue
+		}
+		rest = append(rest, pem.EncodeToMemory(block)...)
+		zero(block.Bytes)
+	}
+	defer zero(rest)
+	if old == nil {
+		return nil, false, fmt.Errorf("no certificate found in %q", certPath)
+	}
+	if !m.mkcertLeafChecker()(old) {
+		return nil, false, fmt.Errorf("the certificate in %q was not issued by mkcert", certPath)
+	}
+
+	within := m.renewWithin
+	if within == 0 {
+		within = defaultRenewWithin
+	}
+	if time.Until(old.NotAfter) > within && m.issuedByLocalCA(old) {
+		return old, false, nil
+	}
+
+	tpl := certTemplate(old)
+	tpl.SerialNumber = randomSerialNumber()
+	tpl.Subject, tpl.KeyUsage = old.Subject, old.KeyUsage
+	tpl.NotBefore, tpl.NotAfter = m.leafValidity()
+	_, issuerKey := m.issuer()
+	tpl.SignatureAlgorithm = m.signatureAlgorithm(issuerKey)
+	if err := m.checkPolicy(tpl); err != nil {
+		return nil, false, err
+	}
+	der, err := m.issueLeaf(tpl, old.PublicKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to generate certificate: %v", err)
+	}
+
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, false, fmt.Errorf("failed to parse the new certificate: %v", err)
+	}
+	out := append(m.chainPEM(der), rest...)
+	defer zero(out)
+	if err := writeFile(certPath, out, info.Mode().Perm()); err != nil {
+		return nil, false, fmt.Errorf("failed to save certificate: %v", err)
+	}
+	return cert, true, nil
+}
+
+// renewFiles implements -renew, calling renew for each of paths. It returns
+// an error if any of them failed to renew.
+func (m *mkcert) renewFiles(paths []string) error {
+	if len(paths) == 0 {
+		log.Fatalln("ERROR: -renew requires the certificate files to renew as arguments")
+	}
+	var failed int
+	for _, path := range paths {
+		cert, renewed, err := m.renew(path)
+		switch {
+		case err != nil:
+			failed++
+			log.Printf("ERROR: failed to renew %q: %s", path, err)
+		case renewed:
+			m.recordIssued(issuedCert{Serial: serialString(cert.SerialNumber), Names: certNames(cert), CertFile: path, NotAfter: cert.NotAfter}, cert.Raw)
+			m.logf(" - %q was renewed, and now expires on %s ✅", path, cert.NotAfter.Format("2 January 2006"))
+		default:
+			m.logf(" - %q doesn't need renewal, it expires on %s", path, cert.NotAfter.Format("2 January 2006"))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d certificates failed to renew", failed, len(paths))
+	}
+	return nil
+}
+
+// checkFiles implements -check, printing the expiration and names of the
+// certificate in each of paths, and whether it chains to the current local
+// CA. It returns an error if any certificate is expired or untrusted.
+func (m *mkcert) checkFiles(paths []string) error {
+	if len(paths) == 0 {
+		log.Fatalln("ERROR: -check requires the certificate files to check as arguments")
+	}
+	var failed int
+	for _, path := range paths {
+		chain, err := readCertChain(path)
+		if err != nil {
+			failed++
+			m.logf("❌ %q: %s\n\n", path, err)
+			continue
+		}
+		leaf := chain[0]
+		m.logf("%q:", path)
+		m.logf("   Names: %s", strings.Join(certNames(leaf), ", "))
+
+		ok := true
+		switch left := time.Until(leaf.NotAfter); {
+		case left < 0:
+			ok = false
+			m.logf("❌ It expired on %s", leaf.NotAfter.Format("2 January 2006"))
+		default:
+			m.logf("✅ It expires on %s, in %d days", leaf.NotAfter.Format("2 January 2006"), int(left.Hours()/24))
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(m.caCert)
+		intermediates := x509.NewCertPool()
+		if m.intCert != nil {
+			intermediates.AddCert(m.intCert)
+		}
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots: roots, Intermediates: intermediates,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			ok = false
+			m.logf("❌ It doesn't chain to the current local CA: %s", err)
+		} else {
+			m.logf("✅ It chains to the current local CA")
+		}
+		if !ok {
+			failed++
+		}
+		m.logln("")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d certificates are unreadable, expired or untrusted", failed, len(paths))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const rotationName = "rotation.json"
+
+// defaultRotateGrace is how long the previous CA stays installed after
+// -rotate-ca, unless -rotate-grace is set.
+const defaultRotateGrace = 30 * 24 * time.Hour
+
+// A rotation is a CA rotation in progress, started by -rotate-ca and
+// recorded in the CAROOT until the previous CA is removed.
+type rotation struct {
+	// Previous is the directory the previous CA was moved to.
+	Previous    string    `json:"previous"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishAfter time.Time `json:"finish_after"`
+}
+
+// readRotation returns the CA rotation in progress, or nil if there is none.
+func (m *mkcert) readRotation() (*rotation, error) {
+	path := filepath.Join(m.CAROOT, rotationName)
+	data, err := ioutil.ReadFile(longPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &rotation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("the CA rotation state %q is corrupted: %v", path, err)
+	}
+	return r, nil
+}
+
+// startRotation implements the first half of -rotate-ca, moving the current
+// CA aside like -renew-ca and recording it, so that it stays installed until
+// the rotation is finished. It must be called with the CAROOT locked, before
+// loadCA creates the new CA.
+func (m *mkcert) startRotation() {
+	r, err := m.readRotation()
+	fatalIfErr(err, "failed to read the CA rotation state")
+	if r != nil {
+		log.Fatalf("ERROR: a CA rotation is already in progress since %s; run \"mkcert -rotate-finish\" to complete it first",
+			r.StartedAt.Format("2 January 2006"))
+	}
+	if !pathExists(filepath.Join(m.CAROOT, rootName)) {
+		fatalErr(errorf(ErrNoCA, "there is no local CA at %q to rotate; run \"mkcert -install\" to create one", m.CAROOT))
+	}
+
+	grace := m.rotateGrace
+	if grace == 0 {
+		grace = defaultRotateGrace
+	}
+	now := time.Now()
+	r = &rotation{Previous: m.moveCA(), StartedAt: now, FinishAfter: now.Add(grace)}
+	data, err := json.MarshalIndent(r, "", "\t")
+	fatalIfErr(err, "failed to encode the CA rotation state")
+	fatalIfErr(writeFile(filepath.Join(m.CAROOT, rotationName), data, 0644), "failed to save the CA rotation state")
+}
+
+// reissueTracked implements the second half of -rotate-ca, renewing with the
+// new CA every unexpired, unrevoked certificate in the issuance index whose
+// file is still where it was saved.
+func (m *mkcert) reissueTracked() {
+	entries, err := m.readIndex()
+	fatalIfErr(err, "failed to read the issuance index")
+
+	seen := make(map[string]bool)
+	var renewed, skipped, failed int
+	for _, e := range entries {
+		if e.Path == "" || seen[e.Path] || e.RevokedAt != nil || time.Now().After(e.NotAfter) {
+			continue
+		}
+		seen[e.Path] = true
+		if !pathExists(e.Path) {
+			continue
+		}
+		if ext := strings.ToLower(filepath.Ext(e.Path)); ext == ".p12" || ext == ".pfx" {
+			m.logf("Skipping %q, as PKCS #12 files can't be re-issued without their key 🤷", e.Path)
+			skipped++
+			continue
+		}
+		cert, ok, err := m.renew(e.Path)
+		switch {
+		case err != nil:
+			failed++
+			log.Printf("ERROR: failed to re-issue %q: %s", e.Path, err)
+		case ok:
+			renewed++
+			m.recordIssued(issuedCert{Serial: serialString(cert.SerialNumber), Names: certNames(cert), CertFile: e.Path, NotAfter: cert.NotAfter}, cert.Raw)
+			m.logf(" - %q", e.Path)
+		}
+	}
+	if renewed > 0 {
+		m.logln("The certificates above were re-issued with the new local CA ✅")
+	} else if failed == 0 && skipped == 0 {
+		m.logln("No tracked certificates needed to be re-issued 👍")
+	}
+	if failed > 0 || skipped > 0 {
+		m.logln("Re-issue the other certificates with \"mkcert regenerate\" or by hand 👈")
+	}
+	m.logln("")
+
+	r, err := m.readRotation()
+	fatalIfErr(err, "failed to read the CA rotation state")
+	m.logf("The previous local CA stays installed until %s, so that certificates not yet replaced keep working ⏳", r.FinishAfter.Format("2 January 2006"))
+	m.logln("Run \"mkcert -rotate-finish\" to remove it earlier 👈")
+	m.logln("")
+}
+
+// finishRotation uninstalls the previous CA of the rotation in progress from
+// the trust stores and deletes it. If due is set, it only does so once the
+// grace period is over, and otherwise does nothing.
+func (m *mkcert) finishRotation(due bool) {
+	r, err := m.readRotation()
+	fatalIfErr(err, "failed to read the CA rotation state")
+	if r == nil {
+		if !due {
+			log.Fatalln("ERROR: there is no CA rotation in progress; start one with \"mkcert -rotate-ca\"")
+		}
+		return
+	}
+	if due {
+		if time.Now().Before(r.FinishAfter) {
+			return
+		}
+		m.logf("The grace period of the CA rotation started on %s is over, removing the previous local CA 🔄", r.StartedAt.Format("2 January 2006"))
+	}
+
+	prev := &mkcert{CAROOT: r.Previous, uninstallMode: true, userOnly: m.userOnly,
+		nssProfile: m.nssProfile, nssNative: m.nssNative, Logger: m.Logger, ctx: m.ctx}
+	if err := prev.readCA(); err != nil {
+		m.logf("Skipping the uninstallation of the previous local CA: %s 🤷", err)
+	} else {
+		prev.uninstall()
+		m.warningsMu.Lock()
+		m.warnings = append(m.warnings, prev.takeWarnings()...)
+		m.warningsMu.Unlock()
+	}
+
+	// Only delete what -rotate-ca moved aside, even if the state was edited.
+	if samePath(filepath.Dir(r.Previous), m.CAROOT) {
+		fatalIfErr(os.RemoveAll(longPath(r.Previous)), "failed to delete the previous local CA")
+	}
+	fatalIfErr(os.Remove(longPath(filepath.Join(m.CAROOT, rotationName))), "failed to remove the CA rotation state")
+	m.logf("The previous local CA at %q was removed, completing the CA rotation ✅", r.Previous)
+	m.logln("")
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+)
+
+// Private keys, and especially the CA key, are overwritten as soon as they
+// are not needed anymore, to reduce the chance of them ending up in core
+// dumps or swap. This is best effort, as the garbage collector and the
+// standard library might have made copies along the way.
+
+// zero overwrites b with zeroes.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func zeroBig(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+// zeroKey overwrites the private parts of key, which can't be used afterwards.
+func zeroKey(key crypto.PrivateKey) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		zeroBig(k.D)
+		for _, p := range k.Primes {
+			zeroBig(p)
+		}
+		zeroBig(k.Precomputed.Dp)
+		zeroBig(k.Precomputed.Dq)
+		zeroBig(k.Precomputed.Qinv)
+		for _, crt := range k.Precomputed.CRTValues {
+			zeroBig(crt.Exp)
+			zeroBig(crt.Coeff)
+			zeroBig(crt.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroBig(k.D)
+	case ed25519.PrivateKey:
+		zero(k)
+	}
+}
+
+// marshalKeyPEM returns the PEM encoded PKCS #8 form of key. The caller
+// should zero the result once it's written out.
+func marshalKeyPEM(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(der)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// serveTokenName is the file in the CAROOT holding the token that
+	// clients of -serve must send, unless it's set with serveTokenEnv.
+	serveTokenName = "serve-token"
+	serveTokenEnv  = "MKCERT_SERVE_TOKEN"
+
+	maxServeRequest = 64 << 10
+	maxServeNames   = 100
+)
+
+// serveUntilCanceled runs srv on l, or on srv.Addr if l is nil, until it
+// fails or the RunContext context is canceled, in which case it returns nil.
+func (m *mkcert) serveUntilCanceled(srv *http.Server, l net.Listener) error {
+	ctx := m.context()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-stopped:
+		}
+	}()
+	var err error
+	if l != nil {
+		err = srv.Serve(l)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// listenServe listens on a -serve address, either "unix://PATH" for a Unix
+// socket only accessible to the current user, or "tcp://HOST:PORT".
+func listenServe(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		// Remove a socket left behind by a previous run, but nothing else.
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	}
+	return nil, fmt.Errorf("invalid -serve address %q, expected unix://PATH or tcp://HOST:PORT", addr)
+}
+
+// serveToken returns the token from $MKCERT_SERVE_TOKEN, or from the token
+// file in the CAROOT, which is generated if missing.
+func (m *mkcert) serveToken() (token, path string) {
+	if token := os.Getenv(serveTokenEnv); token != "" {
+		return token, ""
+	}
+	path = filepath.Join(m.CAROOT, serveTokenName)
+	if data, err := ioutil.ReadFile(longPath(path)); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), path
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	fatalIfErr(err, "failed to generate the token")
+	token = hex.EncodeToString(b)
+	fatalIfErr(writeFile(path, []byte(token+"\n"), 0600), "failed to save the token")
+	return token, path
+}
+
+// serveAPI implements -serve, a local HTTP API for other tools to request
+// certificates from the local CA without access to its key:
+//
+//	POST /issue {"names": ["example.test"]}  returns the key and certificate chain as PEM
+//	GET /ca                                  returns the CA certificate as PEM
+//
+// Requests must carry the token as "Authorization: Bearer TOKEN".
+func (m *mkcert) serveAPI(addr string) {
+	if m.caKey == nil {
+		fatalErr(errNoCAKey("create new certificates"))
+	}
+	l, err := listenServe(addr)
+	fatalIfErr(err, "failed to listen")
+	token, tokenPath := m.serveToken()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/issue", m.handleIssue)
+	mux.HandleFunc("/ca", m.handleCA)
+	auth := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+
+	m.logf("The certificate API is at %s 🔌", addr)
+	if tokenPath != "" {
+		m.logf("Clients must send the token in %q as \"Authorization: Bearer TOKEN\" ℹ️\n\n", tokenPath)
+	} else {
+		m.logf("Clients must send the token in $%s as \"Authorization: Bearer TOKEN\" ℹ️\n\n", serveTokenEnv)
+	}
+	fatalIfErr(m.serveUntilCanceled(&http.Server{Handler: auth}, l), "failed to serve")
+}
+
+func (m *mkcert) handleIssue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Names []string `json:"names"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxServeRequest)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Names) > maxServeNames {
+		http.Error(w, fmt.Sprintf("too many names, the limit is %d", maxServeNames), http.StatusBadRequest)
+		return
+	}
+	certPEM, keyPEM, err := m.CreateCert(r.Context(), req.Names...)
+	// The API runs indefinitely, so don't accumulate the warnings of Run.
+	m.takeWarnings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer zero(keyPEM)
+	m.logf("Issued a certificate for %s", strings.Join(req.Names, ", "))
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(keyPEM)
+	w.Write(certPEM)
+}
+
+func (m *mkcert) handleCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw}))
+}
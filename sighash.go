@@ -0,0 +1,63 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"sort"
+	"strings"
+)
+
+// signatureHashes are the digests that can be selected with -sig-hash.
+var signatureHashes = map[string]crypto.Hash{
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+func signatureHashNames() string {
+	var names []string
+	for name := range signatureHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// signatureAlgorithm returns the algorithm to sign with key using the digest
+// selected with -sig-hash, or UnknownSignatureAlgorithm to let crypto/x509
+// pick its default, which is SHA-256 for RSA and P-256 keys. The key type is
+// taken from the public key, so that it works for PKCS #11 keys too.
+func (m *mkcert) signatureAlgorithm(key crypto.PrivateKey) x509.SignatureAlgorithm {
+	h, ok := signatureHashes[m.sigHash]
+	signer, isSigner := key.(crypto.Signer)
+	if !ok || !isSigner {
+		return x509.UnknownSignatureAlgorithm
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		switch h {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA
+		case crypto.SHA384:
+			return x509.SHA384WithRSA
+		case crypto.SHA512:
+			return x509.SHA512WithRSA
+		}
+	case *ecdsa.PublicKey:
+		switch h {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512
+		}
+	}
+	return x509.UnknownSignatureAlgorithm
+}
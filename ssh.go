@@ -0,0 +1,226 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSH CA is separate from the X.509 one, as OpenSSH doesn't use X.509.
+// Its key is PKCS #8 PEM encoded, like the other keys in the CAROOT, and its
+// public key is in authorized_keys format, ready to be copied to servers.
+const (
+	sshCAKeyName = "ssh-ca-key.pem"
+	sshCAPubName = "ssh-ca.pub"
+)
+
+// Default validities of the SSH certificates. User certificates are meant to
+// be minted whenever needed, while host certificates are installed on servers.
+const (
+	sshUserValidity = 24 * time.Hour
+	sshHostValidity = 30 * 24 * time.Hour
+)
+
+// sshClockSkew is how far in the past SSH certificates start being valid, to
+// tolerate servers with a slightly different clock.
+const sshClockSkew = 5 * time.Minute
+
+// loadSSHCA loads the SSH CA from the CAROOT, creating it if it doesn't
+// exist yet.
+func (m *mkcert) loadSSHCA() ssh.Signer {
+	keyPath := filepath.Join(m.CAROOT, sshCAKeyName)
+	if !pathExists(keyPath) {
+		unlock := m.lockCAROOT()
+		if !pathExists(keyPath) {
+			m.newSSHCA()
+		}
+		unlock()
+	}
+	keyPEM, err := ioutil.ReadFile(longPath(keyPath))
+	fatalIfErr(err, "failed to read the SSH CA key")
+	defer zero(keyPEM)
+	key, err := ssh.ParseRawPrivateKey(keyPEM)
+	fatalIfErr(err, "failed to parse the SSH CA key")
+	signer, err := ssh.NewSignerFromKey(key)
+	fatalIfErr(err, "failed to load the SSH CA key")
+	return signer
+}
+
+func (m *mkcert) newSSHCA() {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	fatalIfErr(err, "failed to generate the SSH CA key")
+	defer zeroKey(priv)
+	sshPub, err := ssh.NewPublicKey(pub)
+	fatalIfErr(err, "failed to encode the SSH CA public key")
+	privPEM, err := marshalKeyPEM(priv)
+	fatalIfErr(err, "failed to encode the SSH CA key")
+	defer zero(privPEM)
+
+	comment := "mkcert SSH CA " + userAndHostname
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment + "\n"
+	err = writeFiles(
+		outputFile{path: filepath.Join(m.CAROOT, sshCAKeyName), data: privPEM, perm: 0400},
+		outputFile{path: filepath.Join(m.CAROOT, sshCAPubName), data: []byte(authorizedKey), perm: 0644},
+	)
+	fatalIfErr(err, "failed to save the SSH CA")
+
+	m.logf("Created a new SSH CA 💥\n")
+}
+
+// makeSSHCert implements -ssh. Names with an "@", like "alice@dev.test",
+// request a user certificate for the user before the "@", and other names
+// a host certificate. All names must be of the same kind.
+func (m *mkcert) makeSSHCert(names []string) {
+	ca := m.loadSSHCA()
+	if len(names) == 0 {
+		m.printSSHTrust(ca)
+		return
+	}
+
+	certType := uint32(ssh.HostCert)
+	if strings.Contains(names[0], "@") {
+		certType = ssh.UserCert
+	}
+	var principals []string
+	for _, name := range names {
+		if strings.Contains(name, "@") != (certType == ssh.UserCert) {
+			log.Fatalln("ERROR: can't mix users (user@host) and hosts in the same SSH certificate")
+		}
+		principal := name
+		if certType == ssh.UserCert {
+			principal = name[:strings.Index(name, "@")]
+			if principal == "" || strings.ContainsAny(principal, " ,\t") {
+				fatalErr(errorf(ErrInvalidHostname, "%q is not a valid SSH user", name))
+			}
+		} else {
+			normalized, _, err := m.normalizeName(name)
+			if err != nil {
+				fatalErr(err)
+			}
+			principal = normalized
+		}
+		principals = appendNames(principals, principal)
+	}
+
+	var pub ssh.PublicKey
+	var keyFile, certFile string
+	if m.sshPubKey != "" {
+		data, err := ioutil.ReadFile(longPath(m.sshPubKey))
+		fatalIfErr(err, "failed to read the SSH public key")
+		pub, _, _, _, err = ssh.ParseAuthorizedKey(data)
+		fatalIfErr(err, "failed to parse the SSH public key")
+		// ssh picks up the certificate automatically with this name.
+		certFile = strings.TrimSuffix(m.sshPubKey, ".pub") + "-cert.pub"
+	} else {
+		base := m.safeFileName(names[0])
+		if len(names) > 1 {
+			base += "+" + strconv.Itoa(len(names)-1)
+		}
+		base = m.outPath(base + "-ssh")
+		m.makeParentDir(base)
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		fatalIfErr(err, "failed to generate the SSH key")
+		defer zeroKey(priv)
+		der, err := x509.MarshalECPrivateKey(priv)
+		fatalIfErr(err, "failed to encode the SSH key")
+		defer zero(der)
+		pub, err = ssh.NewPublicKey(priv.Public())
+		fatalIfErr(err, "failed to encode the SSH public key")
+		keyFile, certFile = base, base+"-cert.pub"
+		err = writeFiles(
+			outputFile{path: keyFile, data: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), perm: 0600},
+			outputFile{path: keyFile + ".pub", data: ssh.MarshalAuthorizedKey(pub), perm: 0644},
+		)
+		fatalIfErr(err, "failed to save the SSH key")
+	}
+
+	validity := sshHostValidity
+	if certType == ssh.UserCert {
+		validity = sshUserValidity
+	}
+	now := time.Now()
+	validBefore := now.Add(validity)
+	switch {
+	case !m.notAfter.IsZero():
+		validBefore = m.notAfter
+	case m.validFor != 0:
+		validBefore = now.Add(m.validFor)
+	}
+
+	var serial [8]byte
+	_, err := rand.Read(serial[:])
+	fatalIfErr(err, "failed to generate serial number")
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        certType,
+		KeyId:           "mkcert " + strings.Join(names, ",") + " " + userAndHostname,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-sshClockSkew).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if certType == ssh.UserCert {
+		// The same defaults as ssh-keygen.
+		cert.Permissions.Extensions = map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}
+	}
+	fatalIfErr(cert.SignCert(rand.Reader, ca), "failed to sign the SSH certificate")
+	fatalIfErr(writeFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644), "failed to save the SSH certificate")
+
+	kind := "host"
+	if certType == ssh.UserCert {
+		kind = "user"
+	}
+	m.logf("\nCreated a new SSH %s certificate valid for the following principals 📜", kind)
+	for _, p := range principals {
+		m.logf(" - %q", p)
+	}
+	if keyFile != "" {
+		m.logf("\nThe certificate is at \"%s\" and the key at \"%s\" ✅\n", certFile, keyFile)
+	} else {
+		m.logf("\nThe certificate is at \"%s\" ✅\n", certFile)
+	}
+	m.logf("It will expire on %s 🗓\n", validBefore.Format("2 January 2006 15:04 MST"))
+
+	if certType == ssh.UserCert && keyFile != "" {
+		m.logf("Use it with \"ssh -i %s %s\" 👈\n", keyFile, names[0])
+	} else if certType == ssh.HostCert && keyFile != "" {
+		m.logf("Install the key and certificate on the server, and add to its sshd_config 👈\n")
+		m.logf("\tHostKey /etc/ssh/%s\n\tHostCertificate /etc/ssh/%s\n", filepath.Base(keyFile), filepath.Base(certFile))
+	}
+	m.printSSHTrust(ca)
+}
+
+// printSSHTrust prints the configuration lines that make servers trust the
+// user certificates, and clients trust the host certificates, of the SSH CA.
+func (m *mkcert) printSSHTrust(ca ssh.Signer) {
+	pubPath := filepath.Join(m.CAROOT, sshCAPubName)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey())))
+	m.logf("The SSH CA public key is at \"%s\" ℹ️\n", pubPath)
+	m.logf("For servers to accept the user certificates, copy it to /etc/ssh/mkcert-ssh-ca.pub and add to sshd_config:\n")
+	m.logf("\tTrustedUserCAKeys /etc/ssh/mkcert-ssh-ca.pub\n\n")
+	m.logf("For clients to accept the host certificates, add to ~/.ssh/known_hosts:\n")
+	m.logf("\t@cert-authority * %s mkcert SSH CA\n\n", authorizedKey)
+}
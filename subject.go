@@ -0,0 +1,93 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parseSubject parses a distinguished name in the OpenSSL -subj format, like
+// "/O=Acme/OU=Dev/CN=myservice", where the leading slash is optional and a
+// backslash escapes the next character. Attributes can be repeated.
+func parseSubject(s string) (pkix.Name, error) {
+	var name pkix.Name
+	var parts []string
+	var cur strings.Builder
+	escaped := false
+	for _, r := range strings.TrimPrefix(s, "/") {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '/':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	parts = append(parts, cur.String())
+
+	for _, part := range parts {
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return pkix.Name{}, fmt.Errorf("%q is not an ATTRIBUTE=VALUE pair", part)
+		}
+		attr, value := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		if value == "" {
+			return pkix.Name{}, fmt.Errorf("the value of %s is empty", attr)
+		}
+		switch strings.ToUpper(attr) {
+		case "C":
+			name.Country = append(name.Country, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, value)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, value)
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "CN":
+			if name.CommonName != "" {
+				return pkix.Name{}, errors.New("CN can only be set once")
+			}
+			name.CommonName = value
+		case "SERIALNUMBER":
+			name.SerialNumber = value
+		default:
+			return pkix.Name{}, fmt.Errorf("unsupported attribute %q, options are: C, ST, L, STREET, POSTALCODE, O, OU, CN, SERIALNUMBER", attr)
+		}
+	}
+	return name, nil
+}
+
+// applySubject overrides the attributes of the default leaf subject name with
+// those set in m.Subject. The mkcert Organization and OrganizationalUnit are
+// kept unless replaced.
+func (m *mkcert) applySubject(name *pkix.Name) {
+	s := m.Subject
+	if s.Organization != nil {
+		name.Organization = s.Organization
+	}
+	if s.OrganizationalUnit != nil {
+		name.OrganizationalUnit = s.OrganizationalUnit
+	}
+	if s.CommonName != "" {
+		name.CommonName = s.CommonName
+	}
+	name.Country, name.Province, name.Locality = s.Country, s.Province, s.Locality
+	name.StreetAddress, name.PostalCode = s.StreetAddress, s.PostalCode
+	name.SerialNumber = s.SerialNumber
+}
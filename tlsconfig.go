@@ -0,0 +1,101 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedCerts bounds the certificates kept by NewTLSConfig, as clients
+// choose the names they are issued for.
+const maxCachedCerts = 1000
+
+// NewTLSConfig returns a tls.Config that issues, on demand, a certificate
+// from the local CA in caroot for whatever name each client asks for with
+// SNI, or for the IP address it connected to if it didn't send one. caroot
+// can be empty to use the default location. The local CA must already
+// exist, see LoadCA.
+//
+// Certificates are cached until shortly before they expire. Public domain
+// names are rejected, as mkcert would do by default.
+func NewTLSConfig(caroot string) (*tls.Config, error) {
+	m := &mkcert{CAROOT: caroot}
+	if err := m.LoadCA(); err != nil {
+		return nil, err
+	}
+	if m.caKey == nil {
+		return nil, errNoCAKey("create new certificates")
+	}
+	c := &certCache{m: m, certs: make(map[string]*cachedCert)}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}, nil
+}
+
+// certCache issues and caches the certificates for NewTLSConfig.
+type certCache struct {
+	m *mkcert
+
+	mu    sync.Mutex
+	certs map[string]*cachedCert
+}
+
+// cachedCert is a certificate being issued, or issued, for a name. done is
+// closed once cert and err are set, so that concurrent handshakes for the
+// same name wait for the same certificate instead of issuing their own.
+type cachedCert struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// certRenewBefore is how long before it expires a cached certificate is
+// replaced.
+const certRenewBefore = 24 * time.Hour
+
+func (c *certCache) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		name = "localhost"
+		if hello.Conn != nil {
+			if host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String()); err == nil {
+				name = host
+			}
+		}
+	}
+
+	c.mu.Lock()
+	e, ok := c.certs[name]
+	if ok {
+		select {
+		case <-e.done:
+			if e.err != nil || time.Until(e.cert.Leaf.NotAfter) < certRenewBefore {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		if len(c.certs) >= maxCachedCerts {
+			c.certs = make(map[string]*cachedCert)
+		}
+		e = &cachedCert{done: make(chan struct{})}
+		c.certs[name] = e
+		go func() {
+			defer close(e.done)
+			e.cert, e.err = c.m.CreateTLSCertificate(context.Background(), name)
+		}()
+	}
+	c.mu.Unlock()
+
+	<-e.done
+	return e.cert, e.err
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build freebsd || openbsd
+// +build freebsd openbsd
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	FirefoxProfile = filepath.Join(globEscape(os.Getenv("HOME")), ".mozilla", "firefox", "*")
+	NSSBrowsers    = "Firefox and/or Chrome/Chromium"
+
+	SystemTrustFilename string
+	SystemTrustCommand  []string
+	CertutilInstallHelp string
+)
+
+func init() {
+	switch runtime.GOOS {
+	case "freebsd":
+		CertutilInstallHelp = "pkg install nss"
+		// certctl(8) is available since FreeBSD 12.2, and picks up
+		// certificates from /usr/local/share/certs when rehashing.
+		if binaryExists("certctl") {
+			SystemTrustFilename = "/usr/local/share/certs/%s.pem"
+			SystemTrustCommand = []string{"certctl", "rehash"}
+		}
+	case "openbsd":
+		CertutilInstallHelp = "pkg_add nss"
+		SystemTrustFilename = "/etc/ssl/certs/%s.pem"
+		SystemTrustCommand = []string{"openssl", "certhash", "/etc/ssl/certs"}
+	}
+}
+
+func (m *mkcert) systemTrustFilename() string {
+	return fmt.Sprintf(SystemTrustFilename, strings.Replace(m.caUniqueName(), " ", "_", -1))
+}
+
+func (m *mkcert) installPlatform() bool {
+	if m.userOnly {
+		m.logf("Note: %s has no per-user system trust store, so with -user-only only %s and Java will trust the local CA. ℹ️", runtime.GOOS, NSSBrowsers)
+		return false
+	}
+	if SystemTrustCommand == nil {
+		m.logf("Installing to the system store requires certctl on FreeBSD 12.2 or later 😣 but %s will still work.", NSSBrowsers)
+		m.logf("You can also manually install the root certificate at %q.", m.caCertPath())
+		return false
+	}
+
+	cert, err := ioutil.ReadFile(m.caCertPath())
+	fatalIfErr(err, "failed to read root certificate")
+
+	// /etc/ssl/certs does not exist by default on OpenBSD.
+	cmd := commandWithSudo("mkdir", "-p", filepath.Dir(m.systemTrustFilename()))
+	out, err := runCommand(m.context(), cmd)
+	fatalIfStoreCmdErr("system", err, "mkdir", out)
+
+	cmd = commandWithSudo("tee", m.systemTrustFilename())
+	cmd.Stdin = bytes.NewReader(cert)
+	out, err = runCommand(m.context(), cmd)
+	fatalIfStoreCmdErr("system", err, "tee", out)
+
+	cmd = commandWithSudo(SystemTrustCommand...)
+	out, err = runCommand(m.context(), cmd)
+	fatalIfStoreCmdErr("system", err, strings.Join(SystemTrustCommand, " "), out)
+
+	return true
+}
+
+func (m *mkcert) uninstallPlatform() bool {
+	if SystemTrustCommand == nil || m.userOnly || !pathExists(m.systemTrustFilename()) {
+		return false
+	}
+
+	cmd := commandWithSudo("rm", "-f", m.systemTrustFilename())
+	out, err := runCommand(m.context(), cmd)
+	fatalIfStoreCmdErr("system", err, "rm", out)
+
+	// Rehashing also drops the now dangling hash links.
+	cmd = commandWithSudo(SystemTrustCommand...)
+	out, err = runCommand(m.context(), cmd)
+	fatalIfStoreCmdErr("system", err, strings.Join(SystemTrustCommand, " "), out)
+
+	return true
+}
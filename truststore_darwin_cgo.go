@@ -0,0 +1,185 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package main
+
+/*
+#cgo CFLAGS: -Wno-deprecated-declarations
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+
+#include <stdlib.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+static OSStatus mkcertCreateCertificate(const UInt8 *der, CFIndex len, SecCertificateRef *cert) {
+	CFDataRef data = CFDataCreate(NULL, der, len);
+	if (data == NULL) {
+		return errSecAllocate;
+	}
+	*cert = SecCertificateCreateWithData(NULL, data);
+	CFRelease(data);
+	return *cert == NULL ? errSecDecode : errSecSuccess;
+}
+
+static void mkcertReleaseCertificate(SecCertificateRef cert) {
+	CFRelease(cert);
+}
+
+// mkcertAddToKeychain adds cert to the System keychain, or if user is set to
+// the default keychain of the user, usually the login one.
+static OSStatus mkcertAddToKeychain(SecCertificateRef cert, int user) {
+	SecKeychainRef keychain = NULL;
+	OSStatus status;
+	if (!user) {
+		status = SecKeychainOpen("/Library/Keychains/System.keychain", &keychain);
+		if (status != errSecSuccess) {
+			return status;
+		}
+	}
+	status = SecCertificateAddToKeychain(cert, keychain);
+	if (keychain != NULL) {
+		CFRelease(keychain);
+	}
+	if (status == errSecDuplicateItem) {
+		status = errSecSuccess;
+	}
+	return status;
+}
+
+// mkcertSetTrustSettings makes the trust settings explicit for the SSL and
+// basic X.509 policies, as older Go does not know the defaults.
+// https://github.com/golang/go/issues/24652
+static OSStatus mkcertSetTrustSettings(SecCertificateRef cert, SecTrustSettingsDomain domain) {
+	SecPolicyRef ssl = SecPolicyCreateSSL(true, NULL);
+	SecPolicyRef basic = SecPolicyCreateBasicX509();
+	SInt32 trustRoot = kSecTrustSettingsResultTrustRoot;
+	CFNumberRef result = CFNumberCreate(NULL, kCFNumberSInt32Type, &trustRoot);
+
+	const void *keys[] = { kSecTrustSettingsPolicy, kSecTrustSettingsResult };
+	const void *sslValues[] = { ssl, result };
+	const void *basicValues[] = { basic, result };
+	CFDictionaryRef sslDict = CFDictionaryCreate(NULL, keys, sslValues, 2,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFDictionaryRef basicDict = CFDictionaryCreate(NULL, keys, basicValues, 2,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	const void *dicts[] = { sslDict, basicDict };
+	CFArrayRef settings = CFArrayCreate(NULL, dicts, 2, &kCFTypeArrayCallBacks);
+
+	OSStatus status = SecTrustSettingsSetTrustSettings(cert, domain, settings);
+
+	CFRelease(settings);
+	CFRelease(basicDict);
+	CFRelease(sslDict);
+	CFRelease(result);
+	CFRelease(basic);
+	CFRelease(ssl);
+	return status;
+}
+
+static OSStatus mkcertRemoveTrustSettings(SecCertificateRef cert, SecTrustSettingsDomain domain) {
+	return SecTrustSettingsRemoveTrustSettings(cert, domain);
+}
+
+static char *mkcertErrorMessage(OSStatus status) {
+	CFStringRef msg = SecCopyErrorMessageString(status, NULL);
+	if (msg == NULL) {
+		return NULL;
+	}
+	CFIndex size = CFStringGetMaximumSizeForEncoding(CFStringGetLength(msg), kCFStringEncodingUTF8) + 1;
+	char *buf = malloc(size);
+	if (buf != NULL && !CFStringGetCString(msg, buf, size, kCFStringEncodingUTF8)) {
+		free(buf);
+		buf = NULL;
+	}
+	CFRelease(msg);
+	return buf;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"unsafe"
+)
+
+// errSecItemNotFound is returned when removing trust settings that don't
+// exist, which just means the root was not installed.
+const errSecItemNotFound = -25300
+
+// securityError describes a non-zero OSStatus returned by Security.framework.
+type securityError struct {
+	op     string
+	status C.OSStatus
+}
+
+func (e securityError) Error() string {
+	msg := "unknown error"
+	if cmsg := C.mkcertErrorMessage(e.status); cmsg != nil {
+		msg = C.GoString(cmsg)
+		C.free(unsafe.Pointer(cmsg))
+	}
+	return fmt.Sprintf("%s: %s (OSStatus %d)", e.op, msg, int(e.status))
+}
+
+func (m *mkcert) secCertificate() C.SecCertificateRef {
+	var cert C.SecCertificateRef
+	der := C.CBytes(m.caCert.Raw)
+	defer C.free(der)
+	status := C.mkcertCreateCertificate((*C.UInt8)(der), C.CFIndex(len(m.caCert.Raw)), &cert)
+	fatalIfSecErr("failed to load the root certificate", status)
+	return cert
+}
+
+// trustDomain selects the admin trust settings domain, or with -user-only the
+// user one, which doesn't require authorization.
+func (m *mkcert) trustDomain() C.SecTrustSettingsDomain {
+	if m.userOnly {
+		return C.kSecTrustSettingsDomainUser
+	}
+	return C.kSecTrustSettingsDomainAdmin
+}
+
+func fatalIfSecErr(op string, status C.OSStatus) {
+	if status == C.errSecSuccess {
+		return
+	}
+	err := securityError{op, status}
+	if os.Geteuid() != 0 && !noSudo {
+		log.Printf("ERROR: %s\n\nIf no authorization prompt was shown, try again with \"sudo mkcert -install\".", err)
+		os.Exit(exitTrustStore)
+	}
+	fatalErr(&TrustStoreError{Store: "system", Err: err})
+}
+
+func (m *mkcert) installPlatform() bool {
+	cert := m.secCertificate()
+	defer C.mkcertReleaseCertificate(cert)
+
+	if m.userOnly {
+		fatalIfSecErr("failed to add the root to the login keychain", C.mkcertAddToKeychain(cert, 1))
+	} else {
+		fatalIfSecErr("failed to add the root to the System keychain", C.mkcertAddToKeychain(cert, 0))
+	}
+	fatalIfSecErr("failed to set the root trust settings", C.mkcertSetTrustSettings(cert, m.trustDomain()))
+
+	return true
+}
+
+func (m *mkcert) uninstallPlatform() bool {
+	cert := m.secCertificate()
+	defer C.mkcertReleaseCertificate(cert)
+
+	status := C.mkcertRemoveTrustSettings(cert, m.trustDomain())
+	if status == errSecItemNotFound {
+		return false
+	}
+	fatalIfSecErr("failed to remove the root trust settings", status)
+
+	return true
+}
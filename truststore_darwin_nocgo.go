@@ -0,0 +1,126 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin && !cgo
+// +build darwin,!cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+
+	"howett.net/plist"
+)
+
+// Without cgo Security.framework is not reachable, so the system store is
+// managed through the security command line tool.
+
+// https://github.com/golang/go/issues/24652#issuecomment-399826583
+var trustSettings []interface{}
+var _, _ = plist.Unmarshal(trustSettingsData, &trustSettings)
+var trustSettingsData = []byte(`
+<array>
+	<dict>
+		<key>kSecTrustSettingsPolicy</key>
+		<data>
+		KoZIhvdjZAED
+		</data>
+		<key>kSecTrustSettingsPolicyName</key>
+		<string>sslServer</string>
+		<key>kSecTrustSettingsResult</key>
+		<integer>1</integer>
+	</dict>
+	<dict>
+		<key>kSecTrustSettingsPolicy</key>
+		<data>
+		KoZIhvdjZAEC
+		</data>
+		<key>kSecTrustSettingsPolicyName</key>
+		<string>basicX509</string>
+		<key>kSecTrustSettingsResult</key>
+		<integer>1</integer>
+	</dict>
+</array>
+`)
+
+// trustDomainArgs selects the admin trust settings domain, or with -user-only
+// the user one.
+func (m *mkcert) trustDomainArgs() []string {
+	if m.userOnly {
+		return nil
+	}
+	return []string{"-d"}
+}
+
+func (m *mkcert) installPlatform() bool {
+	var cmd *exec.Cmd
+	if m.userOnly {
+		// The default keychain, usually the login one, and the user domain.
+		cmd = exec.Command("security", "add-trusted-cert", "-r", "trustRoot", m.caCertPath())
+	} else {
+		cmd = commandWithSudo("security", "add-trusted-cert", "-d", "-k", "/Library/Keychains/System.keychain", m.caCertPath())
+	}
+	out, err := runCommandWithRetry(m.context(), cmd, keychainRetryPolicy)
+	fatalIfStoreCmdErr("system", err, "security add-trusted-cert", out)
+
+	// Make trustSettings explicit, as older Go does not know the defaults.
+	// https://github.com/golang/go/issues/24652
+
+	plistFile, err := ioutil.TempFile("", "trust-settings")
+	fatalIfStoreErr("system", err, "failed to create temp file")
+	defer os.Remove(plistFile.Name())
+
+	cmd = commandWithSudo(append(append([]string{"security", "trust-settings-export"}, m.trustDomainArgs()...), plistFile.Name())...)
+	out, err = runCommandWithRetry(m.context(), cmd, keychainRetryPolicy)
+	fatalIfStoreCmdErr("system", err, "security trust-settings-export", out)
+
+	plistData, err := ioutil.ReadFile(plistFile.Name())
+	fatalIfStoreErr("system", err, "failed to read trust settings")
+	var plistRoot map[string]interface{}
+	_, err = plist.Unmarshal(plistData, &plistRoot)
+	fatalIfStoreErr("system", err, "failed to parse trust settings")
+
+	rootSubjectASN1, _ := asn1.Marshal(m.caCert.Subject.ToRDNSequence())
+
+	if plistRoot["trustVersion"].(uint64) != 1 {
+		log.Fatalln("ERROR: unsupported trust settings version:", plistRoot["trustVersion"])
+	}
+	trustList := plistRoot["trustList"].(map[string]interface{})
+	for key := range trustList {
+		entry := trustList[key].(map[string]interface{})
+		if _, ok := entry["issuerName"]; !ok {
+			continue
+		}
+		issuerName := entry["issuerName"].([]byte)
+		if !bytes.Equal(rootSubjectASN1, issuerName) {
+			continue
+		}
+		entry["trustSettings"] = trustSettings
+		break
+	}
+
+	plistData, err = plist.MarshalIndent(plistRoot, plist.XMLFormat, "\t")
+	fatalIfStoreErr("system", err, "failed to serialize trust settings")
+	err = ioutil.WriteFile(plistFile.Name(), plistData, 0600)
+	fatalIfStoreErr("system", err, "failed to write trust settings")
+
+	cmd = commandWithSudo(append(append([]string{"security", "trust-settings-import"}, m.trustDomainArgs()...), plistFile.Name())...)
+	out, err = runCommandWithRetry(m.context(), cmd, keychainRetryPolicy)
+	fatalIfStoreCmdErr("system", err, "security trust-settings-import", out)
+
+	return true
+}
+
+func (m *mkcert) uninstallPlatform() bool {
+	cmd := commandWithSudo(append(append([]string{"security", "remove-trusted-cert"}, m.trustDomainArgs()...), m.caCertPath())...)
+	out, err := runCommandWithRetry(m.context(), cmd, keychainRetryPolicy)
+	fatalIfStoreCmdErr("system", err, "security remove-trusted-cert", out)
+
+	return true
+}
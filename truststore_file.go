@@ -0,0 +1,269 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Formats for CATrustStore.
+const (
+	TrustStorePKCS12 = "pkcs12"
+	TrustStoreJKS    = "jks"
+)
+
+// defaultTrustStorePassword is the password of the truststores written by
+// -ca-truststore, unless -truststore-pass is set. It's the well known default
+// of the JDK cacerts, as truststores only hold public certificates, and the
+// password only protects their integrity.
+const defaultTrustStorePassword = "changeit"
+
+// CATrustStore returns a truststore containing only the local CA certificate,
+// in the PKCS #12 or JKS format, protected by password. It can be used by JVM
+// applications with -Djavax.net.ssl.trustStore, without keytool.
+func (m *mkcert) CATrustStore(format, password string) ([]byte, error) {
+	if m.caCert == nil {
+		return nil, errors.New("the local CA is not loaded")
+	}
+	if password == "" {
+		return nil, errors.New("the truststore password can't be empty")
+	}
+	alias := strings.ToLower(m.caUniqueName())
+	switch format {
+	case TrustStorePKCS12:
+		return encodePKCS12TrustStore(alias, m.caCert.Raw, password)
+	case TrustStoreJKS:
+		return encodeJKSTrustStore(alias, m.caCert.Raw, password, time.Now()), nil
+	default:
+		return nil, fmt.Errorf("unknown truststore format %q", format)
+	}
+}
+
+// trustStoreFormat returns the truststore format selected by the extension
+// of path: JKS for ".jks" and PKCS #12 otherwise.
+func trustStoreFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".jks") {
+		return TrustStoreJKS
+	}
+	return TrustStorePKCS12
+}
+
+// writeCATrustStore implements -ca-truststore.
+func (m *mkcert) writeCATrustStore() {
+	password := m.trustStorePass
+	if password == "" {
+		password = defaultTrustStorePassword
+	}
+	format := trustStoreFormat(m.caTrustStore)
+	data, err := m.CATrustStore(format, password)
+	fatalIfErr(err, "failed to create the truststore")
+	fatalIfErr(writeFile(m.caTrustStore, data, 0644), "failed to save the truststore")
+
+	m.logf("The local CA truststore (%s) is at \"%s\" ✅\n", strings.ToUpper(format), m.caTrustStore)
+	if m.trustStorePass == "" {
+		m.logf("Its password is the default \"%s\" ℹ️\n", defaultTrustStorePassword)
+	}
+	m.logf("\nUse it with -Djavax.net.ssl.trustStore=%s -Djavax.net.ssl.trustStorePassword=... -Djavax.net.ssl.trustStoreType=%s\n\n",
+		m.caTrustStore, format)
+}
+
+// encodeJKSTrustStore returns a Java KeyStore with a single trusted
+// certificate entry. The format is undocumented, but stable since JDK 1.2:
+// big-endian integers, Java "modified UTF-8" strings, and a trailing SHA-1
+// keyed with the UTF-16 password and a fixed string.
+func encodeJKSTrustStore(alias string, cert []byte, password string, created time.Time) []byte {
+	b := &bytes.Buffer{}
+	writeUTF := func(s string) {
+		binary.Write(b, binary.BigEndian, uint16(len(s)))
+		b.WriteString(s)
+	}
+	binary.Write(b, binary.BigEndian, uint32(0xfeedfeed)) // magic
+	binary.Write(b, binary.BigEndian, uint32(2))          // version
+	binary.Write(b, binary.BigEndian, uint32(1))          // entries
+	binary.Write(b, binary.BigEndian, uint32(2))          // trusted certificate entry
+	writeUTF(alias)
+	binary.Write(b, binary.BigEndian, uint64(created.UnixNano()/int64(time.Millisecond)))
+	writeUTF("X.509")
+	binary.Write(b, binary.BigEndian, uint32(len(cert)))
+	b.Write(cert)
+
+	h := sha1.New()
+	h.Write(bmpString(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(b.Bytes())
+	return h.Sum(b.Bytes())
+}
+
+var (
+	oidDataContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+// pkcs12TrustStoreMACRounds is the iteration count of the MAC key derivation,
+// the same as keytool's default.
+const pkcs12TrustStoreMACRounds = 10000
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// encodePKCS12TrustStore returns a PKCS #12 file with a single certificate
+// bag marked as trusted for any purpose with the attribute the JDK uses for
+// trusted certificate entries. The certificate is not encrypted, as it's
+// public, and the file is only integrity protected by a SHA-1 HMAC keyed
+// with password, like the ones written by keytool.
+func encodePKCS12TrustStore(alias string, cert []byte, password string) ([]byte, error) {
+	explicit := func(der []byte) asn1.RawValue {
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+	}
+	dataContentInfo := func(data []byte) (contentInfo, error) {
+		octets, err := asn1.Marshal(data)
+		return contentInfo{ContentType: oidDataContentType, Content: explicit(octets)}, err
+	}
+	set := func(der []byte) asn1.RawValue {
+		return asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: der}
+	}
+
+	bagValue, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: cert})
+	if err != nil {
+		return nil, err
+	}
+	friendlyName, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: bmpString(alias)})
+	if err != nil {
+		return nil, err
+	}
+	anyEKU, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+	if err != nil {
+		return nil, err
+	}
+	safeContents, err := asn1.Marshal([]safeBag{{
+		ID:    oidCertBag,
+		Value: explicit(bagValue),
+		Attributes: []pkcs12Attribute{
+			{ID: oidFriendlyName, Value: set(friendlyName)},
+			{ID: oidJavaTrustedKeyUsage, Value: set(anyEKU)},
+		},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	safeContentsInfo, err := dataContentInfo(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{safeContentsInfo})
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 20)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12MACKey(salt, password, pkcs12TrustStoreMACRounds))
+	mac.Write(authenticatedSafe)
+
+	authSafe, err := dataContentInfo(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPDU{
+		Version:  3,
+		AuthSafe: authSafe,
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12TrustStoreMACRounds,
+		},
+	})
+}
+
+// pkcs12MACKey derives the 20 bytes HMAC-SHA1 key of a PKCS #12 file with the
+// key derivation function of RFC 7292, Appendix B.2, which for a key no
+// longer than the hash output reduces to a single iterated hash.
+func pkcs12MACKey(salt []byte, password string, iterations int) []byte {
+	const v = 64 // SHA-1 block size
+	fill := func(s []byte) []byte {
+		if len(s) == 0 {
+			return nil
+		}
+		out := make([]byte, (len(s)+v-1)/v*v)
+		for i := range out {
+			out[i] = s[i%len(s)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{3}, v) // ID 3: MAC key
+	pass := append(bmpString(password), 0, 0)
+	input := append(append(d, fill(salt)...), fill(pass)...)
+	key := sha1.Sum(input)
+	for i := 1; i < iterations; i++ {
+		key = sha1.Sum(key[:])
+	}
+	return key[:]
+}
+
+// bmpString returns s encoded as UTF-16BE, as required by ASN.1 BMPString.
+func bmpString(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
@@ -6,59 +6,196 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"hash"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 var (
 	hasJava    bool
 	hasKeytool bool
 
+	// javaKeystores are the cacerts keystores of the detected JDKs, starting
+	// with the one of JAVA_HOME.
+	javaKeystores []javaKeystore
+
+	// javaHome, cacertsPath and keytoolPath are those of the first JDK, used
+	// with -user-only.
 	javaHome    string
 	cacertsPath string
 	keytoolPath string
 	storePass   string = "changeit"
 )
 
+// A javaKeystore is the cacerts keystore of a JDK, and the keytool used to
+// manage it. JREs without their own keytool use the one of another JDK.
+type javaKeystore struct {
+	home    string
+	cacerts string
+	keytool string
+}
+
 func init() {
+	keytoolName := filepath.Join("bin", "keytool")
 	if runtime.GOOS == "windows" {
-		keytoolPath = filepath.Join("bin", "keytool.exe")
-	} else {
-		keytoolPath = filepath.Join("bin", "keytool")
+		keytoolName = filepath.Join("bin", "keytool.exe")
 	}
 
-	if v := os.Getenv("JAVA_HOME"); v != "" {
-		hasJava = true
-		javaHome = v
-
-		if pathExists(filepath.Join(v, keytoolPath)) {
-			hasKeytool = true
-			keytoolPath = filepath.Join(v, keytoolPath)
+	// Distributions often link the cacerts of all their JDKs to a single
+	// shared keystore, which only needs to be updated once.
+	seen := make(map[string]bool)
+	for _, home := range javaHomes() {
+		ks := javaKeystore{home: home}
+		for _, p := range []string{
+			filepath.Join(home, "jre", "lib", "security", "cacerts"),
+			filepath.Join(home, "lib", "security", "cacerts"),
+		} {
+			if pathExists(p) {
+				ks.cacerts = p
+				break
+			}
+		}
+		if ks.cacerts == "" {
+			continue
+		}
+		canonical, err := filepath.EvalSymlinks(ks.cacerts)
+		if err != nil {
+			canonical = ks.cacerts
+		}
+		if seen[canonical] {
+			continue
+		}
+		seen[canonical] = true
+		if pathExists(filepath.Join(home, keytoolName)) {
+			ks.keytool = filepath.Join(home, keytoolName)
 		}
+		javaKeystores = append(javaKeystores, ks)
+	}
 
-		if pathExists(filepath.Join(v, "lib", "security", "cacerts")) {
-			cacertsPath = filepath.Join(v, "lib", "security", "cacerts")
+	for _, ks := range javaKeystores {
+		if ks.keytool != "" && keytoolPath == "" {
+			keytoolPath = ks.keytool
+		}
+	}
+	for i := range javaKeystores {
+		if javaKeystores[i].keytool == "" {
+			javaKeystores[i].keytool = keytoolPath
 		}
+	}
+	hasJava = len(javaKeystores) > 0
+	hasKeytool = keytoolPath != ""
+	if len(javaKeystores) > 0 {
+		javaHome = javaKeystores[0].home
+		cacertsPath = javaKeystores[0].cacerts
+	}
+}
 
-		if pathExists(filepath.Join(v, "jre", "lib", "security", "cacerts")) {
-			cacertsPath = filepath.Join(v, "jre", "lib", "security", "cacerts")
+// javaHomes returns JAVA_HOME, and the JDKs installed in the usual locations
+// of the platform and of JDK managers like SDKMAN!, asdf and IntelliJ IDEA.
+// Only globs are used, as running java or java_home would be much slower.
+func javaHomes() []string {
+	var homes []string
+	if v := os.Getenv("JAVA_HOME"); v != "" {
+		homes = append(homes, v)
+	}
+	var globs []string
+	switch runtime.GOOS {
+	case "darwin":
+		globs = append(globs, "/Library/Java/JavaVirtualMachines/*/Contents/Home")
+	case "windows":
+		if pf := os.Getenv("ProgramFiles"); pf != "" {
+			for _, vendor := range []string{"Java", "Eclipse Adoptium", "Microsoft", "Zulu", "Amazon Corretto"} {
+				globs = append(globs, filepath.Join(globEscape(pf), vendor, "*"))
+			}
 		}
+	default:
+		globs = append(globs, "/usr/lib/jvm/*", "/usr/lib64/jvm/*", "/usr/local/openjdk*")
 	}
+	if home, err := os.UserHomeDir(); err == nil {
+		home = globEscape(home)
+		globs = append(globs,
+			filepath.Join(home, ".sdkman", "candidates", "java", "*"),
+			filepath.Join(home, ".asdf", "installs", "java", "*"),
+			filepath.Join(home, ".jdks", "*"))
+		if runtime.GOOS == "darwin" {
+			globs = append(globs, filepath.Join(home, "Library", "Java", "JavaVirtualMachines", "*", "Contents", "Home"))
+		}
+	}
+	for _, g := range globs {
+		matches, _ := filepath.Glob(g)
+		homes = append(homes, matches...)
+	}
+	return homes
+}
+
+// javaTargets returns the keystores that checkJava, installJava and
+// uninstallJava operate on: the detected ones, or with -user-only the per-user
+// truststore.
+func (m *mkcert) javaTargets() []javaKeystore {
+	if m.userOnly {
+		return []javaKeystore{{home: javaHome, cacerts: m.javaKeystore(), keytool: keytoolPath}}
+	}
+	return javaKeystores
 }
 
+// checkJava reports whether all the Java keystores contain the local CA. The
+// results are cached in the CAROOT, see javaCacheName.
 func (m *mkcert) checkJava() bool {
 	if !hasKeytool {
 		return false
 	}
+	for _, found := range m.checkJavaKeystores() {
+		if !found {
+			return false
+		}
+	}
+	return true
+}
 
+// checkJavaKeystores checks concurrently which of javaTargets contain the
+// local CA.
+func (m *mkcert) checkJavaKeystores() []bool {
+	targets := m.javaTargets()
+	found := make([]bool, len(targets))
+	cache := m.loadJavaCache()
+	// The stamps are taken before running keytool, so that a concurrent
+	// change invalidates the entries.
+	stamps := make([]fileStamp, len(targets))
+	var fs []func()
+	for i, ks := range targets {
+		i, ks := i, ks
+		stamps[i] = stampFile(ks.cacerts)
+		if f, ok := cache.lookup(m, ks.cacerts, stamps[i]); ok {
+			found[i] = f
+			continue
+		}
+		fs = append(fs, func() { found[i] = m.keystoreHasCA(ks) })
+	}
+	if len(fs) == 0 {
+		return found
+	}
+	runParallel(fs...)
+	for i, ks := range targets {
+		cache.record(m, ks.cacerts, stamps[i], found[i])
+	}
+	m.saveJavaCache(cache)
+	return found
+}
+
+func (m *mkcert) keystoreHasCA(ks javaKeystore) bool {
 	// exists returns true if the given x509.Certificate's fingerprint
 	// is in the keytool -list output
 	exists := func(c *x509.Certificate, h hash.Hash, keytoolOutput []byte) bool {
@@ -67,8 +204,11 @@ func (m *mkcert) checkJava() bool {
 		return bytes.Contains(keytoolOutput, []byte(fp))
 	}
 
-	keytoolOutput, err := exec.Command(keytoolPath, "-list", "-keystore", cacertsPath, "-storepass", storePass).CombinedOutput()
-	fatalIfCmdErr(err, "keytool -list", keytoolOutput)
+	if !pathExists(ks.cacerts) {
+		return false
+	}
+	keytoolOutput, err := runCommand(m.context(), exec.Command(ks.keytool, "-list", "-keystore", ks.cacerts, "-storepass", storePass))
+	fatalIfStoreCmdErr("java", err, "keytool -list", keytoolOutput)
 	// keytool outputs SHA1 and SHA256 (Java 9+) certificates in uppercase hex
 	// with each octet pair delimitated by ":". Drop them from the keytool output
 	keytoolOutput = bytes.Replace(keytoolOutput, []byte(":"), nil, -1)
@@ -78,45 +218,167 @@ func (m *mkcert) checkJava() bool {
 	return exists(m.caCert, s1, keytoolOutput) || exists(m.caCert, s256, keytoolOutput)
 }
 
+// userTruststoreName is the per-user copy of the JDK cacerts, including the
+// local CA, that -user-only installs into.
+const userTruststoreName = "java-truststore.jks"
+
+// javaKeystore returns the JDK cacerts, or with -user-only the per-user
+// truststore in CAROOT, which applications must be pointed to with
+// JAVA_TOOL_OPTIONS, as cacerts can usually only be modified by root.
+func (m *mkcert) javaKeystore() string {
+	if m.userOnly {
+		return filepath.Join(m.CAROOT, userTruststoreName)
+	}
+	return cacertsPath
+}
+
+// javaToolOptions returns the JAVA_TOOL_OPTIONS that select the per-user
+// truststore.
+func (m *mkcert) javaToolOptions() string {
+	return "-Djavax.net.ssl.trustStore=" + m.javaKeystore() + " -Djavax.net.ssl.trustStorePassword=" + storePass
+}
+
+// installJava imports the local CA concurrently into the Java keystores that
+// don't contain it yet.
 func (m *mkcert) installJava() {
+	if m.userOnly && !pathExists(m.javaKeystore()) && cacertsPath != "" {
+		// Start from the default roots, so that other TLS connections keep
+		// working for applications that use the per-user truststore.
+		out, err := runCommand(m.context(), exec.Command(keytoolPath, "-importkeystore", "-noprompt",
+			"-srckeystore", cacertsPath, "-srcstorepass", storePass,
+			"-destkeystore", m.javaKeystore(), "-deststorepass", storePass, "-deststoretype", "JKS"))
+		fatalIfStoreCmdErr("java", err, "keytool -importkeystore", out)
+	}
+
+	found := m.checkJavaKeystores()
+	var fs []func()
+	for i, ks := range m.javaTargets() {
+		if !found[i] {
+			ks := ks
+			fs = append(fs, func() { m.installJavaKeystore(ks) })
+		}
+	}
+	runParallel(fs...)
+}
+
+func (m *mkcert) installJavaKeystore(ks javaKeystore) {
+	// The certificate is passed on stdin rather than with -file, because on
+	// Windows the JVM decodes arguments with the ANSI code page, which can't
+	// represent many user profile paths, like C:\Users\José García.
 	args := []string{
 		"-importcert", "-noprompt",
-		"-keystore", cacertsPath,
+		"-keystore", ks.cacerts,
 		"-storepass", storePass,
-		"-file", filepath.Join(m.CAROOT, rootName),
 		"-alias", m.caUniqueName(),
 	}
 
-	out, err := execKeytool(exec.Command(keytoolPath, args...))
-	fatalIfCmdErr(err, "keytool -importcert", out)
+	cmd := exec.Command(ks.keytool, args...)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.caCert.Raw}))
+	out, err := execKeytool(m.context(), ks.home, cmd)
+	fatalIfStoreCmdErr("java", err, "keytool -importcert", out)
 }
 
+// uninstallJava removes the local CA concurrently from all the Java keystores.
 func (m *mkcert) uninstallJava() {
+	var fs []func()
+	for _, ks := range m.javaTargets() {
+		ks := ks
+		fs = append(fs, func() { m.uninstallJavaKeystore(ks) })
+	}
+	runParallel(fs...)
+}
+
+func (m *mkcert) uninstallJavaKeystore(ks javaKeystore) {
+	if !pathExists(ks.cacerts) {
+		return
+	}
 	args := []string{
 		"-delete",
 		"-alias", m.caUniqueName(),
-		"-keystore", cacertsPath,
+		"-keystore", ks.cacerts,
 		"-storepass", storePass,
 	}
-	out, err := execKeytool(exec.Command(keytoolPath, args...))
+	out, err := execKeytool(m.context(), ks.home, exec.Command(ks.keytool, args...))
 	if bytes.Contains(out, []byte("does not exist")) {
 		return // cert didn't exist
 	}
-	fatalIfCmdErr(err, "keytool -delete", out)
+	fatalIfStoreCmdErr("java", err, "keytool -delete", out)
 }
 
 // execKeytool will execute a "keytool" command and if needed re-execute
 // the command with commandWithSudo to work around file permissions.
-func execKeytool(cmd *exec.Cmd) ([]byte, error) {
-	out, err := cmd.CombinedOutput()
-	if err != nil && bytes.Contains(out, []byte("java.io.FileNotFoundException")) && runtime.GOOS != "windows" {
-		origArgs := cmd.Args[1:]
+func execKeytool(ctx context.Context, javaHome string, cmd *exec.Cmd) ([]byte, error) {
+	out, err := runCommand(ctx, cmd)
+	if err != nil && bytes.Contains(out, []byte("java.io.FileNotFoundException")) && runtime.GOOS != "windows" && !noSudo {
+		origArgs, origStdin := cmd.Args[1:], cmd.Stdin
 		cmd = commandWithSudo(cmd.Path)
 		cmd.Args = append(cmd.Args, origArgs...)
 		cmd.Env = []string{
 			"JAVA_HOME=" + javaHome,
 		}
-		out, err = cmd.CombinedOutput()
+		if r, ok := origStdin.(*bytes.Reader); ok {
+			r.Seek(0, io.SeekStart) // consumed by the first attempt
+			cmd.Stdin = r
+		}
+		out, err = runCommand(ctx, cmd)
 	}
 	return out, err
 }
+
+// javaCacheName is the file in the CAROOT that records which Java keystores
+// contain the local CA, as checking them means starting a JVM for each one,
+// on every run. Entries are checked against the size and modification time
+// of the keystores, which keytool rewrites when it changes them.
+const javaCacheName = "java-keystores.json"
+
+// javaCache maps keystore paths to what checkJava found in them.
+type javaCache map[string]javaCacheEntry
+
+type javaCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// CA is the SHA-256 fingerprint of the local CA that was looked for.
+	CA    string `json:"ca"`
+	Found bool   `json:"found"`
+}
+
+func (m *mkcert) loadJavaCache() javaCache {
+	c := make(javaCache)
+	data, err := ioutil.ReadFile(longPath(filepath.Join(m.CAROOT, javaCacheName)))
+	if err == nil {
+		// A corrupted cache is only a cache miss.
+		if json.Unmarshal(data, &c) != nil {
+			c = make(javaCache)
+		}
+	}
+	return c
+}
+
+// saveJavaCache writes c to the CAROOT. The cache is only an optimization, so
+// failures, like for a read-only CAROOT, are ignored.
+func (m *mkcert) saveJavaCache(c javaCache) {
+	if data, err := json.Marshal(c); err == nil {
+		writeFile(filepath.Join(m.CAROOT, javaCacheName), data, 0644)
+	}
+}
+
+func (c javaCache) lookup(m *mkcert, path string, stamp fileStamp) (found, ok bool) {
+	e, ok := c[path]
+	if !ok || !stamp.exists || e.Size != stamp.size || !e.ModTime.Equal(stamp.modTime) || e.CA != m.caFingerprint() {
+		return false, false
+	}
+	return e.Found, true
+}
+
+func (c javaCache) record(m *mkcert, path string, stamp fileStamp, found bool) {
+	if !stamp.exists {
+		delete(c, path)
+		return
+	}
+	c[path] = javaCacheEntry{Size: stamp.size, ModTime: stamp.modTime, CA: m.caFingerprint(), Found: found}
+}
+
+func (m *mkcert) caFingerprint() string {
+	h := sha256.Sum256(m.caCert.Raw)
+	return hex.EncodeToString(h[:])
+}
@@ -6,23 +6,41 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
 var (
-	FirefoxProfile = os.Getenv("HOME") + "/.mozilla/firefox/*"
+	FirefoxProfile = filepath.Join(globEscape(os.Getenv("HOME")), ".mozilla", "firefox", "*")
 	NSSBrowsers    = "Firefox and/or Chrome/Chromium"
 
-	SystemTrustFilename string
-	SystemTrustCommand  []string
 	CertutilInstallHelp string
 )
 
+// A linuxStore is a system trust store. Most are a directory of anchors,
+// compiled into the system bundles by command. The p11-kit store is instead
+// managed with "trust anchor", which picks the directory and runs the
+// extraction itself.
+type linuxStore struct {
+	// name is the value that selects the store in TRUST_STORES.
+	name    string
+	dir     string
+	ext     string
+	command []string
+	p11kit  bool
+}
+
+// linuxStores are the system trust stores that were detected, in order of
+// preference. Only the first one is used, unless others are selected by name
+// with TRUST_STORES, as they usually feed the same system bundles.
+var linuxStores []linuxStore
+
+// isNixOS is whether this is NixOS, where the system trust store is part of
+// the read-only system configuration.
+var isNixOS = pathExists("/etc/NIXOS")
+
 func init() {
 	switch {
 	case binaryExists("apt"):
@@ -31,68 +49,170 @@ func init() {
 		CertutilInstallHelp = "yum install nss-tools"
 	case binaryExists("zypper"):
 		CertutilInstallHelp = "zypper install mozilla-nss-tools"
+	case binaryExists("apk"):
+		CertutilInstallHelp = "apk add nss-tools"
 	}
+
 	if pathExists("/etc/pki/ca-trust/source/anchors/") {
-		SystemTrustFilename = "/etc/pki/ca-trust/source/anchors/%s.pem"
-		SystemTrustCommand = []string{"update-ca-trust", "extract"}
-	} else if pathExists("/usr/local/share/ca-certificates/") {
-		SystemTrustFilename = "/usr/local/share/ca-certificates/%s.crt"
-		SystemTrustCommand = []string{"update-ca-certificates"}
-	} else if pathExists("/etc/ca-certificates/trust-source/anchors/") {
-		SystemTrustFilename = "/etc/ca-certificates/trust-source/anchors/%s.crt"
-		SystemTrustCommand = []string{"trust", "extract-compat"}
-	} else if pathExists("/usr/share/pki/trust/anchors") {
-		SystemTrustFilename = "/usr/share/pki/trust/anchors/%s.pem"
-		SystemTrustCommand = []string{"update-ca-certificates"}
+		linuxStores = append(linuxStores, linuxStore{name: "ca-trust",
+			dir: "/etc/pki/ca-trust/source/anchors", ext: ".pem", command: []string{"update-ca-trust", "extract"}})
+	}
+	// Alpine images, including musl based containers, have
+	// update-ca-certificates but might not have the directory yet.
+	if pathExists("/usr/local/share/ca-certificates/") ||
+		(pathExists("/etc/alpine-release") && binaryExists("update-ca-certificates")) {
+		linuxStores = append(linuxStores, linuxStore{name: "ca-certificates",
+			dir: "/usr/local/share/ca-certificates", ext: ".crt", command: []string{"update-ca-certificates"}})
+	}
+	if pathExists("/etc/ca-certificates/trust-source/anchors/") {
+		linuxStores = append(linuxStores, linuxStore{name: "trust-source",
+			dir: "/etc/ca-certificates/trust-source/anchors", ext: ".crt", command: []string{"trust", "extract-compat"}})
+	}
+	if pathExists("/usr/share/pki/trust/anchors") {
+		linuxStores = append(linuxStores, linuxStore{name: "pki-trust",
+			dir: "/usr/share/pki/trust/anchors", ext: ".pem", command: []string{"update-ca-certificates"}})
+	}
+	if binaryExists("trust") {
+		linuxStores = append(linuxStores, linuxStore{name: "p11-kit", p11kit: true})
+	}
+
+	for _, s := range linuxStores {
+		platformStores = append(platformStores, s.name)
+	}
+	// The bundles compiled by the store commands, as in crypto/x509.
+	systemRootBundles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+	if isNixOS {
+		platformStores = append(platformStores, "nixos")
+	}
+
+	// Snap and Flatpak browsers keep their profiles in their sandbox.
+	home := os.Getenv("HOME")
+	sandboxedNSSProfiles = []nssProfileSource{
+		{"snap", filepath.Join(globEscape(home), "snap", "firefox", "common", ".mozilla", "firefox", "*")},
+		{"snap", filepath.Join(globEscape(home), "snap", "chromium", "current", ".pki", "nssdb")},
+		{"flatpak", filepath.Join(globEscape(home), ".var", "app", "org.mozilla.firefox", ".mozilla", "firefox", "*")},
+		{"flatpak", filepath.Join(globEscape(home), ".var", "app", "org.chromium.Chromium", ".pki", "nssdb")},
+		{"flatpak", filepath.Join(globEscape(home), ".var", "app", "com.google.Chrome", ".pki", "nssdb")},
+	}
+	for _, s := range sandboxedNSSProfiles {
+		if matches, _ := filepath.Glob(s.glob); len(matches) > 0 {
+			hasNSS = true
+		}
 	}
 }
 
-func (m *mkcert) systemTrustFilename() string {
-	return fmt.Sprintf(SystemTrustFilename, strings.Replace(m.caUniqueName(), " ", "_", -1))
+// selectedLinuxStores returns the stores to install into or uninstall from:
+// the ones selected by name with TRUST_STORES, or else the preferred one.
+func selectedLinuxStores() []linuxStore {
+	var selected []linuxStore
+	for _, s := range linuxStores {
+		if storeSelected(s.name) {
+			selected = append(selected, s)
+		}
+	}
+	if len(selected) == 0 && len(linuxStores) > 0 && storeEnabled("system") {
+		selected = linuxStores[:1]
+	}
+	return selected
+}
+
+func (s linuxStore) filename(m *mkcert) string {
+	return filepath.Join(s.dir, strings.Replace(m.caUniqueName(), " ", "_", -1)+s.ext)
 }
 
 func (m *mkcert) installPlatform() bool {
-	if SystemTrustCommand == nil {
-		log.Printf("Installing to the system store is not yet supported on this Linux 😣 but %s will still work.", NSSBrowsers)
-		log.Printf("You can also manually install the root certificate at %q.", filepath.Join(m.CAROOT, rootName))
+	if m.userOnly {
+		m.logf("Note: Linux has no per-user system trust store, so with -user-only only %s and Java will trust the local CA. ℹ️", NSSBrowsers)
+		return false
+	}
+	if isNixOS && (storeEnabled("system") || storeSelected("nixos")) {
+		m.logf("Note: on NixOS the system trust store is part of the system configuration. ℹ️")
+		m.logf("Add the local CA to it in configuration.nix and run \"nixos-rebuild switch\" 👈\n\n\tsecurity.pki.certificateFiles = [ %q ];\n", m.caCertPath())
+		return false
+	}
+	stores := selectedLinuxStores()
+	if len(stores) == 0 {
+		m.logf("Installing to the system store is not yet supported on this Linux 😣 but %s will still work.", NSSBrowsers)
+		m.logf("You can also manually install the root certificate at %q.", m.caCertPath())
 		return false
 	}
 
-	cert, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
+	cert, err := ioutil.ReadFile(m.caCertPath())
 	fatalIfErr(err, "failed to read root certificate")
 
-	cmd := commandWithSudo("tee", m.systemTrustFilename())
-	cmd.Stdin = bytes.NewReader(cert)
-	out, err := cmd.CombinedOutput()
-	fatalIfCmdErr(err, "tee", out)
-
-	cmd = commandWithSudo(SystemTrustCommand...)
-	out, err = cmd.CombinedOutput()
-	fatalIfCmdErr(err, strings.Join(SystemTrustCommand, " "), out)
+	for _, s := range stores {
+		if s.p11kit {
+			cmd := commandWithSudo("trust", "anchor", "--store", m.caCertPath())
+			out, err := runCommand(m.context(), cmd)
+			fatalIfStoreCmdErr("system", err, "trust anchor --store", out)
+			continue
+		}
+
+		if !pathExists(s.dir) {
+			cmd := commandWithSudo("mkdir", "-p", s.dir)
+			out, err := runCommand(m.context(), cmd)
+			fatalIfStoreCmdErr("system", err, "mkdir", out)
+		}
+
+		cmd := commandWithSudo("tee", s.filename(m))
+		cmd.Stdin = bytes.NewReader(cert)
+		out, err := runCommand(m.context(), cmd)
+		fatalIfStoreCmdErr("system", err, "tee", out)
+
+		cmd = commandWithSudo(s.command...)
+		out, err = runCommand(m.context(), cmd)
+		fatalIfStoreCmdErr("system", err, strings.Join(s.command, " "), out)
+	}
 
 	return true
 }
 
 func (m *mkcert) uninstallPlatform() bool {
-	if SystemTrustCommand == nil {
+	if m.userOnly {
 		return false
 	}
-
-	cmd := commandWithSudo("rm", "-f", m.systemTrustFilename())
-	out, err := cmd.CombinedOutput()
-	fatalIfCmdErr(err, "rm", out)
-
-	// We used to install under non-unique filenames.
-	legacyFilename := fmt.Sprintf(SystemTrustFilename, "mkcert-rootCA")
-	if pathExists(legacyFilename) {
-		cmd := commandWithSudo("rm", "-f", legacyFilename)
-		out, err := cmd.CombinedOutput()
-		fatalIfCmdErr(err, "rm (legacy filename)", out)
+	if isNixOS && (storeEnabled("system") || storeSelected("nixos")) {
+		m.logf("Note: on NixOS, remove the local CA from security.pki.certificateFiles in configuration.nix and run \"nixos-rebuild switch\" ℹ️")
+		return false
+	}
+	stores := selectedLinuxStores()
+	if len(stores) == 0 {
+		return false
 	}
 
-	cmd = commandWithSudo(SystemTrustCommand...)
-	out, err = cmd.CombinedOutput()
-	fatalIfCmdErr(err, strings.Join(SystemTrustCommand, " "), out)
+	for _, s := range stores {
+		if s.p11kit {
+			cmd := commandWithSudo("trust", "anchor", "--remove", m.caCertPath())
+			out, err := runCommand(m.context(), cmd)
+			if err != nil && !bytes.Contains(out, []byte("couldn't find")) {
+				fatalIfStoreCmdErr("system", err, "trust anchor --remove", out)
+			}
+			continue
+		}
+
+		cmd := commandWithSudo("rm", "-f", s.filename(m))
+		out, err := runCommand(m.context(), cmd)
+		fatalIfStoreCmdErr("system", err, "rm", out)
+
+		// We used to install under non-unique filenames.
+		legacyFilename := filepath.Join(s.dir, "mkcert-rootCA"+s.ext)
+		if pathExists(legacyFilename) {
+			cmd := commandWithSudo("rm", "-f", legacyFilename)
+			out, err := runCommand(m.context(), cmd)
+			fatalIfStoreCmdErr("system", err, "rm (legacy filename)", out)
+		}
+
+		cmd = commandWithSudo(s.command...)
+		out, err = runCommand(m.context(), cmd)
+		fatalIfStoreCmdErr("system", err, strings.Join(s.command, " "), out)
+	}
 
 	return true
 }
@@ -0,0 +1,148 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useLinuxStores replaces the detected system stores, and disables sudo and
+// the NixOS check, for the duration of the test.
+func useLinuxStores(t *testing.T, stores []linuxStore) {
+	oldStores, oldPlatform, oldNoSudo, oldNixOS := linuxStores, platformStores, noSudo, isNixOS
+	linuxStores, platformStores, noSudo, isNixOS = stores, nil, true, false
+	for _, s := range stores {
+		platformStores = append(platformStores, s.name)
+	}
+	t.Cleanup(func() {
+		linuxStores, platformStores, noSudo, isNixOS = oldStores, oldPlatform, oldNoSudo, oldNixOS
+	})
+}
+
+func TestLinuxInstallCommands(t *testing.T) {
+	m := newTestCA(t)
+	dir, err := ioutil.TempDir("", "mkcert-anchors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+	name := strings.Replace(m.caUniqueName(), " ", "_", -1)
+
+	caCertificates := linuxStore{name: "ca-certificates", dir: dir, ext: ".crt", command: []string{"update-ca-certificates"}}
+	caTrust := linuxStore{name: "ca-trust", dir: missing, ext: ".pem", command: []string{"update-ca-trust", "extract"}}
+	p11kit := linuxStore{name: "p11-kit", p11kit: true}
+
+	tests := []struct {
+		name   string
+		stores []linuxStore
+		env    string
+		want   [][]string
+	}{
+		{"preferred store", []linuxStore{caCertificates, p11kit}, "", [][]string{
+			{"tee", filepath.Join(dir, name+".crt")},
+			{"update-ca-certificates"},
+		}},
+		{"missing directory", []linuxStore{caTrust}, "", [][]string{
+			{"mkdir", "-p", missing},
+			{"tee", filepath.Join(missing, name+".pem")},
+			{"update-ca-trust", "extract"},
+		}},
+		{"p11-kit", []linuxStore{caCertificates, p11kit}, "p11-kit", [][]string{
+			{"trust", "anchor", "--store", m.caCertPath()},
+		}},
+		{"selected stores", []linuxStore{caTrust, caCertificates, p11kit}, "ca-certificates,p11-kit", [][]string{
+			{"tee", filepath.Join(dir, name+".crt")},
+			{"update-ca-certificates"},
+			{"trust", "anchor", "--store", m.caCertPath()},
+		}},
+		{"no system store", []linuxStore{caCertificates}, "nss", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLinuxStores(t, tt.stores)
+			setTrustStores(t, tt.env)
+			f := &fakeRunner{}
+			useFakeRunner(t, f)
+
+			if systemStoreEnabled() {
+				m.installPlatform()
+			}
+			if !reflect.DeepEqual(f.cmds, tt.want) {
+				t.Errorf("commands = %q, want %q", f.cmds, tt.want)
+			}
+			for i, cmd := range f.cmds {
+				if cmd[0] == "tee" && !strings.Contains(f.stdins[i], "BEGIN CERTIFICATE") {
+					t.Errorf("tee stdin = %q, want the CA certificate", f.stdins[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLinuxUninstallCommands(t *testing.T) {
+	m := newTestCA(t)
+	dir, err := ioutil.TempDir("", "mkcert-anchors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacyDir, err := ioutil.TempDir("", "mkcert-anchors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(legacyDir)
+	legacy := filepath.Join(legacyDir, "mkcert-rootCA.crt")
+	if err := ioutil.WriteFile(legacy, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Replace(m.caUniqueName(), " ", "_", -1)
+
+	caCertificates := linuxStore{name: "ca-certificates", dir: dir, ext: ".crt", command: []string{"update-ca-certificates"}}
+	withLegacy := linuxStore{name: "ca-certificates", dir: legacyDir, ext: ".crt", command: []string{"update-ca-certificates"}}
+	p11kit := linuxStore{name: "p11-kit", p11kit: true}
+
+	tests := []struct {
+		name    string
+		stores  []linuxStore
+		env     string
+		results map[string][]fakeResult
+		want    [][]string
+	}{
+		{"preferred store", []linuxStore{caCertificates, p11kit}, "", nil, [][]string{
+			{"rm", "-f", filepath.Join(dir, name+".crt")},
+			{"update-ca-certificates"},
+		}},
+		{"legacy filename", []linuxStore{withLegacy}, "", nil, [][]string{
+			{"rm", "-f", filepath.Join(legacyDir, name+".crt")},
+			{"rm", "-f", legacy},
+			{"update-ca-certificates"},
+		}},
+		{"p11-kit not installed", []linuxStore{p11kit}, "p11-kit", map[string][]fakeResult{
+			"trust anchor --remove": {{[]byte("p11-kit: couldn't find the anchor"), errors.New("exit status 1")}},
+		}, [][]string{
+			{"trust", "anchor", "--remove", m.caCertPath()},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLinuxStores(t, tt.stores)
+			setTrustStores(t, tt.env)
+			f := &fakeRunner{results: tt.results}
+			useFakeRunner(t, f)
+
+			m.uninstallPlatform()
+			if !reflect.DeepEqual(f.cmds, tt.want) {
+				t.Errorf("commands = %q, want %q", f.cmds, tt.want)
+			}
+		})
+	}
+}
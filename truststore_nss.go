@@ -6,12 +6,16 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -20,13 +24,17 @@ var (
 	certutilPath string
 	nssDBs       = []string{
 		filepath.Join(os.Getenv("HOME"), ".pki/nssdb"),
-		filepath.Join(os.Getenv("HOME"), "snap/chromium/current/.pki/nssdb"), // Snapcraft
 		"/etc/pki/nssdb", // CentOS 7
 	}
-	firefoxPaths = []string{
+
+	// sandboxedNSSProfiles are the profiles of browsers installed as Snap or
+	// Flatpak packages, which TRUST_STORES can select separately.
+	sandboxedNSSProfiles []nssProfileSource
+	firefoxPaths         = []string{
 		"/usr/bin/firefox",
 		"/usr/bin/firefox-nightly",
 		"/usr/bin/firefox-developer-edition",
+		"/usr/local/bin/firefox", // FreeBSD and OpenBSD packages
 		"/Applications/Firefox.app",
 		"/Applications/FirefoxDeveloperEdition.app",
 		"/Applications/Firefox Developer Edition.app",
@@ -48,99 +56,244 @@ func init() {
 	case "darwin":
 		switch {
 		case binaryExists("certutil"):
-			certutilPath, _ = exec.LookPath("certutil")
+			certutilPath, _ = runner.LookPath("certutil")
 			hasCertutil = true
 		case binaryExists("/usr/local/opt/nss/bin/certutil"):
 			// Check the default Homebrew path, to save executing Ruby. #135
 			certutilPath = "/usr/local/opt/nss/bin/certutil"
 			hasCertutil = true
 		default:
-			out, err := exec.Command("brew", "--prefix", "nss").Output()
+			cmd := exec.Command("brew", "--prefix", "nss")
+			cmd.Stderr = ioutil.Discard
+			out, err := runCommand(context.Background(), cmd)
 			if err == nil {
 				certutilPath = filepath.Join(strings.TrimSpace(string(out)), "bin", "certutil")
 				hasCertutil = pathExists(certutilPath)
 			}
 		}
 
-	case "linux":
+	case "linux", "freebsd", "openbsd":
 		if hasCertutil = binaryExists("certutil"); hasCertutil {
-			certutilPath, _ = exec.LookPath("certutil")
+			certutilPath, _ = runner.LookPath("certutil")
 		}
 	}
 }
 
 func (m *mkcert) checkNSS() bool {
-	if !hasCertutil {
+	native := m.useNativeNSS()
+	if !hasCertutil && !native {
 		return false
 	}
-	success := true
+	var missing int32
 	if m.forEachNSSProfile(func(profile string) {
-		err := exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()).Run()
+		if native {
+			if !m.checkNSSNative(profile) {
+				atomic.AddInt32(&missing, 1)
+			}
+			return
+		}
+		_, err := runCommand(m.context(), exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()))
 		if err != nil {
-			success = false
+			atomic.AddInt32(&missing, 1)
 		}
 	}) == 0 {
-		success = false
+		return false
 	}
-	return success
+	return atomic.LoadInt32(&missing) == 0
 }
 
 func (m *mkcert) installNSS() bool {
+	native := m.useNativeNSS()
 	if m.forEachNSSProfile(func(profile string) {
-		cmd := exec.Command(certutilPath, "-A", "-d", profile, "-t", "C,,", "-n", m.caUniqueName(), "-i", filepath.Join(m.CAROOT, rootName))
-		out, err := execCertutil(cmd)
-		fatalIfCmdErr(err, "certutil -A -d "+profile, out)
+		if native {
+			fatalIfStoreErr("nss", m.installNSSNative(profile), "failed to install the local CA in "+profile)
+			return
+		}
+		cmd := exec.Command(certutilPath, "-A", "-d", profile, "-t", "C,,", "-n", m.caUniqueName(), "-i", m.caCertPath())
+		out, err := execCertutil(m.context(), cmd)
+		fatalIfStoreCmdErr("nss", err, "certutil -A -d "+profile, out)
 	}) == 0 {
 		log.Printf("ERROR: no %s security databases found", NSSBrowsers)
 		return false
 	}
 	if !m.checkNSS() {
-		log.Printf("Installing in %s failed. Please report the issue with details about your environment at https://github.com/FiloSottile/mkcert/issues/new 👎", NSSBrowsers)
-		log.Printf("Note that if you never started %s, you need to do that at least once.", NSSBrowsers)
+		m.logf("Installing in %s failed. Please report the issue with details about your environment at https://github.com/FiloSottile/mkcert/issues/new 👎", NSSBrowsers)
+		m.logf("Note that if you never started %s, you need to do that at least once.", NSSBrowsers)
 		return false
 	}
 	return true
 }
 
 func (m *mkcert) uninstallNSS() {
+	native := m.useNativeNSS()
 	m.forEachNSSProfile(func(profile string) {
-		err := exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()).Run()
+		if native {
+			if !strings.HasPrefix(profile, "sql:") {
+				return // never installed by installNSSNative
+			}
+			fatalIfStoreErr("nss", m.uninstallNSSNative(profile), "failed to uninstall the local CA from "+profile)
+			return
+		}
+		_, err := runCommand(m.context(), exec.Command(certutilPath, "-V", "-d", profile, "-u", "L", "-n", m.caUniqueName()))
 		if err != nil {
 			return
 		}
 		cmd := exec.Command(certutilPath, "-D", "-d", profile, "-n", m.caUniqueName())
-		out, err := execCertutil(cmd)
-		fatalIfCmdErr(err, "certutil -D -d "+profile, out)
+		out, err := execCertutil(m.context(), cmd)
+		fatalIfStoreCmdErr("nss", err, "certutil -D -d "+profile, out)
 	})
 }
 
 // execCertutil will execute a "certutil" command and if needed re-execute
 // the command with commandWithSudo to work around file permissions.
-func execCertutil(cmd *exec.Cmd) ([]byte, error) {
-	out, err := cmd.CombinedOutput()
-	if err != nil && bytes.Contains(out, []byte("SEC_ERROR_READ_ONLY")) && runtime.GOOS != "windows" {
+// Transient failures, like a database locked by a running browser, are retried.
+func execCertutil(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	out, err := runCommandWithRetry(ctx, cmd, nssRetryPolicy)
+	if err != nil && bytes.Contains(out, []byte("SEC_ERROR_READ_ONLY")) && runtime.GOOS != "windows" && !noSudo {
 		origArgs := cmd.Args[1:]
 		cmd = commandWithSudo(cmd.Path)
 		cmd.Args = append(cmd.Args, origArgs...)
-		out, err = cmd.CombinedOutput()
+		out, err = runCommandWithRetry(ctx, cmd, nssRetryPolicy)
 	}
 	return out, err
 }
 
+// globEscape escapes the filepath.Match metacharacters in a literal path
+// prefix, like a home directory, that will be used to build a pattern.
+func globEscape(path string) string {
+	if runtime.GOOS == "windows" {
+		// Backslash is the path separator, and can't be used to escape.
+		// Brackets are the only metacharacters allowed in Windows paths.
+		return strings.NewReplacer("[", "[[]").Replace(path)
+	}
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(path)
+}
+
+// forEachNSSProfile calls f concurrently for each NSS database, or only for
+// the one selected with -nss-profile, so f must be safe for concurrent use.
 func (m *mkcert) forEachNSSProfile(f func(profile string)) (found int) {
-	profiles, _ := filepath.Glob(FirefoxProfile)
-	profiles = append(profiles, nssDBs...)
-	for _, profile := range profiles {
-		if stat, err := os.Stat(profile); err != nil || !stat.IsDir() {
-			continue
+	dbs := nssProfiles()
+	if m.nssProfile != "" {
+		db := nssDB(m.nssProfile)
+		if db == "" {
+			log.Fatalf("ERROR: no NSS database (cert9.db or cert8.db) found in %q", m.nssProfile)
+		}
+		dbs = []string{db}
+	}
+	if m.userOnly {
+		dbs = userNSSDBs(dbs)
+	}
+	var fs []func()
+	for _, db := range dbs {
+		db := db
+		fs = append(fs, func() { f(db) })
+	}
+	runParallel(fs...)
+	return len(fs)
+}
+
+// userNSSDBs filters out the system-wide databases, like /etc/pki/nssdb.
+func userNSSDBs(dbs []string) []string {
+	home := homeDir()
+	var user []string
+	for _, db := range dbs {
+		dir := strings.TrimPrefix(strings.TrimPrefix(db, "sql:"), "dbm:")
+		if home != "" && strings.HasPrefix(dir, home+string(filepath.Separator)) {
+			user = append(user, db)
 		}
-		if pathExists(filepath.Join(profile, "cert9.db")) {
-			f("sql:" + profile)
-			found++
-		} else if pathExists(filepath.Join(profile, "cert8.db")) {
-			f("dbm:" + profile)
-			found++
+	}
+	return user
+}
+
+// An nssProfileSource is a glob matching NSS profile directories, and the
+// name that selects them in TRUST_STORES.
+type nssProfileSource struct {
+	store string
+	glob  string
+}
+
+// nssStoreEnabled reports whether TRUST_STORES selects any NSS database, or
+// only sandboxed ones that exist.
+func nssStoreEnabled() bool {
+	if storeEnabled("nss") {
+		return true
+	}
+	for _, s := range sandboxedNSSProfiles {
+		if matches, _ := filepath.Glob(s.glob); storeSelected(s.store) && len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nssDB returns the certutil database name for the profile directory, or an
+// empty string if it doesn't contain an NSS database.
+func nssDB(profile string) string {
+	if stat, err := os.Stat(profile); err != nil || !stat.IsDir() {
+		return ""
+	}
+	if pathExists(filepath.Join(profile, "cert9.db")) {
+		return "sql:" + profile
+	} else if pathExists(filepath.Join(profile, "cert8.db")) {
+		return "dbm:" + profile
+	}
+	return ""
+}
+
+// nssProfileCache holds the databases found by nssProfiles, and the stamps of
+// the directories they were looked for in. Adding a profile or a database
+// changes the modification time of its parent directory, invalidating it.
+var nssProfileCache struct {
+	sync.Mutex
+	dbs    []string
+	stamps map[string]fileStamp
+}
+
+// nssProfiles returns the NSS databases of all the Firefox and
+// Chrome/Chromium profiles, walking the profile directories only if they
+// changed since the last call.
+func nssProfiles() []string {
+	nssProfileCache.Lock()
+	defer nssProfileCache.Unlock()
+	if stamps := nssProfileCache.stamps; stamps != nil {
+		valid := true
+		for dir, stamp := range stamps {
+			if stampFile(dir) != stamp {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return nssProfileCache.dbs
+		}
+	}
+
+	stamps := make(map[string]fileStamp)
+	var profiles []string
+	addGlob := func(glob string) {
+		parents, _ := filepath.Glob(filepath.Dir(glob))
+		for _, parent := range parents {
+			stamps[parent] = stampFile(parent)
+		}
+		matches, _ := filepath.Glob(glob)
+		profiles = append(profiles, matches...)
+	}
+	if storeEnabled("nss") {
+		addGlob(FirefoxProfile)
+		profiles = append(profiles, nssDBs...)
+	}
+	for _, s := range sandboxedNSSProfiles {
+		if storeEnabled("nss") || storeSelected(s.store) {
+			addGlob(s.glob)
+		}
+	}
+	var dbs []string
+	for _, profile := range profiles {
+		stamps[profile] = stampFile(profile)
+		if db := nssDB(profile); db != "" {
+			dbs = append(dbs, db)
 		}
 	}
-	return
+	nssProfileCache.dbs, nssProfileCache.stamps = dbs, stamps
+	return dbs
 }
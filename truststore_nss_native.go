@@ -0,0 +1,531 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// nssSQLiteDriver is the database/sql driver used to edit NSS databases
+// without certutil. It's set in truststore_nss_sqlite.go on the platforms
+// supported by the pure-Go SQLite implementation, and empty elsewhere.
+var nssSQLiteDriver string
+
+// useNativeNSS reports whether NSS databases are edited directly, because of
+// -nss-native or because certutil is not available.
+func (m *mkcert) useNativeNSS() bool {
+	return nssSQLiteDriver != "" && (m.nssNative || !hasCertutil)
+}
+
+// canManageNSS reports whether the CA can be installed in NSS databases at
+// all, with certutil or directly.
+func canManageNSS() bool {
+	return hasCertutil || nssSQLiteDriver != ""
+}
+
+// PKCS #11 attributes and values used by the NSS softoken, from pkcs11t.h and
+// pkcs11n.h. In the databases, CK_ULONG values are stored as four bytes in
+// network order, and the attributes are the columns named "a" followed by
+// their hex value.
+const (
+	ckaClass           = 0x00000000
+	ckaToken           = 0x00000001
+	ckaPrivate         = 0x00000002
+	ckaLabel           = 0x00000003
+	ckaValue           = 0x00000011
+	ckaCertificateType = 0x00000080
+	ckaIssuer          = 0x00000081
+	ckaSerialNumber    = 0x00000082
+	ckaSubject         = 0x00000101
+	ckaID              = 0x00000102
+	ckaModifiable      = 0x00000170
+
+	ckaTrustServerAuth      = 0xce536358
+	ckaTrustClientAuth      = 0xce536359
+	ckaTrustCodeSigning     = 0xce53635a
+	ckaTrustEmailProtection = 0xce53635b
+	ckaTrustStepUpApproved  = 0xce536360
+	ckaCertSHA1Hash         = 0xce5363b4
+	ckaCertMD5Hash          = 0xce5363b5
+
+	ckoCertificate = 0x00000001
+	ckoNSSTrust    = 0xce534353
+	ckcX509        = 0x00000000
+
+	cktNSSTrustedDelegator = 0xce534352
+	cktNSSMustVerifyTrust  = 0xce534353
+	cktNSSValidDelegator   = 0xce53435b
+)
+
+// nssAuthenticatedAttributes are the trust attributes that NSS only honors if
+// they are signed with the key database password, see nssSignAttribute.
+var nssAuthenticatedAttributes = []uint32{
+	ckaTrustServerAuth, ckaTrustClientAuth, ckaTrustCodeSigning,
+	ckaTrustEmailProtection, ckaTrustStepUpApproved, ckaCertSHA1Hash, ckaCertMD5Hash,
+}
+
+// nssExplicitNull is how NSS stores empty attribute values.
+var nssExplicitNull = []byte{0xa5, 0x00, 0x5a}
+
+func nssULong(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+type nssAttribute struct {
+	typ   uint32
+	value []byte
+}
+
+// nssObjects returns the certificate and trust objects that
+// "certutil -A -t C,," would add for the local CA.
+func (m *mkcert) nssObjects() (certObj, trustObj []nssAttribute, err error) {
+	ca := m.caCert
+	serial, err := asn1.Marshal(ca.SerialNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+	id := sha1.Sum(spki.PublicKey.Bytes)
+	sha1Hash, md5Hash := sha1.Sum(ca.Raw), md5.Sum(ca.Raw)
+
+	certObj = []nssAttribute{
+		{ckaClass, nssULong(ckoCertificate)},
+		{ckaToken, []byte{1}},
+		{ckaPrivate, []byte{0}},
+		{ckaModifiable, []byte{1}},
+		{ckaLabel, []byte(m.caUniqueName())},
+		{ckaCertificateType, nssULong(ckcX509)},
+		{ckaSubject, ca.RawSubject},
+		{ckaIssuer, ca.RawIssuer},
+		{ckaSerialNumber, serial},
+		{ckaID, id[:]},
+		{ckaValue, ca.Raw},
+	}
+	trustObj = []nssAttribute{
+		{ckaClass, nssULong(ckoNSSTrust)},
+		{ckaToken, []byte{1}},
+		{ckaPrivate, []byte{0}},
+		{ckaModifiable, []byte{1}},
+		{ckaLabel, nssExplicitNull},
+		{ckaIssuer, ca.RawIssuer},
+		{ckaSerialNumber, serial},
+		{ckaTrustServerAuth, nssULong(cktNSSTrustedDelegator)},
+		{ckaTrustClientAuth, nssULong(cktNSSValidDelegator)},
+		{ckaTrustCodeSigning, nssULong(cktNSSMustVerifyTrust)},
+		{ckaTrustEmailProtection, nssULong(cktNSSMustVerifyTrust)},
+		{ckaTrustStepUpApproved, []byte{0}},
+		{ckaCertSHA1Hash, sha1Hash[:]},
+		{ckaCertMD5Hash, md5Hash[:]},
+	}
+	return certObj, trustObj, nil
+}
+
+// nssAttr returns the attribute of type typ of the object attrs.
+func nssAttr(attrs []nssAttribute, typ uint32) (nssAttribute, error) {
+	for _, a := range attrs {
+		if a.typ == typ {
+			return a, nil
+		}
+	}
+	return nssAttribute{}, fmt.Errorf("the NSS object is missing the attribute 0x%x", typ)
+}
+
+// openNSSDatabases opens cert9.db and key4.db in the directory of the "sql:"
+// database db. Legacy "dbm:" databases are not supported.
+func openNSSDatabases(db string) (certDB, keyDB *sql.DB, err error) {
+	if !strings.HasPrefix(db, "sql:") {
+		return nil, nil, errors.New("only cert9.db databases can be edited without certutil")
+	}
+	dir := strings.TrimPrefix(db, "sql:")
+	if !pathExists(filepath.Join(dir, "key4.db")) {
+		return nil, nil, errors.New("key4.db is missing")
+	}
+	if certDB, err = openNSSSQLite(filepath.Join(dir, "cert9.db")); err != nil {
+		return nil, nil, err
+	}
+	if keyDB, err = openNSSSQLite(filepath.Join(dir, "key4.db")); err != nil {
+		certDB.Close()
+		return nil, nil, err
+	}
+	return certDB, keyDB, nil
+}
+
+func openNSSSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open(nssSQLiteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// The database might be locked by a running browser for a moment.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// nssObjectIDs returns the IDs of the objects in cert9.db that match obj in
+// all the attributes of the given types.
+func nssObjectIDs(tx *sql.Tx, obj []nssAttribute, types ...uint32) ([]uint32, error) {
+	var where []string
+	var args []interface{}
+	for _, typ := range types {
+		a, err := nssAttr(obj, typ)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, fmt.Sprintf("a%x = ?", a.typ))
+		args = append(args, a.value)
+	}
+	rows, err := tx.Query("SELECT id FROM nssPublic WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uint32
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, rows.Err()
+}
+
+// checkNSSNative reports whether the local CA and its trust are in db.
+func (m *mkcert) checkNSSNative(db string) bool {
+	certDB, keyDB, err := openNSSDatabases(db)
+	if err != nil {
+		return false
+	}
+	defer certDB.Close()
+	defer keyDB.Close()
+	certObj, trustObj, err := m.nssObjects()
+	if err != nil {
+		return false
+	}
+	tx, err := certDB.Begin()
+	if err != nil {
+		return false
+	}
+	defer tx.Rollback()
+	certs, err := nssObjectIDs(tx, certObj, ckaClass, ckaValue)
+	if err != nil || len(certs) == 0 {
+		return false
+	}
+	trusts, err := nssObjectIDs(tx, trustObj, ckaClass, ckaIssuer, ckaSerialNumber, ckaTrustServerAuth)
+	return err == nil && len(trusts) != 0
+}
+
+// installNSSNative adds the local CA to db like "certutil -A -t C,," would,
+// by inserting the certificate and trust objects in cert9.db, and the trust
+// signatures in key4.db. The latter is only written once the former is
+// committed, so that a failure never leaves a trust object behind without its
+// signatures, which NSS would silently ignore.
+func (m *mkcert) installNSSNative(db string) error {
+	certDB, keyDB, err := openNSSDatabases(db)
+	if err != nil {
+		return err
+	}
+	defer certDB.Close()
+	defer keyDB.Close()
+	passKey, err := nssPasswordKey(keyDB)
+	if err != nil {
+		return err
+	}
+	certObj, trustObj, err := m.nssObjects()
+	if err != nil {
+		return err
+	}
+
+	tx, err := certDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	oldTrusts, err := m.deleteNSSObjects(tx)
+	if err != nil {
+		return err
+	}
+	if _, err := insertNSSObject(tx, certObj); err != nil {
+		return err
+	}
+	trustID, err := insertNSSObject(tx, trustObj)
+	if err != nil {
+		return err
+	}
+	sigs := make(map[string][]byte)
+	for _, a := range trustObj {
+		if !isNSSAuthenticatedAttribute(a.typ) {
+			continue
+		}
+		sig, err := nssSignAttribute(passKey, trustID, a)
+		if err != nil {
+			return err
+		}
+		sigs[nssSignatureID(trustID, a.typ)] = sig
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	keyTx, err := keyDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer keyTx.Rollback()
+	if err := deleteNSSSignatures(keyTx, oldTrusts); err != nil {
+		return err
+	}
+	for id, sig := range sigs {
+		if _, err := keyTx.Exec("INSERT OR REPLACE INTO metaData (id, item1) VALUES (?, ?)", id, sig); err != nil {
+			return err
+		}
+	}
+	return keyTx.Commit()
+}
+
+// uninstallNSSNative removes the local CA and its trust from db.
+func (m *mkcert) uninstallNSSNative(db string) error {
+	certDB, keyDB, err := openNSSDatabases(db)
+	if err != nil {
+		return err
+	}
+	defer certDB.Close()
+	defer keyDB.Close()
+	tx, err := certDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	trusts, err := m.deleteNSSObjects(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The signatures are only deleted once the trust objects are gone.
+	keyTx, err := keyDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer keyTx.Rollback()
+	if err := deleteNSSSignatures(keyTx, trusts); err != nil {
+		return err
+	}
+	return keyTx.Commit()
+}
+
+// deleteNSSObjects deletes the certificate and trust objects of the local CA,
+// and returns the IDs of the latter, whose signatures in key4.db must be
+// deleted with deleteNSSSignatures once tx is committed.
+func (m *mkcert) deleteNSSObjects(tx *sql.Tx) (trusts []uint32, err error) {
+	certObj, trustObj, err := m.nssObjects()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := nssObjectIDs(tx, certObj, ckaClass, ckaValue)
+	if err != nil {
+		return nil, err
+	}
+	trusts, err = nssObjectIDs(tx, trustObj, ckaClass, ckaIssuer, ckaSerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range append(certs, trusts...) {
+		if _, err := tx.Exec("DELETE FROM nssPublic WHERE id = ?", int64(id)); err != nil {
+			return nil, err
+		}
+	}
+	return trusts, nil
+}
+
+// deleteNSSSignatures deletes the signatures of the trust objects with the
+// given IDs from key4.db.
+func deleteNSSSignatures(keyTx *sql.Tx, trusts []uint32) error {
+	for _, id := range trusts {
+		for _, typ := range nssAuthenticatedAttributes {
+			if _, err := keyTx.Exec("DELETE FROM metaData WHERE id = ?", nssSignatureID(id, typ)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertNSSObject inserts an object with a new random ID, like NSS does.
+func insertNSSObject(tx *sql.Tx, attrs []nssAttribute) (uint32, error) {
+	var id uint32
+	for id == 0 {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		id = binary.BigEndian.Uint32(b[:]) & 0x3fffffff
+		var n int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM nssPublic WHERE id = ?", int64(id)).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n != 0 {
+			id = 0
+		}
+	}
+	columns, placeholders := []string{"id"}, []string{"?"}
+	args := []interface{}{int64(id)}
+	for _, a := range attrs {
+		columns = append(columns, fmt.Sprintf("a%x", a.typ))
+		placeholders = append(placeholders, "?")
+		args = append(args, a.value)
+	}
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO nssPublic (%s) VALUES (%s)",
+		strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args...)
+	return id, err
+}
+
+func isNSSAuthenticatedAttribute(typ uint32) bool {
+	for _, t := range nssAuthenticatedAttributes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func nssSignatureID(objectID, typ uint32) string {
+	return fmt.Sprintf("sig_cert_%08x_%08x", objectID, typ)
+}
+
+var (
+	oidPBMAC1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 14}
+	nssPasswordTest = []byte("password-check")
+)
+
+type nssPBKDF2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type nssPBMAC1Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	MessageAuthScheme pkix.AlgorithmIdentifier
+}
+
+// nssPasswordKey returns the key derived from the empty password of the key
+// database, after checking that there is no primary password, as otherwise
+// the trust signatures would not be valid.
+func nssPasswordKey(keyDB *sql.DB) ([]byte, error) {
+	var salt, check []byte
+	err := keyDB.QueryRow("SELECT item1, item2 FROM metaData WHERE id = 'password'").Scan(&salt, &check)
+	if err != nil {
+		return nil, errors.New("the database is not initialized, start the browser at least once")
+	}
+	passKey := sha1.Sum(salt) // SHA-1(global salt || password)
+
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf nssPBKDF2Params
+	var iv []byte
+	errUnsupported := errors.New("the database password check uses unsupported algorithms, use certutil instead")
+	if _, err := asn1.Unmarshal(check, &info); err != nil || !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errUnsupported
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil ||
+		!params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errUnsupported
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil ||
+		!kdf.PRF.Algorithm.Equal(oidHMACSHA256) {
+		return nil, errUnsupported
+	}
+	// Like for encrypted keys, the iteration count comes from the file.
+	if kdf.IterationCount < 1 || kdf.IterationCount > maxPKCS8Iterations {
+		return nil, errUnsupported
+	}
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errUnsupported
+	}
+	if len(iv) == aes.BlockSize-2 {
+		// NSS encodes the IV without its first two bytes, which are always
+		// the DER header of a 14 bytes OCTET STRING.
+		iv = append([]byte{0x04, 0x0e}, iv...)
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errUnsupported
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passKey[:], kdf.Salt, kdf.IterationCount, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+	if !bytes.HasPrefix(plaintext, nssPasswordTest) {
+		return nil, errors.New("the database is protected by a primary password, use certutil instead")
+	}
+	return passKey[:], nil
+}
+
+// nssSignAttribute returns the PBMAC1 signature of an authenticated attribute
+// of the object with the given ID, as NSS stores it in the key database.
+func nssSignAttribute(passKey []byte, objectID uint32, a nssAttribute) ([]byte, error) {
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	const iterations = 1 // what NSS uses with an empty password
+	mac := hmac.New(sha256.New, pbkdf2.Key(passKey, salt, iterations, sha256.Size, sha256.New))
+	mac.Write(nssULong(objectID))
+	mac.Write(nssULong(a.typ))
+	mac.Write(a.value)
+
+	hmacSHA256 := pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256}
+	kdfParams, err := asn1.Marshal(nssPBKDF2Params{
+		Salt: salt, IterationCount: iterations, KeyLength: sha256.Size, PRF: hmacSHA256,
+	})
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(nssPBMAC1Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		MessageAuthScheme: hmacSHA256,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBMAC1, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: mac.Sum(nil),
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyNSSFixture copies testdata/nssdb, an empty database created by NSS
+// with an empty password, to a temporary directory, and returns it as a
+// "sql:" database.
+func copyNSSFixture(t *testing.T) string {
+	if nssSQLiteDriver == "" {
+		t.Skip("no SQLite driver on this platform")
+	}
+	dir, err := ioutil.TempDir("", "mkcert-nssdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for _, name := range []string{"cert9.db", "key4.db"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "nssdb", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return "sql:" + dir
+}
+
+func countNSSRows(t *testing.T, path, query string) int {
+	db, err := sql.Open(nssSQLiteDriver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(query).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNSSNativeRoundTrip(t *testing.T) {
+	m := newTestCA(t)
+	db := copyNSSFixture(t)
+	dir := strings.TrimPrefix(db, "sql:")
+	certDB, keyDB := filepath.Join(dir, "cert9.db"), filepath.Join(dir, "key4.db")
+
+	if m.checkNSSNative(db) {
+		t.Fatal("the CA is installed in the empty database")
+	}
+	// Installing twice must replace the objects, not add more.
+	for i := 0; i < 2; i++ {
+		if err := m.installNSSNative(db); err != nil {
+			t.Fatalf("install: %v", err)
+		}
+	}
+	if !m.checkNSSNative(db) {
+		t.Fatal("the CA is not installed after installNSSNative")
+	}
+	if n := countNSSRows(t, certDB, "SELECT COUNT(*) FROM nssPublic"); n != 2 {
+		t.Errorf("cert9.db has %d objects, want a certificate and a trust object", n)
+	}
+	if n := countNSSRows(t, keyDB, "SELECT COUNT(*) FROM metaData WHERE id LIKE 'sig_cert_%'"); n != len(nssAuthenticatedAttributes) {
+		t.Errorf("key4.db has %d signatures, want %d", n, len(nssAuthenticatedAttributes))
+	}
+
+	if _, err := exec.LookPath("certutil"); err == nil {
+		out, err := exec.Command("certutil", "-V", "-d", db, "-n", m.caUniqueName(), "-u", "L").CombinedOutput()
+		if err != nil {
+			t.Errorf("certutil doesn't trust the CA: %v\n%s", err, out)
+		}
+	} else {
+		t.Log("certutil not found, skipping the NSS verification")
+	}
+
+	if err := m.uninstallNSSNative(db); err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if m.checkNSSNative(db) {
+		t.Error("the CA is still installed after uninstallNSSNative")
+	}
+	if n := countNSSRows(t, certDB, "SELECT COUNT(*) FROM nssPublic"); n != 0 {
+		t.Errorf("cert9.db has %d objects left", n)
+	}
+	if n := countNSSRows(t, keyDB, "SELECT COUNT(*) FROM metaData WHERE id LIKE 'sig_cert_%'"); n != 0 {
+		t.Errorf("key4.db has %d signatures left", n)
+	}
+}
+
+func TestNSSPasswordKeyIterations(t *testing.T) {
+	db := copyNSSFixture(t)
+	keyDB, err := sql.Open(nssSQLiteDriver, filepath.Join(strings.TrimPrefix(db, "sql:"), "key4.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyDB.Close()
+	if _, err := nssPasswordKey(keyDB); err != nil {
+		t.Fatalf("nssPasswordKey: %v", err)
+	}
+
+	// Rewrite the iteration count of the password check.
+	var check []byte
+	if err := keyDB.QueryRow("SELECT item2 FROM metaData WHERE id = 'password'").Scan(&check); err != nil {
+		t.Fatal(err)
+	}
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf nssPBKDF2Params
+	if _, err := asn1.Unmarshal(check, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, -1, maxPKCS8Iterations + 1} {
+		kdf.IterationCount = n
+		kdfBytes, err := asn1.Marshal(kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.KeyDerivationFunc.Parameters = asn1.RawValue{FullBytes: kdfBytes}
+		paramsBytes, err := asn1.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info.Algorithm.Parameters = asn1.RawValue{FullBytes: paramsBytes}
+		tampered, err := asn1.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keyDB.Exec("UPDATE metaData SET item2 = ? WHERE id = 'password'", tampered); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nssPasswordKey(keyDB); err == nil {
+			t.Errorf("nssPasswordKey accepted %d iterations", n)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build (linux && 386) || (linux && amd64) || (linux && arm) || (linux && arm64) || (linux && ppc64le) || (linux && riscv64) || (linux && s390x) || darwin || (windows && 386) || (windows && amd64) || (windows && arm64) || freebsd || (openbsd && amd64) || (openbsd && arm64)
+// +build linux,386 linux,amd64 linux,arm linux,arm64 linux,ppc64le linux,riscv64 linux,s390x darwin windows,386 windows,amd64 windows,arm64 freebsd openbsd,amd64 openbsd,arm64
+
+package main
+
+import _ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+
+func init() {
+	nssSQLiteDriver = "sqlite"
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestGlobEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		home string
+	}{
+		{"plain", "user"},
+		{"spaces", "John Smith"},
+		{"unicode", "Jöhn 日本"},
+		{"brackets", "user [work]"},
+		{"metacharacters", "a*b?c"},
+		{"backslash", `back\slash`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && (tt.name == "metacharacters" || tt.name == "backslash") {
+				t.Skip("not valid in Windows paths")
+			}
+			tmp, err := ioutil.TempDir("", "mkcert-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			// Siblings that an unescaped pattern would also match.
+			for _, home := range []string{tt.home, "user w", "aXbYc"} {
+				profile := filepath.Join(tmp, home, ".mozilla", "firefox", "abc.default")
+				if err := os.MkdirAll(profile, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pattern := filepath.Join(globEscape(filepath.Join(tmp, tt.home)), ".mozilla", "firefox", "*")
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				t.Fatalf("Glob(%q): %v", pattern, err)
+			}
+			want := filepath.Join(tmp, tt.home, ".mozilla", "firefox", "abc.default")
+			if len(matches) != 1 || matches[0] != want {
+				t.Errorf("Glob(%q) = %q, want [%q]", pattern, matches, want)
+			}
+		})
+	}
+}
+
+func TestGlobEscapeSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	tmp, err := ioutil.TempDir("", "mkcert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	target := filepath.Join(tmp, "real home [1]")
+	if err := os.MkdirAll(filepath.Join(target, ".mozilla", "firefox", "abc.default"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, ".mozilla", "firefox", "abc.default", "cert9.db"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(tmp, "linked hôme [2]")
+	if err := os.Symlink(target, home); err != nil {
+		t.Fatal(err)
+	}
+
+	pattern := filepath.Join(globEscape(home), ".mozilla", "firefox", "*")
+	matches, _ := filepath.Glob(pattern)
+	if len(matches) != 1 {
+		t.Fatalf("Glob(%q) = %q, want one profile", pattern, matches)
+	}
+	if db := nssDB(matches[0]); db != "sql:"+matches[0] {
+		t.Errorf("nssDB(%q) = %q, want the sql: database", matches[0], db)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !freebsd && !linux && !openbsd && !windows
+// +build !darwin,!freebsd,!linux,!openbsd,!windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var (
+	FirefoxProfile      = filepath.Join(globEscape(os.Getenv("HOME")), ".mozilla", "firefox", "*")
+	CertutilInstallHelp = "" // NSS support is not implemented on this platform
+	NSSBrowsers         = "Firefox and/or Chrome/Chromium"
+)
+
+func init() {
+	hasSystemStore = false
+}
+
+func (m *mkcert) installPlatform() bool {
+	m.logf("Installing to the system trust store is not supported on GOOS=%s 😣 but certificate issuance still works.", runtime.GOOS)
+	m.logf("You can manually install the root certificate at %q.", m.caCertPath())
+	return false
+}
+
+func (m *mkcert) uninstallPlatform() bool {
+	return false
+}
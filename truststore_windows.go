@@ -5,133 +5,214 @@
 package main
 
 import (
-	"crypto/x509"
-	"encoding/pem"
+	"bytes"
 	"fmt"
-	"io/ioutil"
-	"math/big"
+	"log"
 	"os"
 	"path/filepath"
-	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/windows"
 )
 
 var (
-	FirefoxProfile      = os.Getenv("USERPROFILE") + "\\AppData\\Roaming\\Mozilla\\Firefox\\Profiles"
+	FirefoxProfile      = filepath.Join(globEscape(os.Getenv("USERPROFILE")), "AppData", "Roaming", "Mozilla", "Firefox", "Profiles")
 	CertutilInstallHelp = "" // certutil unsupported on Windows
 	NSSBrowsers         = "Firefox"
 )
 
+func init() {
+	checkSystemStore = (*mkcert).checkWindowsStores
+	installPersonalCert = installWindowsPersonalCert
+}
+
+// windowsStore is the location of a Trusted Root Certification Authorities
+// store. The LocalMachine store applies to all users, but can only be
+// modified by administrators. The CurrentUser store also shows the
+// LocalMachine certificates, and adding to it shows a confirmation dialog.
+type windowsStore struct {
+	name  string
+	flags uint32
+}
+
 var (
-	modcrypt32                           = syscall.NewLazyDLL("crypt32.dll")
-	procCertAddEncodedCertificateToStore = modcrypt32.NewProc("CertAddEncodedCertificateToStore")
-	procCertCloseStore                   = modcrypt32.NewProc("CertCloseStore")
-	procCertDeleteCertificateFromStore   = modcrypt32.NewProc("CertDeleteCertificateFromStore")
-	procCertDuplicateCertificateContext  = modcrypt32.NewProc("CertDuplicateCertificateContext")
-	procCertEnumCertificatesInStore      = modcrypt32.NewProc("CertEnumCertificatesInStore")
-	procCertOpenSystemStoreW             = modcrypt32.NewProc("CertOpenSystemStoreW")
+	windowsCurrentUserRoot  = windowsStore{"CurrentUser", windows.CERT_SYSTEM_STORE_CURRENT_USER}
+	windowsLocalMachineRoot = windowsStore{"LocalMachine", windows.CERT_SYSTEM_STORE_LOCAL_MACHINE}
 )
 
-func (m *mkcert) installPlatform() bool {
-	// Load cert
-	cert, err := ioutil.ReadFile(filepath.Join(m.CAROOT, rootName))
-	fatalIfErr(err, "failed to read root certificate")
-	// Decode PEM
-	if certBlock, _ := pem.Decode(cert); certBlock == nil || certBlock.Type != "CERTIFICATE" {
-		fatalIfErr(fmt.Errorf("invalid PEM data"), "decode pem")
-	} else {
-		cert = certBlock.Bytes
+// installStore returns the LocalMachine store when running as administrator,
+// and the CurrentUser one otherwise or with -user-only.
+func (m *mkcert) installStore() windowsStore {
+	if !m.userOnly && windows.GetCurrentProcessToken().IsElevated() {
+		return windowsLocalMachineRoot
 	}
-	// Open root store
-	store, err := openWindowsRootStore()
-	fatalIfErr(err, "open root store")
+	return windowsCurrentUserRoot
+}
+
+func (m *mkcert) installPlatform() bool {
+	location := m.installStore()
+	store, err := openWindowsRootStore(location, false)
+	fatalIfStoreErr("system", err, "failed to open the root store")
 	defer store.close()
-	// Add cert
-	fatalIfErr(store.addCert(cert), "add cert")
+	fatalIfStoreErr("system", store.addCert(m.caCert.Raw), "failed to add the local CA to the "+location.name+" root store")
+	// Make sure it landed, as the store can silently drop it under policy
+	found, err := store.hasCert(m.caCert.Raw)
+	fatalIfStoreErr("system", err, "failed to check the root store")
+	if !found {
+		log.Fatalf("ERROR: the local CA was not found in the %s root store after adding it", location.name)
+	}
 	return true
 }
 
 func (m *mkcert) uninstallPlatform() bool {
-	// We'll just remove all certs with the same serial number
-	// Open root store
-	store, err := openWindowsRootStore()
-	fatalIfErr(err, "open root store")
-	defer store.close()
-	// Do the deletion
-	deletedAny, err := store.deleteCertsWithSerial(m.caCert.SerialNumber)
-	if err == nil && !deletedAny {
-		err = fmt.Errorf("no certs found")
+	locations := []windowsStore{windowsLocalMachineRoot, windowsCurrentUserRoot}
+	if m.userOnly {
+		locations = locations[1:]
 	}
-	fatalIfErr(err, "delete cert")
-	return true
+	deletedAny := false
+	for _, location := range locations {
+		if !m.inWindowsStore(location) {
+			continue
+		}
+		store, err := openWindowsRootStore(location, false)
+		if err != nil {
+			log.Fatalf("ERROR: failed to open the %s root store: %s\n\nRun \"mkcert -uninstall\" as administrator to remove the local CA for all users 👈", location.name, err)
+		}
+		// Remove exactly our root, not other certs that happen to share a serial
+		deleted, err := store.deleteCert(m.caCert.Raw)
+		store.close()
+		fatalIfStoreErr("system", err, "failed to remove the local CA from the "+location.name+" root store")
+		deletedAny = deletedAny || deleted
+	}
+	return deletedAny
+}
+
+// checkWindowsStores reports whether the local CA is in the CurrentUser root
+// store, which includes the LocalMachine one. Unlike crypto/x509, it reflects
+// the changes made by installPlatform.
+func (m *mkcert) checkWindowsStores() bool {
+	return m.inWindowsStore(windowsCurrentUserRoot)
+}
+
+func (m *mkcert) inWindowsStore(location windowsStore) bool {
+	store, err := openWindowsRootStore(location, true)
+	if err != nil {
+		return false
+	}
+	defer store.close()
+	found, err := store.hasCert(m.caCert.Raw)
+	return err == nil && found
 }
 
-type windowsRootStore uintptr
+// cryptENotFound (CRYPT_E_NOT_FOUND) marks the end of an enumeration.
+const cryptENotFound = 0x80092004
+
+type windowsRootStore windows.Handle
 
-func openWindowsRootStore() (windowsRootStore, error) {
-	rootStr, err := syscall.UTF16PtrFromString("ROOT")
+func openWindowsRootStore(location windowsStore, readOnly bool) (windowsRootStore, error) {
+	rootStr, err := windows.UTF16PtrFromString("ROOT")
 	if err != nil {
 		return 0, err
 	}
-	store, _, err := procCertOpenSystemStoreW.Call(0, uintptr(unsafe.Pointer(rootStr)))
-	if store != 0 {
-		return windowsRootStore(store), nil
+	flags := location.flags | windows.CERT_STORE_OPEN_EXISTING_FLAG
+	if readOnly {
+		flags |= windows.CERT_STORE_READONLY_FLAG
 	}
-	return 0, fmt.Errorf("failed to open windows root store: %v", err)
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM, 0, 0, flags, uintptr(unsafe.Pointer(rootStr)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open the %s root store: %v", location.name, err)
+	}
+	return windowsRootStore(store), nil
 }
 
 func (w windowsRootStore) close() error {
-	ret, _, err := procCertCloseStore.Call(uintptr(w), 0)
-	if ret != 0 {
-		return nil
-	}
-	return fmt.Errorf("failed to close windows root store: %v", err)
+	return windows.CertCloseStore(windows.Handle(w), 0)
 }
 
 func (w windowsRootStore) addCert(cert []byte) error {
-	// TODO: ok to always overwrite?
-	ret, _, err := procCertAddEncodedCertificateToStore.Call(
-		uintptr(w), // HCERTSTORE hCertStore
-		uintptr(syscall.X509_ASN_ENCODING|syscall.PKCS_7_ASN_ENCODING), // DWORD dwCertEncodingType
-		uintptr(unsafe.Pointer(&cert[0])),                              // const BYTE *pbCertEncoded
-		uintptr(len(cert)),                                             // DWORD cbCertEncoded
-		3,                                                              // DWORD dwAddDisposition (CERT_STORE_ADD_REPLACE_EXISTING is 3)
-		0,                                                              // PCCERT_CONTEXT *ppCertContext
-	)
-	if ret != 0 {
-		return nil
+	ctx, err := windows.CertCreateCertificateContext(windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, &cert[0], uint32(len(cert)))
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("failed adding cert: %v", err)
+	defer windows.CertFreeCertificateContext(ctx)
+	return windows.CertAddCertificateContextToStore(windows.Handle(w), ctx, windows.CERT_STORE_ADD_REPLACE_EXISTING, nil)
 }
 
-func (w windowsRootStore) deleteCertsWithSerial(serial *big.Int) (bool, error) {
-	// Go over each, deleting the ones we find
-	var cert *syscall.CertContext
-	deletedAny := false
+// forEachCert calls f with each certificate context in the store, stopping
+// early if f returns false.
+func (w windowsRootStore) forEachCert(f func(cert *windows.CertContext, der []byte) (bool, error)) error {
+	var cert *windows.CertContext
 	for {
-		// Next enum
-		certPtr, _, err := procCertEnumCertificatesInStore.Call(uintptr(w), uintptr(unsafe.Pointer(cert)))
-		if cert = (*syscall.CertContext)(unsafe.Pointer(certPtr)); cert == nil {
-			if errno, ok := err.(syscall.Errno); ok && errno == 0x80092004 {
-				break
+		var err error
+		cert, err = windows.CertEnumCertificatesInStore(windows.Handle(w), cert)
+		if cert == nil {
+			if errno, ok := err.(windows.Errno); ok && errno == cryptENotFound {
+				return nil
 			}
-			return deletedAny, fmt.Errorf("failed enumerating certs: %v", err)
+			return fmt.Errorf("failed enumerating certs: %v", err)
+		}
+		der := (*[1 << 20]byte)(unsafe.Pointer(cert.EncodedCert))[:cert.Length:cert.Length]
+		more, err := f(cert, der)
+		if err != nil || !more {
+			// Release the context the enumeration would have freed
+			windows.CertFreeCertificateContext(cert)
+			return err
 		}
-		// Parse cert
-		certBytes := (*[1 << 20]byte)(unsafe.Pointer(cert.EncodedCert))[:cert.Length]
-		parsedCert, err := x509.ParseCertificate(certBytes)
-		// We'll just ignore parse failures for now
-		if err == nil && parsedCert.SerialNumber != nil && parsedCert.SerialNumber.Cmp(serial) == 0 {
+	}
+}
+
+func (w windowsRootStore) hasCert(want []byte) (bool, error) {
+	found := false
+	err := w.forEachCert(func(_ *windows.CertContext, der []byte) (bool, error) {
+		found = bytes.Equal(der, want)
+		return !found, nil
+	})
+	return found, err
+}
+
+func (w windowsRootStore) deleteCert(want []byte) (bool, error) {
+	deletedAny := false
+	err := w.forEachCert(func(cert *windows.CertContext, der []byte) (bool, error) {
+		if bytes.Equal(der, want) {
 			// Duplicate the context so it doesn't stop the enum when we delete it
-			dupCertPtr, _, err := procCertDuplicateCertificateContext.Call(uintptr(unsafe.Pointer(cert)))
-			if dupCertPtr == 0 {
-				return deletedAny, fmt.Errorf("failed duplicating context: %v", err)
-			}
-			if ret, _, err := procCertDeleteCertificateFromStore.Call(dupCertPtr); ret == 0 {
-				return deletedAny, fmt.Errorf("failed deleting certificate: %v", err)
+			if err := windows.CertDeleteCertificateFromStore(windows.CertDuplicateCertificateContext(cert)); err != nil {
+				return false, fmt.Errorf("failed deleting certificate: %v", err)
 			}
 			deletedAny = true
 		}
+		return true, nil
+	})
+	return deletedAny, err
+}
+
+// installWindowsPersonalCert imports the certificate and key in pfx into the
+// CurrentUser "MY" store. The key is persisted by PFXImportCertStore, and
+// stays associated with the certificate copied to the store.
+func installWindowsPersonalCert(pfx []byte, password string) error {
+	pass, err := windows.UTF16PtrFromString(password)
+	if err != nil {
+		return err
+	}
+	blob := &windows.CryptDataBlob{Size: uint32(len(pfx)), Data: &pfx[0]}
+	tmp, err := windows.PFXImportCertStore(blob, pass, windows.CRYPT_USER_KEYSET|windows.PKCS12_ALLOW_OVERWRITE_KEY)
+	if err != nil {
+		return fmt.Errorf("failed to import the PKCS #12 file: %v", err)
+	}
+	defer windows.CertCloseStore(tmp, 0)
+	cert, err := windows.CertFindCertificateInStore(tmp, windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, 0, windows.CERT_FIND_ANY, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to import the PKCS #12 file: %v", err)
+	}
+	defer windows.CertFreeCertificateContext(cert)
+
+	myStr, err := windows.UTF16PtrFromString("MY")
+	if err != nil {
+		return err
+	}
+	my, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM, 0, 0, windows.CERT_SYSTEM_STORE_CURRENT_USER, uintptr(unsafe.Pointer(myStr)))
+	if err != nil {
+		return fmt.Errorf("failed to open the personal store: %v", err)
 	}
-	return deletedAny, nil
+	defer windows.CertCloseStore(my, 0)
+	return windows.CertAddCertificateContextToStore(my, cert, windows.CERT_STORE_ADD_REPLACE_EXISTING, nil)
 }
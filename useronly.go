@@ -0,0 +1,53 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime"
+)
+
+// noSudo is set by -user-only, and makes commandWithSudo never use sudo.
+var noSudo bool
+
+// printUserOnlyReport explains which applications will pick up the local CA
+// installed with -user-only, and which won't.
+func (m *mkcert) printUserOnlyReport() {
+	var will, wont []string
+	if systemStoreEnabled() {
+		switch runtime.GOOS {
+		case "darwin":
+			will = append(will, "Safari, Chrome and other apps using the login keychain, for this user")
+			wont = append(wont, "daemons and apps running as other users")
+		case "windows":
+			will = append(will, "Edge, Chrome and other apps using the Windows certificate store, for this user")
+			wont = append(wont, "services running as other accounts, like LocalSystem")
+		default:
+			wont = append(wont, "curl, OpenSSL, Go and other apps using the system certificate bundle")
+		}
+	}
+	if nssStoreEnabled() && hasNSS && canManageNSS() {
+		will = append(will, "the "+NSSBrowsers+" profiles of this user")
+	}
+	if storeEnabled("java") && hasJava && hasKeytool {
+		will = append(will, "Java apps started with JAVA_TOOL_OPTIONS=\""+m.javaToolOptions()+"\"")
+		wont = append(wont, "other Java apps, which use the JDK cacerts")
+	}
+
+	m.logln("")
+	if len(will) == 0 {
+		m.logln("With -user-only, no application will trust the local CA on this system! ⚠️")
+	} else {
+		m.logln("With -user-only, the local CA will be trusted by:")
+		for _, w := range will {
+			m.logf(" ✅ %s", w)
+		}
+	}
+	if len(wont) > 0 {
+		m.logln("It will not be trusted by:")
+		for _, w := range wont {
+			m.logf(" ❌ %s", w)
+		}
+	}
+}
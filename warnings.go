@@ -0,0 +1,64 @@
+// Copyright 2018 The mkcert Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Warning is an advisory about an operation that still succeeded, like the
+// local CA not being installed in a trust store. Warnings are logged as they
+// happen, and also returned by Run so that callers can surface them.
+type Warning struct {
+	// Kind is one of the Warning* constants.
+	Kind string `json:"kind"`
+	// Store is the trust store the warning is about ("system", "nss" or
+	// "java"), if any.
+	Store string `json:"store,omitempty"`
+	// Message is the text that was logged.
+	Message string `json:"message"`
+}
+
+const (
+	// WarningNotInstalled means the local CA is not in a trust store.
+	WarningNotInstalled = "not-installed"
+	// WarningNotTrusted means the local CA was installed but is not trusted.
+	WarningNotTrusted = "not-trusted"
+	// WarningStoreUnsupported means a trust store can't be managed on this
+	// system, for example because certutil or keytool are missing.
+	WarningStoreUnsupported = "store-unsupported"
+	// WarningHostname means a name might not be accepted by all clients.
+	WarningHostname = "hostname"
+	// WarningRenamed means the output files were renamed to avoid
+	// overwriting an unrelated certificate.
+	WarningRenamed = "renamed"
+	// WarningPermissions means the CA is accessible to other users.
+	WarningPermissions = "permissions"
+	// WarningPolicy means browsers will reject a certificate that was
+	// issued anyway because of -allow-noncompliant.
+	WarningPolicy = "policy"
+	// WarningRevocation means certificates might not be revocable, or
+	// revocation might not be checked correctly.
+	WarningRevocation = "revocation"
+)
+
+// warn logs a warning and collects it for Run to return.
+func (m *mkcert) warn(kind, store, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	m.logln(msg)
+	m.warningsMu.Lock()
+	defer m.warningsMu.Unlock()
+	m.warnings = append(m.warnings, Warning{Kind: kind, Store: store, Message: strings.TrimSpace(msg)})
+}
+
+// takeWarnings returns the collected warnings and resets them.
+func (m *mkcert) takeWarnings() []Warning {
+	m.warningsMu.Lock()
+	defer m.warningsMu.Unlock()
+	w := m.warnings
+	m.warnings = nil
+	return w
+}